@@ -4,8 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"math"
+	"regexp"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 	"unicode/utf8"
 
 	sitter "github.com/smacker/go-tree-sitter"
@@ -14,7 +21,8 @@ import (
 
 func NewTextDocument(text string) *TextDocument {
 	doc := TextDocument{
-		Text: text,
+		Text:             text,
+		PositionEncoding: UTF16,
 	}
 
 	doc.UpdateLines()
@@ -22,9 +30,23 @@ func NewTextDocument(text string) *TextDocument {
 	return &doc
 }
 
+// Same as NewTextDocument() but reads text from r
+func NewTextDocumentFromReader(r io.Reader) (*TextDocument, error) {
+	text, err := io.ReadAll(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewTextDocument(string(text)), nil
+}
+
 type TextDocument struct {
-	Text                   string
-	TextLength             UInt
+	Text       string
+	TextLength UInt
+	// Byte offsets of lines starts. There is always one line more than line terminators,
+	// so when Text ends with line terminator last line is empty and addressable only with character 0,
+	// same as end of document position in LSP
 	Lines                  []UInt
 	Tree                   *sitter.Tree
 	Parser                 *sitter.Parser
@@ -32,14 +54,121 @@ type TextDocument struct {
 	HighlightIgnore        *Ignore
 	HighlightCaptures      []*sitter.QueryCapture
 	HighlightCapturesDirty bool
+	// Changes of HighlightCaptures made by last UpdateTree() after edits, when captures were up to date before edits.
+	// Start and Delete are indexes of HighlightCaptures before update, Data is nil. nil when captures were dirty
+	HighlightEdits []HighlightEdit
+	// Embedded languages, their captures are merged with HighlightCaptures
+	Injections       []*Injection
+	PositionEncoding PositionEncoding
+	// Clamp positions with ClampPosition() in PositionToByteIndex() and PositionToPoint() instead of returning error
+	Lenient bool
+	// First detected line terminator: "\n", "\r\n" or "\r". Empty when Text is single line
+	LineEnding string
+	// Tab stop width for PositionToVisualColumn(). Zero means tab is one column
+	TabWidth UInt
+	// Version of last change applied with ChangeVersioned()
+	Version int32
+	// How overlapping captures are resolved in ConvertHighlightCaptures()
+	TokenConflictResolution TokenConflictResolution
+	// Compare old and new Tree in UpdateTree() for LastChangedRanges()
+	TrackChangedRanges bool
+	// SetTextIncremental() will fully reparse when changed part of new text is larger than rest of it
+	FullReparseLargeDiff bool
 
 	lastLineOffset lineOffsetColumn
+	// tree-sitter rows offsets, splitted only by "\n". nil when same as Lines
+	rows []UInt
+	// document is used by SyncTextDocument, so readers should not write any cache
+	shared bool
+	// Text was changed after last successful parse
+	treeDirty bool
+	// Text was fully replaced after last successful parse, so Tree can not be used for incremental parse
+	fullParse bool
+	// Max end byte of HighlightCaptures up to each index, for GetHighlightCapturesInLine()
+	capturesMaxEnd []UInt
+	// Byte ranges of HighlightCaptures nodes
+	captureRanges []byteRange
+	// Query pattern indexes of HighlightCaptures
+	capturePatterns []uint16
+	// Text as bytes for Bytes(), nil after change of Text
+	bytes []byte
+	// Max duration of UpdateTree() parsing, zero means no limit
+	parseTimeout time.Duration
+	// Token types of captures instead of legend, see SetCaptureMapper()
+	captureMapper func(cap *sitter.QueryCapture, name string) (TokenType, bool)
+	// Parsers for DetectGrammar() in order of registration
+	grammars []grammar
+	// Edits of Tree since last parse, to compare HighlightCaptures before and after parse
+	edits []byteEdit
+	// Sorted not overlapping byte ranges changed by last UpdateTree(), when TrackChangedRanges is on
+	changedRanges []byteRange
+}
+
+// Wrapper of TextDocument for concurrent usage. Every public method of TextDocument has wrapper with same signature,
+// writers are under write lock and readers under read lock.
+// TextDocument methods do not lock anything, so calling them inside Read() or Write() will not deadlock,
+// but calling SyncTextDocument methods inside Read() or Write() will.
+// Nodes and captures returned by readers are valid only until next write
+type SyncTextDocument struct {
+	doc *TextDocument
+	mu  sync.RWMutex
+}
+
+// Unit in which Position.Character is measured
+type PositionEncoding uint8
+
+const (
+	// UTF-16 code units, default for LSP
+	UTF16 PositionEncoding = iota
+	// bytes
+	UTF8
+	// unicode code points (runes)
+	UTF32
+	// user-perceived characters, base rune with following combining marks, variation selectors,
+	// emoji modifiers and zero width joiners is one character. Joined emoji sequences and flags are not clustered
+	Grapheme
+)
+
+// Semantic tokens of LSP can not overlap, so overlapping captures should be resolved before encoding
+type TokenConflictResolution uint8
+
+const (
+	// all captures are encoded, even overlapping and zero length ones
+	KeepAllTokens TokenConflictResolution = iota
+	// shortest of overlapping captures is kept, others are dropped. Zero length captures are dropped
+	KeepInnermostToken
+	// capture with lowest index in query is kept, so capture names should be ordered by importance.
+	// Innermost capture is kept for same index. Zero length captures are dropped
+	KeepPriorityToken
+	// capture of earliest pattern in query is kept, like in tree-sitter-highlight.
+	// Innermost capture is kept for same pattern. Zero length captures are dropped
+	KeepPatternPriorityToken
+)
+
+// Highlight capture with index of query pattern which produced it
+type HighlightCapture struct {
+	*sitter.QueryCapture
+	PatternIndex uint16
+}
+
+// Region of document parsed with other language
+type Injection struct {
+	Region Range
+	Tree   *sitter.Tree
+	// Indexes of query captures should match indexes of main HighlightQuery captures,
+	// so merged captures can be converted with same legend
+	Query *sitter.Query
+
+	parser   *sitter.Parser
+	language *sitter.Language
 }
 
 type HighlightEdit struct {
 	Start  UInt
 	Delete UInt
 	Insert []*sitter.QueryCapture
+	// Insert encoded same way as ConvertHighlightCaptures() result
+	Data []UInt
 }
 
 type HighlightLegend = []TokenType
@@ -52,23 +181,109 @@ type TokenType struct {
 type Token struct {
 	Position
 	TokenType
+	// in units of PositionEncoding
 	Length UInt
 }
 
+type documentSymbol struct {
+	proto.DocumentSymbol
+	start    UInt
+	end      UInt
+	children []*documentSymbol
+}
+
+type byteEdit struct {
+	start  UInt
+	oldEnd UInt
+	newEnd UInt
+}
+
+type byteRange struct {
+	start UInt
+	end   UInt
+}
+
 type lineOffsetColumn struct {
 	line   UInt
 	offset UInt
 	column UInt
+	// column is valid only for encoding in which it was counted
+	encoding PositionEncoding
 }
 
+// Kinds of nodes which captures should be ignored
 type Ignore struct {
 	Missing bool
 	Extra   bool
-	Named   bool
-	Error   bool
-	Null    bool
+	// ignore named nodes, like identifiers, so only anonymous nodes left
+	Named bool
+	// ignore anonymous nodes, like punctuation, so only named nodes left
+	Anonymous bool
+	Error     bool
+	Null      bool
+	// ignore captures with same node and capture name as previous ones, when name is used in many patterns
+	Duplicates bool
+}
+
+// Text predicate of query pattern, like #eq?, #match? or #any-of? and their #not- versions
+type queryPredicate struct {
+	name   string
+	negate bool
+	// capture of node which text is checked
+	capture uint32
+	// capture of right side of #eq?, -1 when values are used
+	other  int64
+	values []string
+	// nil when pattern of #match? is invalid, so predicate never matches
+	regexp *regexp.Regexp
+}
+
+// Options of GetNodesByRangeOpts(). Children of nodes which not match NamedOnly or Types are checked instead
+type NodeRangeOptions struct {
+	NamedOnly bool
+	// Nodes deeper than MaxDepth are not visited, root node has depth 0. Zero means no limit
+	MaxDepth int
+	// Node types to return, empty means all types
+	Types []string
+}
+
+func (opts *NodeRangeOptions) match(node *Node) bool {
+	if opts.NamedOnly && !node.IsNamed() {
+		return false
+	}
+
+	return len(opts.Types) == 0 || slices.Contains(opts.Types, node.Type())
+}
+
+func (opts *NodeRangeOptions) isMaxDepth(node *Node) bool {
+	if opts.MaxDepth <= 0 {
+		return false
+	}
+
+	depth := 0
+
+	for parent := node.Parent(); parent != nil; parent = parent.Parent() {
+		depth++
+	}
+
+	return depth >= opts.MaxDepth
 }
 
+// Returned by ChangeVersioned() when version is not greater than current Version
+var ErrStaleVersion = errors.New("version of change is not newer than document version")
+
+// Returned by node query methods when Tree was not regenerated after last change of Text
+var ErrTreeDirty = errors.New("tree is not up to date with text")
+
+// Returned by RootNode() and node query methods when there is no Tree
+var ErrNoTree = errors.New("document has no tree")
+
+// Returned by UpdateTree() when parse takes longer than timeout of SetParseTimeout(), old Tree is kept
+var ErrParseTimeout = errors.New("parse timeout exceeded")
+
+// Same as ErrNoTree but when there is no Tree because Parser was not set
+var ErrNoParser = fmt.Errorf("document has no parser: %w", ErrNoTree)
+
 type (
 	UInt        = proto.UInteger
 	ChangeEvent = proto.TextDocumentContentChangeEvent
@@ -82,694 +297,5153 @@ func (doc *TextDocument) Change(e *ChangeEvent) error {
 	return doc.ChangeCtx(e, nil)
 }
 
+// Apply change event. If e.Range is nil then whole text will be replaced, same as SetTextCtx()
 func (doc *TextDocument) ChangeCtx(e *ChangeEvent, ctx *context.Context) error {
-	start, err := doc.PositionToByteIndex(&e.Range.Start)
+	if e.Range == nil {
+		err := doc.SetTextCtx(e.Text, ctx)
 
-	if err != nil {
-		return err
+		if err != nil {
+			return err
+		}
+
+		return doc.UpdateHighlightCapturesCtx(contextOrBackground(ctx))
 	}
 
-	end, err := doc.PositionToByteIndex(&e.Range.End)
+	err := doc.applyChange(e)
 
 	if err != nil {
 		return err
 	}
 
-	startPoint, err := doc.PositionToPoint(&e.Range.Start)
+	return doc.updateTreeAndHighlights(ctx)
+}
+
+// UpdateTree() and then UpdateHighlightCapturesCtx(), used by all changes
+func (doc *TextDocument) updateTreeAndHighlights(ctx *context.Context) error {
+	err := doc.UpdateTree(ctx)
 
 	if err != nil {
 		return err
 	}
 
-	oldEndPoint, err := doc.PositionToPoint(&e.Range.End)
+	return doc.UpdateHighlightCapturesCtx(contextOrBackground(ctx))
+}
 
-	if err != nil {
-		return err
-	}
+// Same as ChangeCtx() but returns range of inserted text in changed document
+func (doc *TextDocument) ChangeResult(e *ChangeEvent, ctx *context.Context) (*Range, error) {
+	start := UInt(0)
 
-	doc.Text = doc.Text[:start] + e.Text + doc.Text[end:]
-	doc.UpdateLines()
+	if e.Range != nil {
+		index, err := doc.PositionToByteIndex(&e.Range.Start)
 
-	if doc.Tree == nil {
-		return doc.UpdateTree(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		start = index
 	}
 
-	newEndIndex := start + UInt(len(e.Text))
-	newEndPoint, err := doc.ByteIndexToPoint(newEndIndex)
+	err := doc.ChangeCtx(e, ctx)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	doc.Tree.Edit(sitter.EditInput{
-		StartIndex:  start,
-		OldEndIndex: end,
-		NewEndIndex: newEndIndex,
-		StartPoint:  *startPoint,
-		OldEndPoint: *oldEndPoint,
-		NewEndPoint: *newEndPoint,
-	})
+	return doc.ByteRangeToRange(start, start+UInt(len(e.Text)))
+}
 
-	err = doc.UpdateTree(ctx)
+// Apply events one by one, each event Range should refer to document state after previous events.
+// Tree will be parsed only once after all events are applied
+func (doc *TextDocument) ChangeMany(events []*ChangeEvent, ctx *context.Context) error {
+	for _, e := range events {
+		err := doc.applyChange(e)
 
-	if err != nil {
-		return err
+		if err != nil {
+			return err
+		}
 	}
 
-	return nil
+	return doc.updateTreeAndHighlights(ctx)
 }
 
-func NewRange(startLine UInt, startChar UInt, endLine UInt, endChar UInt) *Range {
-	return &Range{
-		Start: Position{
-			Line:      startLine,
-			Character: startChar,
-		},
-		End: Position{
-			Line:      endLine,
-			Character: endChar,
-		},
+// Same as ChangeCtx() but returns ErrStaleVersion if version <= doc.Version, so out of order changes are not applied.
+// Version is updated only on success
+func (doc *TextDocument) ChangeVersioned(version int32, e *ChangeEvent) error {
+	if version <= doc.Version {
+		return ErrStaleVersion
 	}
-}
 
-func (doc *TextDocument) UpdateLines() {
-	lines := strings.Split(doc.Text, "\n")
-	doc.Lines = make([]UInt, len(lines))
-	doc.TextLength = UInt(len(doc.Text))
-	doc.lastLineOffset = lineOffsetColumn{}
-	offset := UInt(0)
+	err := doc.Change(e)
 
-	for i, line := range lines {
-		doc.Lines[i] = offset
-		offset += 1 + UInt(len(line))
+	if err != nil {
+		return err
 	}
-}
-
-// Same as SetTextCtx with ctx = nil
-func (doc *TextDocument) SetText(text string) error {
-	return doc.SetTextCtx(text, nil)
-}
-
-// Set Text, call UpdateLines() and UpdateTree(), be aware of how UpdateTree() will generate new Tree
-func (doc *TextDocument) SetTextCtx(text string, ctx *context.Context) error {
-	doc.Text = text
-	doc.UpdateLines()
 
-	return doc.UpdateTree(ctx)
-}
+	doc.Version = version
 
-// Same as SetParserCtx() with ctx = nil
-func (doc *TextDocument) SetParser(parser *sitter.Parser) error {
-	return doc.SetParserCtx(parser, nil)
+	return nil
 }
 
-// Will set Parser and call UpdateTree()
-func (doc *TextDocument) SetParserCtx(parser *sitter.Parser, ctx *context.Context) error {
-	doc.Parser = parser
+// Same as ChangeMany() but with content changes of didChange notification as values
+func (doc *TextDocument) ApplyDidChange(changes []ChangeEvent, ctx *context.Context) error {
+	events := make([]*ChangeEvent, len(changes))
 
-	return doc.UpdateTree(ctx)
-}
+	for i := range changes {
+		events[i] = &changes[i]
+	}
 
-func (doc *TextDocument) SetHighlightQuery(query *sitter.Query, ignore *Ignore) {
-	doc.HighlightQuery = query
-	doc.HighlightIgnore = ignore
-	doc.UpdateHighlightCaptures()
+	return doc.ChangeMany(events, ctx)
 }
 
-// Will update Tree. If Tree present and NOT changed then it will be fully regenerated.
-// If Tree has changes then it will be used to generate new Tree
-func (doc *TextDocument) UpdateTree(ctx *context.Context) error {
-	if doc.Parser == nil {
-		return nil
+// Apply ContentChanges of didChange notification params, they could be
+// TextDocumentContentChangeEvent or TextDocumentContentChangeEventWhole. Version is ignored
+func (doc *TextDocument) ApplyDidChangeParams(params *proto.DidChangeTextDocumentParams, ctx *context.Context) error {
+	events := make([]*ChangeEvent, len(params.ContentChanges))
+
+	for i, change := range params.ContentChanges {
+		switch e := change.(type) {
+		case ChangeEvent:
+			events[i] = &e
+		case *ChangeEvent:
+			events[i] = e
+		case proto.TextDocumentContentChangeEventWhole:
+			events[i] = &ChangeEvent{Text: e.Text}
+		case *proto.TextDocumentContentChangeEventWhole:
+			events[i] = &ChangeEvent{Text: e.Text}
+		default:
+			return fmt.Errorf("unknown content change type %T", change)
+		}
 	}
 
-	oldTree := doc.Tree
+	return doc.ChangeMany(events, ctx)
+}
 
-	if doc.Tree != nil && !doc.Tree.RootNode().HasChanges() {
-		doc.Tree = nil
+// Update Text, Lines and edit Tree without parsing
+func (doc *TextDocument) applyChange(e *ChangeEvent) error {
+	if e.Range == nil {
+		doc.replaceText(e.Text)
+		return nil
 	}
 
-	if ctx == nil {
-		c := context.Background()
-		ctx = &c
-	}
+	// points are needed only for Tree edit
+	withPoints := doc.Tree != nil
 
-	tree, err := doc.Parser.ParseCtx(*ctx, oldTree, []byte(doc.Text))
+	start, startPoint, _, err := doc.positionToIndexPoint(&e.Range.Start, withPoints)
 
 	if err != nil {
-		doc.Tree = oldTree
 		return err
 	}
 
-	if oldTree != nil {
-		oldTree.Close()
-	}
+	end, oldEndPoint := start, startPoint
 
-	doc.Tree = tree
-	doc.HighlightCapturesDirty = true
+	// insertion has same start and end, so end is not converted again
+	if e.Range.End != e.Range.Start {
+		end, oldEndPoint, _, err = doc.positionToIndexPoint(&e.Range.End, withPoints)
 
-	return nil
-}
+		if err != nil {
+			return err
+		}
+	}
 
-func (doc *TextDocument) UpdateHighlightCaptures() {
-	if doc.Tree == nil || doc.HighlightQuery == nil || !doc.HighlightCapturesDirty {
-		return
+	// same as in ChangeBytes(), reversed range is a client bug, so it is not normalized
+	if start > end {
+		return fmt.Errorf("range start %d:%d is after end %d:%d", e.Range.Start.Line, e.Range.Start.Character, e.Range.End.Line, e.Range.End.Character)
 	}
 
-	doc.HighlightCaptures = doc.GetHighlightCapturesInNode(doc.Tree.RootNode())
-	doc.HighlightCapturesDirty = false
+	return doc.applyByteChange(start, end, startPoint, oldEndPoint, e.Text)
 }
 
-func (doc *TextDocument) GetHighlightCapturesByRange(start *Point, end *Point) []*sitter.QueryCapture {
-	doc.UpdateHighlightCaptures()
+// Same as ChangeCtx() but with byte indexes of old text instead of positions
+func (doc *TextDocument) ChangeBytes(start UInt, end UInt, text string, ctx *context.Context) error {
+	if start > end {
+		return fmt.Errorf("start byte index %d is greater than end %d", start, end)
+	}
 
-	list := make([]*sitter.QueryCapture, 0)
+	startPoint, err := doc.ByteIndexToPoint(start)
 
-	for _, cap := range doc.HighlightCaptures {
-		if NodeOverlapsRange(cap.Node, start, end) {
-			list = append(list, cap)
-		}
+	if err != nil {
+		return err
 	}
 
-	return list
-}
+	oldEndPoint := startPoint
 
-func (doc *TextDocument) GetHighlightCaptureByPosition(pos *Position) (*sitter.QueryCapture, error) {
-	point, err := doc.PositionToPoint(pos)
+	if end != start {
+		oldEndPoint, err = doc.ByteIndexToPoint(end)
 
-	if err != nil {
-		return nil, err
+		if err != nil {
+			return err
+		}
 	}
 
-	doc.UpdateHighlightCaptures()
+	err = doc.applyByteChange(start, end, startPoint, oldEndPoint, text)
 
-	for _, cap := range doc.HighlightCaptures {
-		if NodeOverlapsRange(cap.Node, point, point) {
-			return cap, nil
-		}
+	if err != nil {
+		return err
 	}
 
-	return nil, nil
+	return doc.updateTreeAndHighlights(ctx)
 }
 
-func (doc *TextDocument) GetClosestHighlightCaptureByPosition(pos *Position) (prev *sitter.QueryCapture, target *sitter.QueryCapture, next *sitter.QueryCapture, err error) {
-	point, err := doc.PositionToPoint(pos)
+// Replace text of node with ChangeCtx(), so Tree is edited incrementally. Node should be from current Tree,
+// so error is returned when Tree is dirty or node is out of Text
+func (doc *TextDocument) ReplaceNode(node *Node, text string, ctx *context.Context) error {
+	err := doc.checkTree()
 
 	if err != nil {
-		return
+		return err
 	}
 
-	doc.UpdateHighlightCaptures()
+	start, end, err := doc.NodeToByteRange(node)
 
-	for _, cap := range doc.HighlightCaptures {
-		switch CompareNodeWithRange(cap.Node, point, point) {
-		case -1:
-			prev = cap
+	if err != nil {
+		return err
+	}
 
-		case 2:
-			next = cap
-			return
+	r, err := doc.ByteRangeToRange(start, end)
 
-		default:
-			target = cap
-		}
+	if err != nil {
+		return err
 	}
 
-	return
+	return doc.ChangeCtx(&ChangeEvent{Range: r, Text: text}, ctx)
 }
 
-func (doc *TextDocument) GetHighlightCapturesInNode(root *Node) []*sitter.QueryCapture {
-	qc := sitter.NewQueryCursor()
-	qc.Exec(doc.HighlightQuery, root)
-	defer qc.Close()
+func (doc *TextDocument) applyByteChange(start UInt, end UInt, startPoint *Point, oldEndPoint *Point, text string) error {
+	newEndIndex := start + UInt(len(text))
+	regions := doc.injectionRegions()
+	doc.Text = doc.Text[:start] + text + doc.Text[end:]
+	doc.updateLinesRange(start, end, newEndIndex)
+	doc.shiftInjections(regions, byteEdit{start, end, newEndIndex})
 
-	list := make([]*sitter.QueryCapture, 0)
+	if doc.Tree == nil {
+		return nil
+	}
 
-	for {
-		match, ok := qc.NextMatch()
+	// deletion ends at start and text without "\n" ends on same row, so rows are not searched
+	newEndPoint := &Point{
+		Row:    startPoint.Row,
+		Column: startPoint.Column + UInt(len(text)),
+	}
 
-		if !ok {
-			break
-		}
+	if strings.IndexByte(text, '\n') >= 0 {
+		var err error
 
-		for _, cap := range match.Captures {
-			if shouldIgnore(doc.HighlightIgnore, cap.Node) {
-				continue
-			}
+		newEndPoint, err = doc.ByteIndexToPoint(newEndIndex)
 
-			list = append(list, &cap)
+		if err != nil {
+			return err
 		}
 	}
 
-	return list
-}
-
-func (doc *TextDocument) PositionToByteIndex(pos *Position) (UInt, error) {
-	linesCount := UInt(len(doc.Lines))
+	doc.Tree.Edit(sitter.EditInput{
+		StartIndex:  start,
+		OldEndIndex: end,
+		NewEndIndex: newEndIndex,
+		StartPoint:  *startPoint,
+		OldEndPoint: *oldEndPoint,
+		NewEndPoint: *newEndPoint,
+	})
 
-	if pos.Line >= linesCount {
-		return 0, fmt.Errorf("line %d is out of range (%d)", pos.Line, linesCount-1)
-	}
+	doc.edits = append(doc.edits, byteEdit{start, end, newEndIndex})
 
-	character := UInt(0)
-	offset := doc.Lines[pos.Line]
-	max := doc.TextLength
+	return nil
+}
 
-	if pos.Line+1 < linesCount {
-		max = doc.Lines[pos.Line+1] - 1
+// Byte ranges of Injections regions, nil items for invalid regions
+func (doc *TextDocument) injectionRegions() []*byteRange {
+	if len(doc.Injections) == 0 {
+		return nil
 	}
 
-	for character < pos.Character {
-		char, size := utf8.DecodeRuneInString(doc.Text[offset:])
-
-		if char == utf8.RuneError {
-			return 0, errors.New("rune error")
-		}
+	list := make([]*byteRange, len(doc.Injections))
 
-		offset += UInt(size)
-		character++
+	for i, inj := range doc.Injections {
+		r, err := doc.RangeToSitterRange(&inj.Region)
 
-		if offset > max || (offset == max && character < pos.Character) {
-			return 0, fmt.Errorf("character %d is out of range (%d) for line %d", pos.Character, character, pos.Line)
+		if err == nil {
+			list[i] = &byteRange{r.StartByte, r.EndByte}
 		}
 	}
 
-	return offset, nil
+	return list
 }
 
-func (doc *TextDocument) ByteIndexLine(index UInt) (UInt, error) {
-	if index > doc.TextLength {
-		return 0, fmt.Errorf("byte index %d is out of range (%d)", index, doc.TextLength)
-	}
+// Move Injections regions with edit. Text inserted at region end is added to region
+func (doc *TextDocument) shiftInjections(regions []*byteRange, e byteEdit) {
+	for i, r := range regions {
+		if r == nil {
+			continue
+		}
 
-	line := UInt(len(doc.Lines) - 1)
+		shifted := e.shift(*r)
 
-	for {
-		if line == 0 || doc.Lines[line] <= index {
-			break
+		if r.end == e.start {
+			shifted.end = e.newEnd
 		}
 
-		line--
-	}
+		region, err := doc.ByteRangeToRange(shifted.start, shifted.end)
 
-	return line, nil
+		if err == nil {
+			doc.Injections[i].Region = *region
+		}
+	}
 }
 
-// byte index means number of bytes from text start
-func (doc *TextDocument) ByteIndexToPosition(index UInt) (*Position, error) {
-	line, err := doc.ByteIndexLine(index)
+func NewRange(startLine UInt, startChar UInt, endLine UInt, endChar UInt) *Range {
+	return &Range{
+		Start: Position{
+			Line:      startLine,
+			Character: startChar,
+		},
+		End: Position{
+			Line:      endLine,
+			Character: endChar,
+		},
+	}
+}
 
-	if err != nil {
-		return nil, err
+// Copy of range where Start is not after End, for ranges of right-to-left selections
+func NormalizeRange(r *Range) *Range {
+	if positionAfter(&r.Start, &r.End) {
+		return &Range{Start: r.End, End: r.Start}
 	}
 
-	offset := doc.Lines[line]
+	return &Range{Start: r.Start, End: r.End}
+}
 
-	return doc.LineByteIndexToPosition(line, index-offset)
+func positionAfter(a *Position, b *Position) bool {
+	return ComparePositions(a, b) > 0
 }
 
-func (doc *TextDocument) ByteIndexToPoint(index UInt) (*Point, error) {
-	line, err := doc.ByteIndexLine(index)
+// -1 when a is before b, 1 when a is after b and 0 when they are equal
+func ComparePositions(a *Position, b *Position) int {
+	if a.Line != b.Line {
+		if a.Line < b.Line {
+			return -1
+		}
 
-	if err != nil {
-		return nil, err
+		return 1
 	}
 
-	offset := doc.Lines[line]
+	if a.Character != b.Character {
+		if a.Character < b.Character {
+			return -1
+		}
 
-	return &Point{
-		Row:    line,
-		Column: index - offset,
-	}, nil
+		return 1
+	}
+
+	return 0
 }
 
-// index is number of bytes from line start
-func (doc *TextDocument) LineByteIndexToPosition(line UInt, index UInt) (*Position, error) {
-	offset, max, err := doc.LineMinMaxByteIndex(line)
+// True when pos is between start and end of range, both inclusive, so cursor at range end is in range.
+// Reversed range is normalized
+func PositionInRange(pos *Position, r *Range) bool {
+	r = NormalizeRange(r)
 
-	if err != nil {
-		return nil, err
+	return ComparePositions(pos, &r.Start) >= 0 && ComparePositions(pos, &r.End) <= 0
+}
+
+// Will update Lines offsets. Lines are splitted by "\n", "\r\n" and "\r"
+func (doc *TextDocument) UpdateLines() {
+	doc.scanLines(nil)
+}
+
+// Scan Text for lines using backing array of lines when it is not nil
+func (doc *TextDocument) scanLines(lines []UInt) {
+	text := doc.Text
+	doc.bytes = nil
+
+	// text before first line terminator is skipped, so single line text is not scanned byte by byte
+	first := strings.IndexByte(text, '\n')
+
+	if first < 0 {
+		first = len(text)
 	}
 
-	column := UInt(0)
-	index += offset
-	last := &doc.lastLineOffset
+	if cr := strings.IndexByte(text[:first], '\r'); cr >= 0 {
+		first = cr
+	}
 
-	if last.line == line && last.offset <= index {
-		offset = last.offset
-		column = last.column
+	if lines == nil {
+		lines = make([]UInt, 0, strings.Count(text[first:], "\n")+1)
 	}
 
-	for {
-		if offset >= index {
-			break
-		}
+	doc.Lines = append(lines[:0], 0)
+	doc.TextLength = UInt(len(text))
+	doc.LineEnding = ""
+	doc.lastLineOffset = lineOffsetColumn{}
+	doc.treeDirty = true
+	doc.rows = nil
+	loneCR := false
 
-		char, size := utf8.DecodeRuneInString(doc.Text[offset:])
+	for i := first; i < len(text); i++ {
+		ending := ""
 
-		if char == utf8.RuneError {
-			return nil, errors.New("rune error")
-		}
+		switch text[i] {
+		case '\n':
+			ending = "\n"
 
-		offset += UInt(size)
-		column++
+		case '\r':
+			if i+1 < len(text) && text[i+1] == '\n' {
+				ending = "\r\n"
+				i++
+			} else {
+				ending = "\r"
+				loneCR = true
+			}
 
-		if offset > max {
-			return nil, fmt.Errorf("byte index %d is out of range (%d) for line %d", index-doc.Lines[line], max-doc.Lines[line], line)
+		default:
+			continue
 		}
+
+		if doc.LineEnding == "" {
+			doc.LineEnding = ending
+		}
+
+		doc.Lines = append(doc.Lines, UInt(i+1))
 	}
 
-	last.line = line
-	last.offset = offset
-	last.column = column
+	if !loneCR {
+		return
+	}
 
-	return &Position{
-		Line:      line,
-		Character: column,
-	}, nil
-}
+	// tree-sitter counts rows only by "\n"
+	doc.rows = make([]UInt, 1, len(doc.Lines))
 
-func (doc *TextDocument) PointToPosition(point Point) (*Position, error) {
-	return doc.LineByteIndexToPosition(point.Row, point.Column)
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			doc.rows = append(doc.rows, UInt(i+1))
+		}
+	}
 }
 
-func (doc *TextDocument) PositionToPoint(pos *Position) (*Point, error) {
-	index, err := doc.PositionToByteIndex(pos)
+// Update Lines after Text[start:end] of old text was replaced with Text[start:newEnd].
+// Only lines of edited region will be rescanned, lines after it will be shifted
+func (doc *TextDocument) updateLinesRange(start UInt, end UInt, newEnd UInt) {
+	text := doc.Text
+	doc.bytes = nil
 
-	if err != nil {
-		return nil, err
+	// lone "\r" changes tree-sitter rows, so it is simpler to rescan everything
+	if doc.rows != nil || strings.IndexByte(text[start:newEnd], '\r') >= 0 || (start > 0 && text[start-1] == '\r') {
+		doc.UpdateLines()
+		return
 	}
 
-	offset := doc.Lines[pos.Line]
+	old := doc.Lines
+	textLength := UInt(len(text))
 
-	return &Point{
-		Row:    pos.Line,
-		Column: index - offset,
-	}, nil
-}
+	// edit of last line without line terminators, like in single line text, keeps Lines
+	if old[len(old)-1] <= start && strings.IndexByte(text[start:newEnd], '\n') < 0 {
+		doc.TextLength = textLength
+		doc.lastLineOffset = lineOffsetColumn{}
+		doc.treeDirty = true
+		return
+	}
 
-func (doc *TextDocument) NodeToRange(node *Node) (*proto.Range, error) {
-	start, err := doc.PointToPosition(node.StartPoint())
+	first := sort.Search(len(old), func(i int) bool { return old[i] >= start })
+	last := sort.Search(len(old), func(i int) bool { return old[i] > end+1 })
+	lines := make([]UInt, 0, len(old)-last+first+int(newEnd-start)/16+2)
+	lines = append(lines, old[:first]...)
 
-	if err != nil {
-		return nil, err
+	if first == 0 {
+		lines = append(lines, 0)
 	}
 
-	end, err := doc.PointToPosition(node.EndPoint())
+	// line terminator right before start can be part of edited line terminator
+	i := start
 
-	if err != nil {
-		return nil, err
+	if i > 0 {
+		i--
 	}
 
-	return &proto.Range{
-		Start: *start,
-		End:   *end,
-	}, nil
-}
+	for ; i <= newEnd && i < textLength; i++ {
+		switch text[i] {
+		case '\n':
+			lines = append(lines, i+1)
 
-func (doc *TextDocument) LineMinMaxByteIndex(line UInt) (UInt, UInt, error) {
-	linesCount := UInt(len(doc.Lines))
+		case '\r':
+			if i+1 < textLength && text[i+1] == '\n' {
+				i++
+			}
 
-	if line >= linesCount {
-		return 0, 0, fmt.Errorf("line %d is out of range (%d)", line, linesCount)
+			lines = append(lines, i+1)
+		}
 	}
 
-	min := doc.Lines[line]
-	max := doc.TextLength
+	scanned := lines[len(lines)-1]
+
+	for _, offset := range old[last:] {
+		offset = offset - end + newEnd
 
-	if line+1 < linesCount {
-		max = doc.Lines[line+1] - 1
+		if offset > scanned {
+			lines = append(lines, offset)
+		}
 	}
 
-	return min, max, nil
-}
+	doc.Lines = lines
+	doc.TextLength = textLength
+	doc.lastLineOffset = lineOffsetColumn{}
+	doc.treeDirty = true
+	doc.LineEnding = ""
 
-func (doc *TextDocument) GetNonSpaceTextAroundPosition(pos *Position) (string, error) {
-	end, err := doc.PositionToByteIndex(pos)
+	if len(lines) > 1 {
+		doc.LineEnding = "\n"
 
-	if err != nil {
-		return "", err
+		if lines[1] > 1 && text[lines[1]-2] == '\r' {
+			doc.LineEnding = "\r\n"
+		}
 	}
+}
 
-	start := end
-	min, max, err := doc.LineMinMaxByteIndex(pos.Line)
+// Reuse document for new text. Tree and Injections will be closed, Lines backing array will be reused.
+// Parser, HighlightQuery and other settings are kept, call UpdateTree() to parse new text
+func (doc *TextDocument) Reset(text string) {
+	doc.Close()
+	doc.Text = text
+	doc.scanLines(doc.Lines)
+}
 
-	if err != nil {
-		return "", err
+// Free C memory of Tree and Injections. Parser and HighlightQuery are owned by caller, so they are not closed.
+// Safe to call more than once
+func (doc *TextDocument) Close() {
+	if doc.Tree != nil {
+		doc.Tree.Close()
+		doc.Tree = nil
 	}
 
-	for {
-		if start <= min {
-			start = min
-			break
+	for _, inj := range doc.Injections {
+		if inj.Tree != nil {
+			inj.Tree.Close()
+			inj.Tree = nil
 		}
 
-		char, size := utf8.DecodeLastRuneInString(doc.Text[min:start])
+		inj.parser.Close()
+	}
 
-		if char == utf8.RuneError {
-			return "", errors.New("rune error")
-		}
+	doc.Injections = nil
+	doc.HighlightCaptures = nil
+	doc.HighlightCapturesDirty = false
+	doc.HighlightEdits = nil
+	doc.capturesMaxEnd = nil
+	doc.captureRanges = nil
+	doc.capturePatterns = nil
+	doc.edits = nil
+	doc.fullParse = false
+	doc.changedRanges = nil
+}
 
-		if char == ' ' {
-			break
+// Independent copy of document for speculative edits. Tree is copied with Tree.Copy(), which is cheap,
+// Injections get own parsers. Parser, HighlightQuery and HighlightIgnore are shared with original document,
+// so Parser should not be used by both documents concurrently.
+// HighlightCaptures nodes belong to original Tree, so they are dirty in clone until next UpdateHighlightCaptures()
+func (doc *TextDocument) Clone() *TextDocument {
+	c := *doc
+	c.Lines = slices.Clone(doc.Lines)
+	c.rows = slices.Clone(doc.rows)
+	c.edits = slices.Clone(doc.edits)
+	c.grammars = slices.Clone(doc.grammars)
+	c.shared = false
+	c.HighlightCaptures = nil
+	c.HighlightCapturesDirty = doc.Tree != nil && doc.HighlightQuery != nil
+	c.HighlightEdits = nil
+	c.capturesMaxEnd = nil
+	c.captureRanges = nil
+	c.capturePatterns = nil
+
+	if doc.Tree != nil {
+		c.Tree = doc.Tree.Copy()
+	}
+
+	c.Injections = nil
+
+	for _, inj := range doc.Injections {
+		clone := *inj
+		clone.parser = sitter.NewParser()
+		clone.parser.SetLanguage(inj.language)
+
+		if inj.Tree != nil {
+			clone.Tree = inj.Tree.Copy()
 		}
 
-		start -= UInt(size)
+		c.Injections = append(c.Injections, &clone)
 	}
 
-	for {
-		if end >= max {
-			end = max
-			break
-		}
+	return &c
+}
 
-		char, size := utf8.DecodeRuneInString(doc.Text[end:max])
+// Text ends with line terminator, so last line of Lines is empty
+func (doc *TextDocument) HasFinalNewline() bool {
+	return len(doc.Lines) > 1 && doc.Lines[len(doc.Lines)-1] == doc.TextLength
+}
 
-		if char == utf8.RuneError {
-			return "", errors.New("rune error")
-		}
+// Number of lines without empty line after final line terminator, so "a\nb" and "a\nb\n" both have 2 lines
+// and empty Text has 0 lines
+func (doc *TextDocument) LineCount() UInt {
+	if doc.TextLength == 0 {
+		return 0
+	}
 
-		if char == ' ' {
-			break
-		}
+	count := UInt(len(doc.Lines))
 
-		end += UInt(size)
+	if doc.HasFinalNewline() {
+		count--
 	}
 
-	return doc.Text[start:end], nil
+	return count
 }
 
-func (doc *TextDocument) GetNodesByRange(start *Position, end *Position) ([]*Node, error) {
-	tree := doc.Tree
-	root := tree.RootNode()
-	targets := make([]*Node, 0)
-
-	startPoint, err := doc.PositionToPoint(start)
+// Text was changed but Tree was not regenerated because of parse error or because there is no Parser
+func (doc *TextDocument) TreeDirty() bool {
+	return doc.treeDirty
+}
 
-	if err != nil {
-		return nil, err
+// ErrTreeDirty when Tree is present but not up to date with Text
+func (doc *TextDocument) checkTree() error {
+	if doc.Tree != nil && doc.treeDirty {
+		return ErrTreeDirty
 	}
 
-	var endPoint *Point
+	return nil
+}
 
-	if end == nil {
-		endPoint = startPoint
-	} else {
-		endPoint, err = doc.PositionToPoint(end)
+// True when Tree is present, even if it is dirty
+func (doc *TextDocument) HasTree() bool {
+	return doc.Tree != nil
+}
+
+// Root node of Tree. When Parser is set but there is no Tree yet, Tree will be parsed,
+// but not in SyncTextDocument readers. ErrNoParser or ErrNoTree when there is still no Tree
+func (doc *TextDocument) RootNode() (*Node, error) {
+	if doc.Tree == nil && doc.Parser != nil && !doc.shared {
+		err := doc.UpdateTree(nil)
 
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if CompareNodeWithRange(root, startPoint, endPoint) == 0 {
-		return append(targets, root), nil
+	if doc.Tree == nil {
+		if doc.Parser == nil {
+			return nil, ErrNoParser
+		}
+
+		return nil, ErrNoTree
 	}
 
-	c := sitter.NewTreeCursor(root)
-	defer c.Close()
+	err := doc.checkTree()
 
-	VisitNode(c, func(node *Node) int8 {
-		switch CompareNodeWithRange(node, startPoint, endPoint) {
-		case -1:
-			return 1
+	if err != nil {
+		return nil, err
+	}
 
-		case 0:
-			targets = append(targets, node)
-			return 1
+	return doc.Tree.RootNode(), nil
+}
 
-		case 1:
-			if node.ChildCount() > 0 {
-				return 0
-			} else {
-				targets = append(targets, node)
-				return 1
-			}
+// Same as SetTextCtx with ctx = nil
+func (doc *TextDocument) SetText(text string) error {
+	return doc.SetTextCtx(text, nil)
+}
 
-		default:
-			return -1
-		}
-	})
+// Set Text, call UpdateLines() and UpdateTree(), be aware of how UpdateTree() will generate new Tree
+func (doc *TextDocument) SetTextCtx(text string, ctx *context.Context) error {
+	doc.replaceText(text)
 
-	return targets, nil
+	return doc.UpdateTree(ctx)
 }
 
-func (doc *TextDocument) GetNodeByPosition(pos *Position) (*Node, error) {
-	nodes, err := doc.GetNodesByRange(pos, nil)
+// Set Text and update Lines, Tree will be regenerated by next parse.
+// Injections regions are moved by changed part of text, same as with SetTextDiff()
+func (doc *TextDocument) replaceText(text string) {
+	regions := doc.injectionRegions()
+	start, end, newEnd := UInt(0), UInt(0), UInt(0)
 
-	if err != nil {
-		return nil, err
+	if regions != nil {
+		start, end, newEnd = diffBounds(doc.Text, text)
 	}
 
-	if len(nodes) == 0 {
-		return nil, nil
+	doc.Text = text
+	doc.UpdateLines()
+	doc.shiftInjections(regions, byteEdit{start, end, newEnd})
+
+	// Tree does not match new text even without edits, so it should be regenerated and not reused
+	// by next parse, also when ranged edits of same batch are applied to it
+	if doc.Tree != nil {
+		doc.fullParse = true
+		doc.edits = nil
+		doc.HighlightCapturesDirty = true
 	}
-
-	return nodes[0], nil
 }
 
-func (doc *TextDocument) GetClosestNodeByPosition(pos *Position) (*Node, error) {
-	point, err := doc.PositionToPoint(pos)
+// Replace whole text with single edit made of common prefix and suffix of old and new text,
+// so Tree will be parsed incrementally instead of full regeneration
+func (doc *TextDocument) SetTextDiff(text string, ctx *context.Context) error {
+	if text == doc.Text {
+		return nil
+	}
+
+	start, end, newEnd := diffBounds(doc.Text, text)
+
+	startPoint, err := doc.ByteIndexToPoint(start)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return doc.Tree.RootNode().NamedDescendantForPointRange(*point, *point), nil
-}
+	oldEndPoint, err := doc.ByteIndexToPoint(end)
 
-func (doc *TextDocument) ConvertHighlightCaptures(legend HighlightLegend) ([]UInt, error) {
-	doc.UpdateHighlightCaptures()
+	if err != nil {
+		return err
+	}
 
-	list := doc.HighlightCaptures
-	tokens := make([]UInt, len(list)*5)
+	err = doc.applyByteChange(start, end, startPoint, oldEndPoint, text[start:newEnd])
 
-	var prev *Position
+	if err != nil {
+		return err
+	}
 
-	for i, cap := range list {
-		node := cap.Node
-		start, err := doc.PointToPosition(node.StartPoint())
+	return doc.updateTreeAndHighlights(ctx)
+}
 
-		if err != nil {
-			return nil, err
-		}
+// Same as SetTextDiff(), but when FullReparseLargeDiff is on and changed part of new text is larger than
+// unchanged part, Tree will be regenerated like in SetTextCtx(), because there is not much to reuse
+func (doc *TextDocument) SetTextIncremental(text string, ctx *context.Context) error {
+	if text == doc.Text {
+		return nil
+	}
 
-		end, err := doc.PointToPosition(node.EndPoint())
+	if doc.FullReparseLargeDiff {
+		start, _, newEnd := diffBounds(doc.Text, text)
+		changed := newEnd - start
 
-		if err != nil {
-			return nil, err
+		if changed > UInt(len(text))-changed {
+			return doc.SetTextCtx(text, ctx)
 		}
+	}
 
-		token := Token{
-			Position:  *start,
-			TokenType: legend[cap.Index],
-			Length:    UInt(end.Character - start.Character),
-		}
+	return doc.SetTextDiff(text, ctx)
+}
 
-		if prev != nil {
-			token.Line = token.Line - prev.Line
+// Byte bounds of changed part: start of change, end in old text and end in new text.
+// Bounds are never inside of utf-8 character or "\r\n"
+func diffBounds(oldText string, newText string) (UInt, UInt, UInt) {
+	maxLen := min(len(oldText), len(newText))
+	prefix := 0
 
-			if token.Line == 0 {
-				token.Character = token.Character - prev.Character
-			}
-		}
+	for prefix < maxLen && oldText[prefix] == newText[prefix] {
+		prefix++
+	}
 
-		prev = start
+	for prefix > 0 && !(isSplitBoundary(oldText, prefix) && isSplitBoundary(newText, prefix)) {
+		prefix--
+	}
 
-		n := i * 5
+	suffix := 0
 
-		tokens[n+0] = token.Line
-		tokens[n+1] = token.Character
-		tokens[n+2] = token.Length
-		tokens[n+3] = token.Type
-		tokens[n+4] = token.Modifiers
+	for suffix < maxLen-prefix && oldText[len(oldText)-1-suffix] == newText[len(newText)-1-suffix] {
+		suffix++
 	}
 
-	return tokens, nil
+	for suffix > 0 && !(isSplitBoundary(oldText, len(oldText)-suffix) && isSplitBoundary(newText, len(newText)-suffix)) {
+		suffix--
+	}
+
+	return UInt(prefix), UInt(len(oldText) - suffix), UInt(len(newText) - suffix)
 }
 
-// Compare Node with points range
-//
-// -1 - node before range
-// 0 - node inside range
-// 1 - node overlaps range
-// 2 - node after range
-func CompareNodeWithRange(node *Node, rangeStart *Point, rangeEnd *Point) int8 {
-	start := node.StartPoint()
-	end := node.EndPoint()
-	zeroRange := rangeStart.Row == rangeEnd.Row && rangeStart.Column == rangeEnd.Column
+// True if text can be split at index without breaking utf-8 character or "\r\n"
+func isSplitBoundary(text string, index int) bool {
+	if index <= 0 || index >= len(text) {
+		return true
+	}
 
-	if zeroRange &&
-		((start.Row == rangeStart.Row && start.Column == rangeStart.Column) ||
-			(end.Row == rangeEnd.Row && end.Column == rangeEnd.Column)) {
-		return 1
+	return utf8.RuneStart(text[index]) && !(text[index-1] == '\r' && text[index] == '\n')
+}
+
+// Same as SetParserCtx() with ctx = nil
+func (doc *TextDocument) SetParser(parser *sitter.Parser) error {
+	return doc.SetParserCtx(parser, nil)
+}
+
+// Will set Parser and call UpdateTree()
+func (doc *TextDocument) SetParserCtx(parser *sitter.Parser, ctx *context.Context) error {
+	doc.Parser = parser
+
+	return doc.UpdateTree(ctx)
+}
+
+// Will set Parser without calling UpdateTree(), so current Tree will be used for next incremental parse.
+// Safe only when parser has same language as parser which generated current Tree and Tree is up to date with Text,
+// otherwise next parse will produce broken Tree
+func (doc *TextDocument) SetParserKeepTree(parser *sitter.Parser) {
+	doc.Parser = parser
+}
+
+func (doc *TextDocument) SetHighlightQuery(query *sitter.Query, ignore *Ignore) {
+	doc.HighlightQuery = query
+	doc.HighlightIgnore = ignore
+	// captures of previous query or ignore are outdated
+	doc.HighlightCapturesDirty = true
+	doc.UpdateHighlightCaptures()
+}
+
+type grammar struct {
+	name   string
+	parser *sitter.Parser
+	detect func(doc *TextDocument) bool
+}
+
+// Add parser for DetectGrammar(), detect should return true when document is written in this grammar.
+// Grammar with same name is replaced
+func (doc *TextDocument) RegisterGrammar(name string, parser *sitter.Parser, detect func(doc *TextDocument) bool) {
+	g := grammar{name: name, parser: parser, detect: detect}
+
+	for i := range doc.grammars {
+		if doc.grammars[i].name == name {
+			doc.grammars[i] = g
+			return
+		}
 	}
 
-	if end.Row < rangeStart.Row || (rangeStart.Row == end.Row && end.Column <= rangeStart.Column) {
-		return -1
+	doc.grammars = append(doc.grammars, g)
+}
+
+// Set Parser of first registered grammar which detect returns true and fully regenerate Tree when Parser is changed.
+// Returns name of detected grammar, empty when nothing detected, then Parser stays as is
+func (doc *TextDocument) DetectGrammar() (string, error) {
+	for _, g := range doc.grammars {
+		if !g.detect(doc) {
+			continue
+		}
+
+		if g.parser == doc.Parser {
+			return g.name, nil
+		}
+
+		// edited Tree should be up to date before change of language, so it will be regenerated and not reused
+		if doc.treeDirty {
+			err := doc.UpdateTree(nil)
+
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return g.name, doc.SetParser(g.parser)
 	}
 
-	if (rangeStart.Row < start.Row || rangeStart.Row == start.Row && rangeStart.Column <= start.Column) &&
-		(rangeEnd.Row > end.Row || rangeEnd.Row == end.Row && rangeEnd.Column >= end.Column) {
-		return 0
+	return "", nil
+}
+
+// Limit duration of parsing in UpdateTree(), including Injections. Zero means no limit
+func (doc *TextDocument) SetParseTimeout(d time.Duration) {
+	doc.parseTimeout = d
+}
+
+// Will update Tree. If Tree present and NOT changed then it will be fully regenerated.
+// If Tree has changes then it will be used to generate new Tree.
+// ErrParseTimeout when parse timeout is exceeded, then old Tree is kept and document stays dirty
+func (doc *TextDocument) UpdateTree(ctx *context.Context) error {
+	if doc.parseTimeout <= 0 {
+		return doc.updateTree(ctx)
 	}
 
-	if rangeEnd.Row < start.Row || (rangeEnd.Row == start.Row && rangeEnd.Column <= start.Column) {
-		return 2
+	parent := contextOrBackground(ctx)
+	timeoutCtx, cancel := context.WithTimeout(parent, doc.parseTimeout)
+	defer cancel()
+
+	err := doc.updateTree(&timeoutCtx)
+
+	if errors.Is(err, context.DeadlineExceeded) && parent.Err() == nil {
+		return ErrParseTimeout
 	}
 
-	return 1
+	return err
 }
 
-func NodeOverlapsRange(node *Node, rangeStart *Point, rangeEnd *Point) bool {
-	res := CompareNodeWithRange(node, rangeStart, rangeEnd)
+func (doc *TextDocument) updateTree(ctx *context.Context) error {
+	if doc.Parser == nil {
+		return doc.updateInjections(ctx)
+	}
 
-	return res == 0 || res == 1
+	oldTree := doc.Tree
+
+	if doc.Tree != nil && (doc.fullParse || !doc.Tree.RootNode().HasChanges()) {
+		doc.Tree = nil
+	}
+
+	tree, err := doc.Parser.ParseCtx(contextOrBackground(ctx), doc.Tree, doc.Bytes())
+
+	if err != nil {
+		// halted parse is resumed by next parse even with other text, so it should be dropped
+		doc.Parser.Reset()
+		doc.Tree = oldTree
+		return err
+	}
+
+	// captures before edits, moved to edited text, to describe changes with HighlightEdits
+	var prev []*sitter.QueryCapture
+	var prevRanges []byteRange
+
+	if doc.HighlightQuery != nil && !doc.HighlightCapturesDirty && len(doc.edits) > 0 && len(doc.captureRanges) == len(doc.HighlightCaptures) {
+		prev = doc.HighlightCaptures
+		prevRanges = make([]byteRange, len(prev))
+
+		for i, r := range doc.captureRanges {
+			for _, e := range doc.edits {
+				r = e.shift(r)
+			}
+
+			prevRanges[i] = r
+		}
+	}
+
+	doc.changedRanges = nil
+
+	if doc.TrackChangedRanges {
+		if doc.Tree != nil {
+			doc.changedRanges = doc.diffTrees(doc.Tree, tree)
+		} else {
+			doc.changedRanges = []byteRange{{0, doc.TextLength}}
+		}
+	}
+
+	// captures before first changed node are kept and only captures after it are queried again.
+	// Captures after changes can't be kept, because nodes have absolute positions.
+	// Injections trees are parsed again, so their captures are always queried again
+	keep := 0
+	from := UInt(0)
+
+	if prev != nil && doc.Tree != nil && len(doc.Injections) == 0 {
+		start := doc.TextLength
+
+		for _, r := range doc.editedRanges() {
+			start = min(start, r.start)
+		}
+
+		keep, from = keptCapturesCount(prevRanges, firstChangedByte(doc.Tree.RootNode(), tree.RootNode(), start))
+	}
+
+	// kept captures have nodes of old Tree, so it will be closed by GC when they are replaced
+	if oldTree != nil && keep == 0 {
+		oldTree.Close()
+	}
+
+	doc.Tree = tree
+	doc.HighlightCapturesDirty = true
+	doc.HighlightEdits = nil
+	doc.treeDirty = false
+	doc.fullParse = false
+	doc.edits = nil
+
+	err = doc.updateInjections(ctx)
+
+	if err != nil || prev == nil {
+		return err
+	}
+
+	if keep > 0 {
+		err = doc.updateHighlightCapturesFrom(contextOrBackground(ctx), keep, from)
+	} else {
+		err = doc.UpdateHighlightCapturesCtx(contextOrBackground(ctx))
+	}
+
+	// on error captures stay dirty
+	if err == nil {
+		doc.HighlightEdits = highlightCapturesEdits(prev, prevRanges, doc.HighlightCaptures, doc.captureRanges)
+	}
+
+	return nil
 }
 
-// Walk through Tree
-// compare function should return: -1 to stop walking, 0 for go inside, 1 to go to next sibling
-func VisitNode(cursor *sitter.TreeCursor, compare func(*Node) int8) {
-	for {
-		node := cursor.CurrentNode()
-		action := compare(node)
+// Ranges of Text where Tree was changed by last UpdateTree(), sorted and not overlapping.
+// Made of edited text and nodes which differ from nodes of previous Tree. Whole document when Tree was fully regenerated.
+// Works only with TrackChangedRanges, because go-tree-sitter has no ts_tree_get_changed_ranges()
+func (doc *TextDocument) LastChangedRanges() []Range {
+	list := make([]Range, 0, len(doc.changedRanges))
 
-		if action < 0 {
-			return
+	for _, r := range doc.changedRanges {
+		item, err := doc.ByteRangeToRange(r.start, min(r.end, doc.TextLength))
+
+		if err != nil {
+			continue
 		}
 
-		if action == 0 {
-			if cursor.GoToFirstChild() {
-				VisitNode(cursor, compare)
-				cursor.GoToParent()
-			}
+		list = append(list, *item)
+	}
+
+	return list
+}
+
+// Edited text and ranges of nodes which differ in edited old Tree and new one
+func (doc *TextDocument) diffTrees(oldTree *sitter.Tree, newTree *sitter.Tree) []byteRange {
+	ranges := diffNodes(oldTree.RootNode(), newTree.RootNode(), nil)
+	ranges = append(ranges, doc.editedRanges()...)
+
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	merged := make([]byteRange, 0, len(ranges))
+
+	for _, r := range ranges {
+		last := len(merged) - 1
+
+		if last >= 0 && r.start <= merged[last].end {
+			merged[last].end = max(merged[last].end, r.end)
+			continue
 		}
 
-		if !cursor.GoToNextSibling() {
-			break
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// Parse region of document with language and merge captures of query with HighlightCaptures.
+// Injection will be reparsed with each UpdateTree()
+func (doc *TextDocument) AddInjection(language *sitter.Language, query *sitter.Query, region Range) (*Injection, error) {
+	parser := sitter.NewParser()
+	parser.SetLanguage(language)
+
+	inj := &Injection{
+		Region:   region,
+		Query:    query,
+		parser:   parser,
+		language: language,
+	}
+
+	err := doc.parseInjection(inj, context.Background())
+
+	if err != nil {
+		parser.Close()
+		return nil, err
+	}
+
+	doc.Injections = append(doc.Injections, inj)
+
+	return inj, nil
+}
+
+func (doc *TextDocument) updateInjections(ctx *context.Context) error {
+	if len(doc.Injections) == 0 {
+		return nil
+	}
+
+	c := contextOrBackground(ctx)
+
+	for _, inj := range doc.Injections {
+		err := doc.parseInjection(inj, c)
+
+		if err != nil {
+			return err
 		}
 	}
+
+	return nil
 }
 
-func BitMask(indexes []UInt) UInt {
-	value := UInt(0)
+// Parse only region of Text with language. Tree nodes have positions of whole Text and Tree should be closed by caller.
+// Use AddInjection() to keep region parsed and shifted with changes
+func (doc *TextDocument) ParseRegion(language *sitter.Language, region Range) (*sitter.Tree, error) {
+	parser := sitter.NewParser()
+	defer parser.Close()
 
-	for _, index := range indexes {
-		bit := math.Pow(2, float64(index))
-		value = value | UInt(bit)
+	parser.SetLanguage(language)
+
+	return doc.parseRegion(parser, region, context.Background())
+}
+
+func (doc *TextDocument) parseRegion(parser *sitter.Parser, region Range, ctx context.Context) (*sitter.Tree, error) {
+	r, err := doc.RangeToSitterRange(&region)
+
+	if err != nil {
+		return nil, err
 	}
 
-	return value
+	parser.SetIncludedRanges([]sitter.Range{*r})
+
+	tree, err := parser.ParseCtx(ctx, nil, doc.Bytes())
+
+	if err != nil {
+		// same as in updateTree()
+		parser.Reset()
+		return nil, err
+	}
+
+	return tree, nil
 }
 
-func shouldIgnore(ignore *Ignore, node *Node) bool {
-	if ignore == nil {
-		return false
+func (doc *TextDocument) parseInjection(inj *Injection, ctx context.Context) error {
+	tree, err := doc.parseRegion(inj.parser, inj.Region, ctx)
+
+	if err != nil {
+		return err
 	}
 
-	return (ignore.Missing && node.IsMissing()) ||
-		(ignore.Extra && node.IsExtra()) ||
-		(ignore.Error && node.IsError()) ||
-		(ignore.Null && node.IsNull()) ||
-		(ignore.Named && node.IsNamed())
+	if inj.Tree != nil {
+		inj.Tree.Close()
+	}
+
+	inj.Tree = tree
+	doc.HighlightCapturesDirty = true
+
+	return nil
+}
+
+// Captures of Injections are merged with captures of Tree. HighlightCaptures are always sorted by start byte of node,
+// but captures may overlap, like nested nodes
+func (doc *TextDocument) UpdateHighlightCaptures() {
+	doc.UpdateHighlightCapturesCtx(context.Background())
+}
+
+// Same as UpdateHighlightCaptures() but stops with ctx error when ctx is done, then HighlightCaptures stay dirty
+func (doc *TextDocument) UpdateHighlightCapturesCtx(ctx context.Context) error {
+	if doc.Tree == nil || doc.HighlightQuery == nil || !doc.HighlightCapturesDirty {
+		return nil
+	}
+
+	caps, err := doc.queryCapturesCtx(ctx, doc.HighlightQuery, doc.Tree.RootNode(), nil, doc.HighlightIgnore)
+
+	if err != nil {
+		return err
+	}
+
+	for _, inj := range doc.Injections {
+		if inj.Tree == nil || inj.Query == nil {
+			continue
+		}
+
+		injCaps, err := doc.queryCapturesCtx(ctx, inj.Query, inj.Tree.RootNode(), nil, doc.HighlightIgnore)
+
+		if err != nil {
+			return err
+		}
+
+		caps = append(caps, injCaps...)
+	}
+
+	doc.setHighlightCaptures(0, caps)
+
+	return nil
+}
+
+// Keep first captures and query captures of nodes from byte index, which should be after kept captures
+func (doc *TextDocument) updateHighlightCapturesFrom(ctx context.Context, keep int, from UInt) error {
+	root := doc.Tree.RootNode()
+	// one byte before, so zero length nodes at index are also matched
+	start, err := doc.ByteIndexToPoint(max(from, 1) - 1)
+
+	if err != nil {
+		return err
+	}
+
+	caps, err := doc.queryCapturesCtx(ctx, doc.HighlightQuery, root, start, doc.HighlightIgnore)
+
+	if err != nil {
+		return err
+	}
+
+	// captures of matches which started before are already kept
+	caps = slices.DeleteFunc(caps, func(cap HighlightCapture) bool {
+		return cap.Node.StartByte() < from
+	})
+
+	doc.setHighlightCaptures(keep, caps)
+
+	return nil
+}
+
+// Set HighlightCaptures to first keep current captures and new captures after them
+func (doc *TextDocument) setHighlightCaptures(keep int, caps []HighlightCapture) {
+	// captures of one match are in order of pattern and not of text, also Injections captures are appended
+	sort.SliceStable(caps, func(i, j int) bool {
+		return caps[i].Node.StartByte() < caps[j].Node.StartByte()
+	})
+
+	count := keep + len(caps)
+	list := append(make([]*sitter.QueryCapture, 0, count), doc.HighlightCaptures[:keep]...)
+	patterns := append(make([]uint16, 0, count), doc.capturePatterns[:keep]...)
+	maxEnd := append(make([]UInt, 0, count), doc.capturesMaxEnd[:keep]...)
+	ranges := append(make([]byteRange, 0, count), doc.captureRanges[:keep]...)
+
+	for _, cap := range caps {
+		r := byteRange{cap.Node.StartByte(), cap.Node.EndByte()}
+		end := r.end
+
+		if len(maxEnd) > 0 {
+			end = max(end, maxEnd[len(maxEnd)-1])
+		}
+
+		list = append(list, cap.QueryCapture)
+		patterns = append(patterns, cap.PatternIndex)
+		ranges = append(ranges, r)
+		maxEnd = append(maxEnd, end)
+	}
+
+	doc.HighlightCaptures = list
+	doc.HighlightCapturesDirty = false
+	doc.HighlightEdits = nil
+	doc.capturesMaxEnd = maxEnd
+	doc.captureRanges = ranges
+	doc.capturePatterns = patterns
+}
+
+// Count of first captures which end before start and are not overlapped by later captures,
+// and start of text after them. Ranges should be sorted by start.
+// Capture which ends at start isn't kept, because insertion at end of node may extend it
+func keptCapturesCount(ranges []byteRange, start UInt) (int, UInt) {
+	for i := len(ranges) - 1; i >= 0; i-- {
+		if ranges[i].start < start && ranges[i].end >= start {
+			start = ranges[i].start
+		}
+	}
+
+	count := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].start >= start
+	})
+
+	return count, start
+}
+
+// Captures which differ from previous ones by range or capture index, as one edit of previous list.
+// Empty when nothing changed
+func highlightCapturesEdits(prev []*sitter.QueryCapture, prevRanges []byteRange, list []*sitter.QueryCapture, ranges []byteRange) []HighlightEdit {
+	same := func(i int, j int) bool {
+		return prev[i].Index == list[j].Index && prevRanges[i] == ranges[j]
+	}
+
+	prefix := 0
+
+	for prefix < len(prev) && prefix < len(list) && same(prefix, prefix) {
+		prefix++
+	}
+
+	suffix := 0
+
+	for suffix < len(prev)-prefix && suffix < len(list)-prefix && same(len(prev)-1-suffix, len(list)-1-suffix) {
+		suffix++
+	}
+
+	if prefix+suffix == len(prev) && prefix+suffix == len(list) {
+		return []HighlightEdit{}
+	}
+
+	return []HighlightEdit{{
+		Start:  UInt(prefix),
+		Delete: UInt(len(prev) - prefix - suffix),
+		Insert: list[prefix : len(list)-suffix],
+	}}
+}
+
+// Captures which overlap line. Captures before line are skipped with binary search
+func (doc *TextDocument) GetHighlightCapturesInLine(line UInt) []*sitter.QueryCapture {
+	doc.UpdateHighlightCaptures()
+
+	list := make([]*sitter.QueryCapture, 0)
+
+	if line >= UInt(len(doc.Lines)) {
+		return list
+	}
+
+	lineStart := doc.Lines[line]
+	lineEnd := doc.TextLength
+
+	if line+1 < UInt(len(doc.Lines)) {
+		lineEnd = doc.Lines[line+1]
+	}
+
+	caps := doc.HighlightCaptures
+	first := 0
+
+	if len(doc.capturesMaxEnd) == len(caps) {
+		first = sort.Search(len(caps), func(i int) bool {
+			return doc.capturesMaxEnd[i] > lineStart
+		})
+	}
+
+	for _, cap := range caps[first:] {
+		if cap.Node.StartByte() >= lineEnd {
+			break
+		}
+
+		if cap.Node.EndByte() > lineStart {
+			list = append(list, cap)
+		}
+	}
+
+	return list
+}
+
+func (doc *TextDocument) GetHighlightCapturesByRange(start *Point, end *Point) []*sitter.QueryCapture {
+	doc.UpdateHighlightCaptures()
+
+	list := make([]*sitter.QueryCapture, 0)
+
+	for _, cap := range doc.HighlightCaptures {
+		if NodeOverlapsRange(cap.Node, start, end) {
+			list = append(list, cap)
+		}
+	}
+
+	return list
+}
+
+// HighlightCaptures with index of query pattern of each capture. Patterns of injections are from their queries
+func (doc *TextDocument) GetHighlightCapturesWithPatterns() []HighlightCapture {
+	doc.UpdateHighlightCaptures()
+
+	list := make([]HighlightCapture, len(doc.HighlightCaptures))
+
+	for i, cap := range doc.HighlightCaptures {
+		list[i].QueryCapture = cap
+
+		if i < len(doc.capturePatterns) {
+			list[i].PatternIndex = doc.capturePatterns[i]
+		}
+	}
+
+	return list
+}
+
+// Pattern index of each of HighlightCaptures, so subsets of captures can be resolved by pattern
+func (doc *TextDocument) highlightCapturePatterns() map[*sitter.QueryCapture]uint16 {
+	patterns := make(map[*sitter.QueryCapture]uint16, len(doc.capturePatterns))
+
+	for i, pattern := range doc.capturePatterns {
+		patterns[doc.HighlightCaptures[i]] = pattern
+	}
+
+	return patterns
+}
+
+func (doc *TextDocument) GetHighlightCaptureByPosition(pos *Position) (*sitter.QueryCapture, error) {
+	point, err := doc.PositionToPoint(pos)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = doc.checkTree()
+
+	if err != nil {
+		return nil, err
+	}
+
+	doc.UpdateHighlightCaptures()
+
+	for _, cap := range doc.HighlightCaptures {
+		if NodeOverlapsRange(cap.Node, point, point) {
+			return cap, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Same as GetHighlightCaptureByPosition() but returns capture as Token with type from legend.
+// nil Token when there is no capture at position
+func (doc *TextDocument) GetTokenAtPosition(pos *Position, legend HighlightLegend) (*Token, error) {
+	cap, err := doc.GetHighlightCaptureByPosition(pos)
+
+	if err != nil || cap == nil {
+		return nil, err
+	}
+
+	tokenType, ok, err := doc.captureType(cap, legend)
+
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	tokens, err := doc.captureTokens(cap, tokenType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		if token.Line == pos.Line {
+			return &token, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Name of capture in HighlightQuery, like "variable.parameter". Empty string if there is no such capture
+func (doc *TextDocument) CaptureName(cap *sitter.QueryCapture) string {
+	if cap == nil || doc.HighlightQuery == nil || cap.Index >= doc.HighlightQuery.CaptureCount() {
+		return ""
+	}
+
+	return doc.HighlightQuery.CaptureNameForId(cap.Index)
+}
+
+// Same as GetHighlightCaptureByPosition() but returns capture name
+func (doc *TextDocument) GetHighlightCaptureNameByPosition(pos *Position) (string, error) {
+	cap, err := doc.GetHighlightCaptureByPosition(pos)
+
+	if err != nil {
+		return "", err
+	}
+
+	return doc.CaptureName(cap), nil
+}
+
+func (doc *TextDocument) GetClosestHighlightCaptureByPosition(pos *Position) (prev *sitter.QueryCapture, target *sitter.QueryCapture, next *sitter.QueryCapture, err error) {
+	point, err := doc.PositionToPoint(pos)
+
+	if err != nil {
+		return
+	}
+
+	err = doc.checkTree()
+
+	if err != nil {
+		return
+	}
+
+	doc.UpdateHighlightCaptures()
+
+	for _, cap := range doc.HighlightCaptures {
+		switch CompareNodeWithRange(cap.Node, point, point) {
+		case -1:
+			prev = cap
+
+		case 2:
+			next = cap
+			return
+
+		default:
+			target = cap
+		}
+	}
+
+	return
+}
+
+func (doc *TextDocument) GetHighlightCapturesInNode(root *Node) []*sitter.QueryCapture {
+	return doc.QueryCaptures(doc.HighlightQuery, root, doc.HighlightIgnore)
+}
+
+// Call fn for each highlight capture in root node without collecting them to slice. Stops when fn returns false
+func (doc *TextDocument) EachHighlightCapture(root *Node, fn func(*sitter.QueryCapture) bool) {
+	doc.eachQueryCapture(doc.HighlightQuery, root, doc.HighlightIgnore, fn)
+}
+
+// Captures of any query in root node, filtered by ignore
+func (doc *TextDocument) QueryCaptures(query *sitter.Query, root *Node, ignore *Ignore) []*sitter.QueryCapture {
+	list := make([]*sitter.QueryCapture, 0)
+
+	doc.eachQueryCapture(query, root, ignore, func(cap *sitter.QueryCapture) bool {
+		list = append(list, cap)
+		return true
+	})
+
+	return list
+}
+
+// Same as QueryCaptures() but with pattern indexes and checks ctx periodically
+func (doc *TextDocument) queryCapturesCtx(ctx context.Context, query *sitter.Query, root *Node, start *Point, ignore *Ignore) ([]HighlightCapture, error) {
+	list := make([]HighlightCapture, 0)
+	var err error
+
+	doc.eachQueryMatchCapture(query, root, start, ignore, func(cap *sitter.QueryCapture, pattern uint16) bool {
+		if len(list)%256 == 0 {
+			err = ctx.Err()
+
+			if err != nil {
+				return false
+			}
+		}
+
+		list = append(list, HighlightCapture{cap, pattern})
+		return true
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func (doc *TextDocument) eachQueryCapture(query *sitter.Query, root *Node, ignore *Ignore, fn func(*sitter.QueryCapture) bool) {
+	doc.eachQueryMatchCapture(query, root, nil, ignore, func(cap *sitter.QueryCapture, _ uint16) bool {
+		return fn(cap)
+	})
+}
+
+// Same as eachQueryCapture() but fn gets pattern index of capture match.
+// When start is not nil only matches with nodes ending after it are returned, but they may have captures before it
+func (doc *TextDocument) eachQueryMatchCapture(query *sitter.Query, root *Node, start *Point, ignore *Ignore, fn func(*sitter.QueryCapture, uint16) bool) {
+	qc := sitter.NewQueryCursor()
+	defer qc.Close()
+
+	if start != nil {
+		qc.SetPointRange(*start, root.EndPoint())
+	}
+
+	qc.Exec(query, root)
+
+	predicates := compileQueryPredicates(query)
+
+	type captureKey struct {
+		node  uintptr
+		index uint32
+	}
+
+	var seen map[captureKey]bool
+
+	if ignore != nil && ignore.Duplicates {
+		seen = make(map[captureKey]bool)
+	}
+
+	for {
+		match, ok := qc.NextMatch()
+
+		if !ok {
+			break
+		}
+
+		if predicates != nil && !doc.matchPredicates(match, predicates[match.PatternIndex]) {
+			continue
+		}
+
+		// pointer to slice item and not to loop variable, so each capture has its own address
+		for i := range match.Captures {
+			cap := &match.Captures[i]
+
+			if shouldIgnore(ignore, cap.Node) {
+				continue
+			}
+
+			if seen != nil {
+				key := captureKey{cap.Node.ID(), cap.Index}
+
+				if seen[key] {
+					continue
+				}
+
+				seen[key] = true
+			}
+
+			if !fn(cap, match.PatternIndex) {
+				return
+			}
+		}
+	}
+}
+
+// Predicates of each pattern of query, nil when query has no predicates.
+// Only #eq?, #match?, #any-of? and their #not- versions are supported, others and directives like #set! are ignored
+func compileQueryPredicates(query *sitter.Query) [][]queryPredicate {
+	var list [][]queryPredicate
+
+	count := query.PatternCount()
+
+	for i := UInt(0); i < count; i++ {
+		for _, steps := range query.PredicatesForPattern(i) {
+			if len(steps) < 2 || steps[0].Type != sitter.QueryPredicateStepTypeString || steps[1].Type != sitter.QueryPredicateStepTypeCapture {
+				continue
+			}
+
+			p := queryPredicate{
+				capture: steps[1].ValueId,
+				other:   -1,
+			}
+
+			p.name, p.negate = strings.CutPrefix(query.StringValueForId(steps[0].ValueId), "not-")
+
+			if p.name != "eq?" && p.name != "match?" && p.name != "any-of?" {
+				continue
+			}
+
+			for _, step := range steps[2:] {
+				if step.Type == sitter.QueryPredicateStepTypeCapture {
+					p.other = int64(step.ValueId)
+				} else {
+					p.values = append(p.values, query.StringValueForId(step.ValueId))
+				}
+			}
+
+			if p.name == "match?" && len(p.values) > 0 {
+				p.regexp, _ = regexp.Compile(p.values[0])
+			}
+
+			if list == nil {
+				list = make([][]queryPredicate, count)
+			}
+
+			list[i] = append(list[i], p)
+		}
+	}
+
+	return list
+}
+
+// All captures of predicates should match them
+func (doc *TextDocument) matchPredicates(match *sitter.QueryMatch, predicates []queryPredicate) bool {
+	for _, p := range predicates {
+		for _, cap := range match.Captures {
+			if cap.Index != p.capture {
+				continue
+			}
+
+			text := doc.NodeText(cap.Node)
+			ok := false
+
+			switch p.name {
+			case "eq?":
+				if p.other < 0 {
+					ok = len(p.values) > 0 && text == p.values[0]
+					break
+				}
+
+				ok = true
+
+				for _, other := range match.Captures {
+					if int64(other.Index) == p.other && doc.NodeText(other.Node) != text {
+						ok = false
+					}
+				}
+
+			case "match?":
+				ok = p.regexp != nil && p.regexp.MatchString(text)
+
+			case "any-of?":
+				ok = slices.Contains(p.values, text)
+			}
+
+			if ok == p.negate {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (doc *TextDocument) PositionToByteIndex(pos *Position) (UInt, error) {
+	if doc.Lenient {
+		pos = doc.ClampPosition(pos)
+	}
+
+	return doc.positionByteIndex(pos)
+}
+
+// Byte index, Point and position which was actually used, clamped in Lenient mode, with one scan of line.
+// Point is nil when withPoint is false
+func (doc *TextDocument) positionToIndexPoint(pos *Position, withPoint bool) (UInt, *Point, *Position, error) {
+	if doc.Lenient {
+		pos = doc.ClampPosition(pos)
+	}
+
+	index, err := doc.positionByteIndex(pos)
+
+	if err != nil || !withPoint {
+		return index, nil, pos, err
+	}
+
+	if doc.rows != nil {
+		point, err := doc.ByteIndexToPoint(index)
+
+		return index, point, pos, err
+	}
+
+	return index, &Point{
+		Row:    pos.Line,
+		Column: index - doc.Lines[pos.Line],
+	}, pos, nil
+}
+
+// Same as PositionToByteIndex() without clamping
+func (doc *TextDocument) positionByteIndex(pos *Position) (UInt, error) {
+	linesCount := UInt(len(doc.Lines))
+
+	if pos.Line >= linesCount {
+		return 0, fmt.Errorf("line %d is out of range (%d)", pos.Line, linesCount-1)
+	}
+
+	character := UInt(0)
+	offset := doc.Lines[pos.Line]
+	max := doc.lineEnd(pos.Line)
+
+	// characters are bytes, so runes are not decoded
+	if doc.PositionEncoding == UTF8 {
+		if pos.Character > max-offset {
+			return 0, fmt.Errorf("character %d is out of range (%d) for line %d", pos.Character, max-offset, pos.Line)
+		}
+
+		offset += pos.Character
+
+		if offset < max && !utf8.RuneStart(doc.Text[offset]) {
+			return 0, fmt.Errorf("character %d is inside of multi-unit character for line %d", pos.Character, pos.Line)
+		}
+
+		return offset, nil
+	}
+
+	offset, _, err := doc.scanCharacters(pos, offset, character, max)
+
+	return offset, err
+}
+
+// Walk runes of pos.Line from offset, which is at character, till pos.Character. max is line end.
+// Returns byte index and character of position
+func (doc *TextDocument) scanCharacters(pos *Position, offset UInt, character UInt, max UInt) (UInt, UInt, error) {
+	for character < pos.Character {
+		char, size := utf8.DecodeRuneInString(doc.Text[offset:])
+
+		if char == utf8.RuneError {
+			return 0, 0, errors.New("rune error")
+		}
+
+		offset += UInt(size)
+		character += doc.runeLength(char, size)
+
+		if character > pos.Character {
+			return 0, 0, fmt.Errorf("character %d is inside of multi-unit character for line %d", pos.Character, pos.Line)
+		}
+
+		if offset > max || (offset == max && character < pos.Character) {
+			return 0, 0, fmt.Errorf("character %d is out of range (%d) for line %d", pos.Character, character, pos.Line)
+		}
+	}
+
+	// position is after whole cluster, not after its base rune
+	if doc.PositionEncoding == Grapheme && character > 0 {
+		for offset < max {
+			char, size := utf8.DecodeRuneInString(doc.Text[offset:max])
+
+			if !isGraphemeExtend(char) {
+				break
+			}
+
+			offset += UInt(size)
+		}
+	}
+
+	return offset, character, nil
+}
+
+// Same as PositionToByteIndex() for many positions, but positions of same line are resolved with one scan of line.
+// Indexes are in order of positions
+func (doc *TextDocument) PositionsToByteIndexes(positions []*Position) ([]UInt, error) {
+	list := make([]UInt, len(positions))
+	order := make([]int, len(positions))
+
+	if doc.Lenient {
+		positions = slices.Clone(positions)
+	}
+
+	for i, pos := range positions {
+		if doc.Lenient {
+			positions[i] = doc.ClampPosition(pos)
+		}
+
+		order[i] = i
+	}
+
+	slices.SortFunc(order, func(a, b int) int {
+		if positionAfter(positions[a], positions[b]) {
+			return 1
+		}
+
+		if positionAfter(positions[b], positions[a]) {
+			return -1
+		}
+
+		return 0
+	})
+
+	var offset, character, max UInt
+
+	for k, i := range order {
+		pos := positions[i]
+
+		if doc.PositionEncoding == UTF8 {
+			index, err := doc.positionByteIndex(pos)
+
+			if err != nil {
+				return nil, err
+			}
+
+			list[i] = index
+			continue
+		}
+
+		if k == 0 || pos.Line != positions[order[k-1]].Line {
+			if pos.Line >= UInt(len(doc.Lines)) {
+				return nil, fmt.Errorf("line %d is out of range (%d)", pos.Line, len(doc.Lines)-1)
+			}
+
+			offset = doc.Lines[pos.Line]
+			character = 0
+			max = doc.lineEnd(pos.Line)
+		}
+
+		var err error
+
+		offset, character, err = doc.scanCharacters(pos, offset, character, max)
+
+		if err != nil {
+			return nil, err
+		}
+
+		list[i] = offset
+	}
+
+	return list, nil
+}
+
+// Nearest valid position. Line after last line will be clamped to end of document,
+// character after line end to line end and character inside of multi-unit character to its start
+func (doc *TextDocument) ClampPosition(pos *Position) *Position {
+	line := pos.Line
+	character := pos.Character
+	lastLine := UInt(len(doc.Lines) - 1)
+
+	if line > lastLine {
+		line = lastLine
+		character = math.MaxUint32
+	}
+
+	offset := doc.Lines[line]
+	max := doc.lineEnd(line)
+	column := UInt(0)
+
+	for offset < max {
+		char, size := utf8.DecodeRuneInString(doc.Text[offset:max])
+		length := doc.runeLength(char, size)
+
+		if column+length > character {
+			break
+		}
+
+		offset += UInt(size)
+		column += length
+	}
+
+	return &Position{
+		Line:      line,
+		Character: column,
+	}
+}
+
+// Number of UTF-16 code units from document start to position, like offsets of Monaco model.
+// Line terminators are counted too
+func (doc *TextDocument) PositionToUTF16Offset(pos *Position) (UInt, error) {
+	index, err := doc.PositionToByteIndex(pos)
+
+	if err != nil {
+		return 0, err
+	}
+
+	offset := UInt(0)
+
+	for _, char := range doc.Text[:index] {
+		if char >= 0x10000 {
+			offset += 2
+		} else {
+			offset++
+		}
+	}
+
+	return offset, nil
+}
+
+// Inverse of PositionToUTF16Offset()
+func (doc *TextDocument) UTF16OffsetToPosition(offset UInt) (*Position, error) {
+	units := UInt(0)
+	index := doc.TextLength
+
+	for i, char := range doc.Text {
+		if units >= offset {
+			index = UInt(i)
+			break
+		}
+
+		if char >= 0x10000 {
+			units += 2
+		} else {
+			units++
+		}
+	}
+
+	if units < offset {
+		return nil, fmt.Errorf("UTF-16 offset %d is out of range (%d)", offset, units)
+	}
+
+	if units > offset {
+		return nil, fmt.Errorf("UTF-16 offset %d is inside of surrogate pair", offset)
+	}
+
+	return doc.ByteIndexToPosition(index)
+}
+
+func (doc *TextDocument) ByteIndexLine(index UInt) (UInt, error) {
+	if index > doc.TextLength {
+		return 0, fmt.Errorf("byte index %d is out of range (%d)", index, doc.TextLength)
+	}
+
+	// first line which starts after index
+	next := sort.Search(len(doc.Lines), func(i int) bool {
+		return doc.Lines[i] > index
+	})
+
+	return UInt(max(next-1, 0)), nil
+}
+
+// byte index means number of bytes from text start. TextLength is valid index and it is always
+// same as EndPosition(): end of last line or start of empty line after final line terminator. Index after it is error
+func (doc *TextDocument) ByteIndexToPosition(index UInt) (*Position, error) {
+	line, err := doc.ByteIndexLine(index)
+
+	if err != nil {
+		return nil, err
+	}
+
+	offset := doc.Lines[line]
+
+	return doc.LineByteIndexToPosition(line, index-offset)
+}
+
+// Convert byte indexes range to Range. Conversion of end will reuse cached offset of start when they on same line
+func (doc *TextDocument) ByteRangeToRange(start UInt, end UInt) (*Range, error) {
+	if start > end {
+		return nil, fmt.Errorf("start byte index %d is greater than end %d", start, end)
+	}
+
+	if end > doc.TextLength {
+		return nil, fmt.Errorf("end byte index %d is out of range (%d)", end, doc.TextLength)
+	}
+
+	startPos, err := doc.ByteIndexToPosition(start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	endPos, err := doc.ByteIndexToPosition(end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Range{
+		Start: *startPos,
+		End:   *endPos,
+	}, nil
+}
+
+func (doc *TextDocument) ByteIndexToPoint(index UInt) (*Point, error) {
+	if index > doc.TextLength {
+		return nil, fmt.Errorf("byte index %d is out of range (%d)", index, doc.TextLength)
+	}
+
+	rows := doc.pointRows()
+
+	// first row which starts after index
+	next := sort.Search(len(rows), func(i int) bool {
+		return rows[i] > index
+	})
+
+	row := UInt(max(next-1, 0))
+
+	return &Point{
+		Row:    row,
+		Column: index - rows[row],
+	}, nil
+}
+
+// index is number of bytes from line start, index inside of line terminator is clamped to line end
+func (doc *TextDocument) LineByteIndexToPosition(line UInt, index UInt) (*Position, error) {
+	offset, max, err := doc.LineMinMaxByteIndex(line)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// tree-sitter rows are splitted only by "\n", so node can end inside of "\r\n", which is line end for position
+	if offset+index > max && line+1 < UInt(len(doc.Lines)) && offset+index < doc.Lines[line+1] {
+		index = max - offset
+	}
+
+	if doc.PositionEncoding == UTF8 {
+		if offset+index > max {
+			return nil, fmt.Errorf("byte index %d is out of range (%d) for line %d", index, max-offset, line)
+		}
+
+		return &Position{
+			Line:      line,
+			Character: index,
+		}, nil
+	}
+
+	column := UInt(0)
+	index += offset
+	last := &doc.lastLineOffset
+
+	if !doc.shared && last.line == line && last.encoding == doc.PositionEncoding && last.offset <= index {
+		offset = last.offset
+		column = last.column
+	}
+
+	for {
+		if offset >= index {
+			break
+		}
+
+		// ASCII byte is one column in every encoding, so only non-ASCII bytes are decoded
+		if offset < max && doc.Text[offset] < utf8.RuneSelf {
+			offset++
+			column++
+			continue
+		}
+
+		char, size := utf8.DecodeRuneInString(doc.Text[offset:])
+
+		if char == utf8.RuneError {
+			return nil, errors.New("rune error")
+		}
+
+		offset += UInt(size)
+		column += doc.runeLength(char, size)
+
+		if offset > max {
+			return nil, fmt.Errorf("byte index %d is out of range (%d) for line %d", index-doc.Lines[line], max-doc.Lines[line], line)
+		}
+	}
+
+	if !doc.shared {
+		last.line = line
+		last.offset = offset
+		last.column = column
+		last.encoding = doc.PositionEncoding
+	}
+
+	return &Position{
+		Line:      line,
+		Character: column,
+	}, nil
+}
+
+func (doc *TextDocument) PointToPosition(point Point) (*Position, error) {
+	if doc.rows == nil {
+		return doc.LineByteIndexToPosition(point.Row, point.Column)
+	}
+
+	if point.Row >= UInt(len(doc.rows)) {
+		return nil, fmt.Errorf("row %d is out of range (%d)", point.Row, len(doc.rows)-1)
+	}
+
+	return doc.ByteIndexToPosition(doc.rows[point.Row] + point.Column)
+}
+
+func (doc *TextDocument) PositionToPoint(pos *Position) (*Point, error) {
+	_, point, _, err := doc.positionToIndexPoint(pos, true)
+
+	return point, err
+}
+
+// Text as byte slice, which is copied once and cached until next change of Text, so it should not be modified.
+// Not cached in SyncTextDocument readers
+func (doc *TextDocument) Bytes() []byte {
+	if doc.bytes != nil {
+		return doc.bytes
+	}
+
+	bytes := []byte(doc.Text)
+
+	if !doc.shared {
+		doc.bytes = bytes
+	}
+
+	return bytes
+}
+
+// Same as node.Content() but without copying of Text. Empty string when node is out of Text
+func (doc *TextDocument) NodeText(node *Node) string {
+	start, end := doc.NodeByteRange(node)
+
+	if start > end || end > doc.TextLength {
+		return ""
+	}
+
+	return doc.Text[start:end]
+}
+
+// Start and end bytes of node without checks, see NodeToByteRange()
+func (doc *TextDocument) NodeByteRange(node *Node) (start UInt, end UInt) {
+	return node.StartByte(), node.EndByte()
+}
+
+// Byte indexes of node in Text, for slicing of Text and for byte methods like ByteRangeToRange().
+// Error when node is out of Text, like node of other document or of Tree before change.
+// Use NodeToRange() for positions, their characters are in units of PositionEncoding and not bytes
+func (doc *TextDocument) NodeToByteRange(node *Node) (UInt, UInt, error) {
+	start, end := doc.NodeByteRange(node)
+
+	if start > end || end > doc.TextLength {
+		return 0, 0, fmt.Errorf("node range %d-%d is out of text (%d)", start, end, doc.TextLength)
+	}
+
+	return start, end, nil
+}
+
+func (doc *TextDocument) NodeByteLength(node *Node) UInt {
+	return node.EndByte() - node.StartByte()
+}
+
+func (doc *TextDocument) NodeStartPosition(node *Node) (*Position, error) {
+	return doc.PointToPosition(node.StartPoint())
+}
+
+func (doc *TextDocument) NodeEndPosition(node *Node) (*Position, error) {
+	return doc.PointToPosition(node.EndPoint())
+}
+
+// Range of node, characters are in units of PositionEncoding. Use NodeToByteRange() for byte indexes
+func (doc *TextDocument) NodeToRange(node *Node) (*proto.Range, error) {
+	start, err := doc.NodeStartPosition(node)
+
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := doc.NodeEndPosition(node)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &proto.Range{
+		Start: *start,
+		End:   *end,
+	}, nil
+}
+
+func (doc *TextDocument) RangeToSitterRange(r *Range) (*sitter.Range, error) {
+	start, err := doc.PositionToByteIndex(&r.Start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := doc.PositionToByteIndex(&r.End)
+
+	if err != nil {
+		return nil, err
+	}
+
+	startPoint, err := doc.ByteIndexToPoint(start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	endPoint, err := doc.ByteIndexToPoint(end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &sitter.Range{
+		StartPoint: *startPoint,
+		EndPoint:   *endPoint,
+		StartByte:  start,
+		EndByte:    end,
+	}, nil
+}
+
+func (doc *TextDocument) LineMinMaxByteIndex(line UInt) (UInt, UInt, error) {
+	linesCount := UInt(len(doc.Lines))
+
+	if line >= linesCount {
+		return 0, 0, fmt.Errorf("line %d is out of range (%d)", line, linesCount)
+	}
+
+	return doc.Lines[line], doc.lineEnd(line), nil
+}
+
+// Byte index of line end without line terminator
+func (doc *TextDocument) lineEnd(line UInt) UInt {
+	if line+1 >= UInt(len(doc.Lines)) {
+		return doc.TextLength
+	}
+
+	end := doc.Lines[line+1] - 1
+
+	if end > doc.Lines[line] && doc.Text[end] == '\n' && doc.Text[end-1] == '\r' {
+		end--
+	}
+
+	return end
+}
+
+// Offsets of tree-sitter rows
+func (doc *TextDocument) pointRows() []UInt {
+	if doc.rows != nil {
+		return doc.rows
+	}
+
+	return doc.Lines
+}
+
+// Reversed range is normalized with NormalizeRange()
+func (doc *TextDocument) GetTextByRange(r *Range) (string, error) {
+	r = NormalizeRange(r)
+	start, err := doc.PositionToByteIndex(&r.Start)
+
+	if err != nil {
+		return "", err
+	}
+
+	end, err := doc.PositionToByteIndex(&r.End)
+
+	if err != nil {
+		return "", err
+	}
+
+	return doc.Text[start:end], nil
+}
+
+// Text of line without line terminator
+func (doc *TextDocument) GetLineText(line UInt) (string, error) {
+	min, max, err := doc.LineMinMaxByteIndex(line)
+
+	if err != nil {
+		return "", err
+	}
+
+	return doc.Text[min:max], nil
+}
+
+// True when line has no characters before its line terminator. Empty line after final line terminator is valid line
+func (doc *TextDocument) IsEmptyLine(line UInt) (bool, error) {
+	min, max, err := doc.LineMinMaxByteIndex(line)
+
+	if err != nil {
+		return false, err
+	}
+
+	return min == max, nil
+}
+
+// Call fn with text of each line without line terminator, same as GetLineText() but without line checks.
+// Empty last line after final line terminator is included. Stops when fn returns false
+func (doc *TextDocument) EachLine(fn func(line UInt, text string) bool) {
+	for line, start := range doc.Lines {
+		if !fn(UInt(line), doc.Text[start:doc.lineEnd(UInt(line))]) {
+			return
+		}
+	}
+}
+
+// Leading spaces and tabs of line, their counts and text
+func (doc *TextDocument) GetLineIndentation(line UInt) (spaces UInt, tabs UInt, text string, err error) {
+	min, max, err := doc.LineMinMaxByteIndex(line)
+
+	if err != nil {
+		return 0, 0, "", err
+	}
+
+	end := min
+
+	for ; end < max; end++ {
+		switch doc.Text[end] {
+		case ' ':
+			spaces++
+			continue
+
+		case '\t':
+			tabs++
+			continue
+		}
+
+		break
+	}
+
+	return spaces, tabs, doc.Text[min:end], nil
+}
+
+// Range of whole line without line terminator
+func (doc *TextDocument) LineRange(line UInt) (*Range, error) {
+	length, err := doc.LineLengthInChars(line)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewRange(line, 0, line, length), nil
+}
+
+// Position of end of line before its line terminator
+func (doc *TextDocument) EndOfLinePosition(line UInt) (*Position, error) {
+	length, err := doc.LineLengthInChars(line)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Position{
+		Line:      line,
+		Character: length,
+	}, nil
+}
+
+// Position after last character of Text. When Text ends with line terminator it is start of last empty line
+func (doc *TextDocument) EndPosition() *Position {
+	return doc.ClampPosition(&Position{Line: math.MaxUint32})
+}
+
+// Range from document start to EndPosition(), like for formatting of whole document
+func (doc *TextDocument) FullRange() *Range {
+	return &Range{End: *doc.EndPosition()}
+}
+
+// Number of characters of line without line terminator in units of PositionEncoding
+func (doc *TextDocument) LineLengthInChars(line UInt) (UInt, error) {
+	min, max, err := doc.LineMinMaxByteIndex(line)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if doc.PositionEncoding == UTF8 {
+		return max - min, nil
+	}
+
+	length := UInt(0)
+
+	for offset := min; offset < max; {
+		char, size := utf8.DecodeRuneInString(doc.Text[offset:max])
+
+		if char == utf8.RuneError {
+			return 0, errors.New("rune error")
+		}
+
+		offset += UInt(size)
+		length += doc.runeLength(char, size)
+	}
+
+	return length, nil
+}
+
+// Number of characters of Text[start:end] in units of PositionEncoding, line terminators are counted too
+func (doc *TextDocument) byteRangeLengthInChars(start UInt, end UInt) UInt {
+	if doc.PositionEncoding == UTF8 {
+		return end - start
+	}
+
+	length := UInt(0)
+
+	for offset := start; offset < end; {
+		if doc.Text[offset] < utf8.RuneSelf {
+			offset++
+			length++
+			continue
+		}
+
+		char, size := utf8.DecodeRuneInString(doc.Text[offset:end])
+		offset += UInt(size)
+		length += doc.runeLength(char, size)
+	}
+
+	return length
+}
+
+// Display column of position, where each character is one column and tab advances to next TabWidth stop
+func (doc *TextDocument) PositionToVisualColumn(pos *Position) (UInt, error) {
+	index, err := doc.PositionToByteIndex(pos)
+
+	if err != nil {
+		return 0, err
+	}
+
+	line, err := doc.ByteIndexLine(index)
+
+	if err != nil {
+		return 0, err
+	}
+
+	column := UInt(0)
+
+	for _, char := range doc.Text[doc.Lines[line]:index] {
+		if char == '\t' && doc.TabWidth > 0 {
+			column += doc.TabWidth - column%doc.TabWidth
+		} else {
+			column++
+		}
+	}
+
+	return column, nil
+}
+
+// Text around position till space characters on both sides or line edges
+func (doc *TextDocument) GetNonSpaceTextAroundPosition(pos *Position) (string, error) {
+	return doc.GetNonSpaceTextAroundPositionFunc(pos, func(char rune) bool {
+		return char == ' '
+	})
+}
+
+// Same as GetNonSpaceTextAroundPosition() but text is expanded till isBoundary() returns true,
+// if isBoundary is nil then unicode.IsSpace is used
+func (doc *TextDocument) GetNonSpaceTextAroundPositionFunc(pos *Position, isBoundary func(rune) bool) (string, error) {
+	if isBoundary == nil {
+		isBoundary = unicode.IsSpace
+	}
+
+	end, err := doc.PositionToByteIndex(pos)
+
+	if err != nil {
+		return "", err
+	}
+
+	start := end
+	min, max, err := doc.LineMinMaxByteIndex(pos.Line)
+
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		if start <= min {
+			start = min
+			break
+		}
+
+		char, size := utf8.DecodeLastRuneInString(doc.Text[min:start])
+
+		if char == utf8.RuneError {
+			return "", errors.New("rune error")
+		}
+
+		if isBoundary(char) {
+			break
+		}
+
+		start -= UInt(size)
+	}
+
+	for {
+		if end >= max {
+			end = max
+			break
+		}
+
+		char, size := utf8.DecodeRuneInString(doc.Text[end:max])
+
+		if char == utf8.RuneError {
+			return "", errors.New("rune error")
+		}
+
+		if isBoundary(char) {
+			break
+		}
+
+		end += UInt(size)
+	}
+
+	return doc.Text[start:end], nil
+}
+
+// Word around position and its range. Word is expanded while isWordChar() returns true,
+// if isWordChar is nil then [A-Za-z0-9_] is used
+func (doc *TextDocument) WordRangeAtPosition(pos *Position, isWordChar func(rune) bool) (*Range, string, error) {
+	if isWordChar == nil {
+		isWordChar = IsWordChar
+	}
+
+	end, err := doc.PositionToByteIndex(pos)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	start := end
+	min, max, err := doc.LineMinMaxByteIndex(pos.Line)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	for start > min {
+		char, size := utf8.DecodeLastRuneInString(doc.Text[min:start])
+
+		if char == utf8.RuneError {
+			return nil, "", errors.New("rune error")
+		}
+
+		if !isWordChar(char) {
+			break
+		}
+
+		start -= UInt(size)
+	}
+
+	for end < max {
+		char, size := utf8.DecodeRuneInString(doc.Text[end:max])
+
+		if char == utf8.RuneError {
+			return nil, "", errors.New("rune error")
+		}
+
+		if !isWordChar(char) {
+			break
+		}
+
+		end += UInt(size)
+	}
+
+	r, err := doc.ByteRangeToRange(start, end)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return r, doc.Text[start:end], nil
+}
+
+// Same as GetNodesByRangeOpts() with default options
+func (doc *TextDocument) GetNodesByRange(start *Position, end *Position) ([]*Node, error) {
+	return doc.GetNodesByRangeOpts(start, end, NodeRangeOptions{})
+}
+
+// Top most nodes which are inside of range plus leaves which overlap range edges. If end is nil then start is used.
+// Reversed range is normalized
+func (doc *TextDocument) GetNodesByRangeOpts(start *Position, end *Position, opts NodeRangeOptions) ([]*Node, error) {
+	if end != nil && positionAfter(start, end) {
+		start, end = end, start
+	}
+
+	startPoint, err := doc.PositionToPoint(start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var endPoint *Point
+
+	if end == nil {
+		endPoint = startPoint
+	} else {
+		endPoint, err = doc.PositionToPoint(end)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return doc.getNodesByPointRange(startPoint, endPoint, &opts)
+}
+
+// Same as GetNodesByRange() but with byte indexes instead of positions
+func (doc *TextDocument) GetNodesByByteRange(start UInt, end UInt) ([]*Node, error) {
+	if start > end {
+		start, end = end, start
+	}
+
+	startPoint, err := doc.ByteIndexToPoint(start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	endPoint, err := doc.ByteIndexToPoint(end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return doc.getNodesByPointRange(startPoint, endPoint, &NodeRangeOptions{})
+}
+
+func (doc *TextDocument) getNodesByPointRange(startPoint *Point, endPoint *Point, opts *NodeRangeOptions) ([]*Node, error) {
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	targets := make([]*Node, 0)
+
+	c := sitter.NewTreeCursor(root)
+	defer c.Close()
+
+	VisitNode(c, func(node *Node) int8 {
+		res := CompareNodeWithRange(node, startPoint, endPoint)
+
+		switch res {
+		case -1:
+			return 1
+
+		case 0, 1:
+			maxDepth := opts.isMaxDepth(node)
+
+			if opts.match(node) && (res == 0 || maxDepth || node.ChildCount() == 0) {
+				targets = append(targets, node)
+				return 1
+			}
+
+			if maxDepth || node.ChildCount() == 0 {
+				return 1
+			}
+
+			return 0
+
+		default:
+			return -1
+		}
+	})
+
+	return targets, nil
+}
+
+// Same as VisitNode() from root of Tree, but compare is called only for nodes which overlap points range,
+// nodes before range are skipped with their children and walking stops at first node after range
+func (doc *TextDocument) VisitNodesInRange(start *Point, end *Point, compare func(*Node) int8) error {
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return err
+	}
+
+	c := sitter.NewTreeCursor(root)
+	defer c.Close()
+
+	VisitNode(c, func(node *Node) int8 {
+		switch CompareNodeWithRange(node, start, end) {
+		case -1:
+			return 1
+
+		case 2:
+			return -1
+
+		default:
+			return compare(node)
+		}
+	})
+
+	return nil
+}
+
+func (doc *TextDocument) GetNodeByPosition(pos *Position) (*Node, error) {
+	nodes, err := doc.GetNodesByRange(pos, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+
+	return nodes[0], nil
+}
+
+// Same as GetNodeByPosition() but with byte index instead of position
+func (doc *TextDocument) GetNodeAtByteIndex(index UInt) (*Node, error) {
+	point, err := doc.ByteIndexToPoint(index)
+
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := doc.getNodesByPointRange(point, point, &NodeRangeOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+
+	return nodes[0], nil
+}
+
+func (doc *TextDocument) GetClosestNodeByPosition(pos *Position) (*Node, error) {
+	point, err := doc.PositionToPoint(pos)
+
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return root.NamedDescendantForPointRange(*point, *point), nil
+}
+
+// Closest named node of position with its previous and next named siblings, nil when there is no sibling
+func (doc *TextDocument) GetSiblingNodes(pos *Position) (prev *Node, current *Node, next *Node, err error) {
+	current, err = doc.GetClosestNodeByPosition(pos)
+
+	if err != nil || current == nil {
+		return nil, nil, nil, err
+	}
+
+	return current.PrevNamedSibling(), current, current.NextNamedSibling(), nil
+}
+
+// Smallest named node which contains whole range. Reversed range is normalized
+func (doc *TextDocument) GetContainingNode(start *Position, end *Position) (*Node, error) {
+	startPoint, endPoint, err := doc.rangeToPoints(start, end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return root.NamedDescendantForPointRange(*startPoint, *endPoint), nil
+}
+
+// Same as GetContainingNode(), named after tree-sitter NamedDescendantForPointRange() which it wraps
+func (doc *TextDocument) GetNamedDescendantForRange(start *Position, end *Position) (*Node, error) {
+	return doc.GetContainingNode(start, end)
+}
+
+// Smallest named node with exactly this range. Returns nil node when there is no such node.
+// Nodes are not valid after reparse, so to track node across edits save its range with NodeToRange(),
+// pass it through ShiftRange() with every change event and re-resolve node with this method after changes
+func (doc *TextDocument) GetNodeByStableRange(r *Range) (*Node, error) {
+	startPoint, endPoint, err := doc.rangeToPoints(&r.Start, &r.End)
+
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	node := root.NamedDescendantForPointRange(*startPoint, *endPoint)
+
+	if node == nil || node.StartPoint() != *startPoint || node.EndPoint() != *endPoint {
+		return nil, nil
+	}
+
+	return node, nil
+}
+
+// Range adjusted by change event which is not applied yet. Changes after range keep it as is, changes before
+// range move it and changes inside of range move its end. Returns nil when change overlaps range edge
+// or replaces whole document, so tracked range is lost
+func (doc *TextDocument) ShiftRange(r *Range, edit *ChangeEvent) *Range {
+	if edit.Range == nil {
+		return nil
+	}
+
+	r = NormalizeRange(r)
+	e := NormalizeRange(edit.Range)
+
+	switch {
+	case ComparePositions(&e.End, &r.Start) <= 0:
+		return &Range{
+			Start: *doc.shiftPosition(&r.Start, e, edit.Text),
+			End:   *doc.shiftPosition(&r.End, e, edit.Text),
+		}
+
+	case ComparePositions(&e.Start, &r.End) >= 0:
+		return r
+
+	case ComparePositions(&e.Start, &r.Start) >= 0 && ComparePositions(&e.End, &r.End) <= 0:
+		return &Range{
+			Start: r.Start,
+			End:   *doc.shiftPosition(&r.End, e, edit.Text),
+		}
+	}
+
+	return nil
+}
+
+// Position which is after change range moved by replacement of range with text
+func (doc *TextDocument) shiftPosition(pos *Position, r *Range, text string) *Position {
+	lines := UInt(0)
+	character := r.Start.Character
+
+	for i, size := 0, 0; i < len(text); i += size {
+		char := rune(text[i])
+		size = 1
+
+		if char == '\r' || char == '\n' {
+			if char == '\r' && i+1 < len(text) && text[i+1] == '\n' {
+				size = 2
+			}
+
+			lines++
+			character = 0
+			continue
+		}
+
+		if char >= utf8.RuneSelf {
+			char, size = utf8.DecodeRuneInString(text[i:])
+		}
+
+		character += doc.runeLength(char, size)
+	}
+
+	if pos.Line > r.End.Line {
+		return &Position{
+			Line:      pos.Line - (r.End.Line - r.Start.Line) + lines,
+			Character: pos.Character,
+		}
+	}
+
+	return &Position{
+		Line:      r.Start.Line + lines,
+		Character: character + pos.Character - r.End.Character,
+	}
+}
+
+// Top most nodes which are fully inside of range, unlike GetNodesByRange() leaves which overlap range edges
+// are not included. Reversed range is normalized
+func (doc *TextDocument) GetContainedNodes(start *Position, end *Position) ([]*Node, error) {
+	startPoint, endPoint, err := doc.rangeToPoints(start, end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]*Node, 0)
+
+	err = doc.VisitNodesInRange(startPoint, endPoint, func(node *Node) int8 {
+		if CompareNodeWithRange(node, startPoint, endPoint) == 0 {
+			list = append(list, node)
+			return 1
+		}
+
+		return 0
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Points of normalized range
+func (doc *TextDocument) rangeToPoints(start *Position, end *Position) (*Point, *Point, error) {
+	if positionAfter(start, end) {
+		start, end = end, start
+	}
+
+	startPoint, err := doc.PositionToPoint(start)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	endPoint, err := doc.PositionToPoint(end)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return startPoint, endPoint, nil
+}
+
+// Closest node of position and its text when node type is in identifierTypes, ["identifier"] by default.
+// Returns nil node for other nodes, like operators and punctuation
+func (doc *TextDocument) GetIdentifierAtPosition(pos *Position, identifierTypes []string) (*Node, string, error) {
+	node, err := doc.GetClosestNodeByPosition(pos)
+
+	if err != nil || node == nil {
+		return nil, "", err
+	}
+
+	if len(identifierTypes) == 0 {
+		identifierTypes = []string{"identifier"}
+	}
+
+	if !slices.Contains(identifierTypes, node.Type()) {
+		return nil, "", nil
+	}
+
+	return node, doc.NodeText(node), nil
+}
+
+// Nodes with type in types, ["identifier"] by default, which text equals name, in order of document.
+// Scopes are not resolved, so it is only textual search of references
+func (doc *TextDocument) FindIdentifierOccurrences(name string, types []string) ([]*Node, error) {
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(types) == 0 {
+		types = []string{"identifier"}
+	}
+
+	list := make([]*Node, 0)
+	c := sitter.NewTreeCursor(root)
+	defer c.Close()
+
+	VisitNode(c, func(node *Node) int8 {
+		// shorter node can not contain name
+		if doc.NodeByteLength(node) < UInt(len(name)) {
+			return 1
+		}
+
+		if slices.Contains(types, node.Type()) && doc.NodeText(node) == name {
+			list = append(list, node)
+		}
+
+		return 0
+	})
+
+	return list, nil
+}
+
+// Edits which replace each of FindIdentifierOccurrences() with newName, document is not changed.
+// Scopes are not resolved, so all occurrences are renamed
+func (doc *TextDocument) RenameIdentifier(name string, newName string, types []string) ([]proto.TextEdit, error) {
+	nodes, err := doc.FindIdentifierOccurrences(name, types)
+
+	if err != nil {
+		return nil, err
+	}
+
+	edits := make([]proto.TextEdit, len(nodes))
+
+	for i, node := range nodes {
+		r, err := doc.NodeToRange(node)
+
+		if err != nil {
+			return nil, err
+		}
+
+		edits[i] = proto.TextEdit{
+			Range:   *r,
+			NewText: newName,
+		}
+	}
+
+	return edits, nil
+}
+
+// Closest node at position or its ancestor which type is in types, like GetEnclosingNodesOfType()[0].
+// If types is empty then closest named ancestor, without node at position, will be returned
+func (doc *TextDocument) GetAncestorByPosition(pos *Position, types []string) (*Node, error) {
+	target, err := doc.GetClosestNodeByPosition(pos)
+
+	if err != nil || target == nil {
+		return nil, err
+	}
+
+	for node := target; node != nil; node = node.Parent() {
+		if len(types) == 0 {
+			if node != target && node.IsNamed() {
+				return node, nil
+			}
+
+			continue
+		}
+
+		if slices.Contains(types, node.Type()) {
+			return node, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Closest node of position and its ancestors with one of types, innermost first. Returns nil when nothing matches
+func (doc *TextDocument) GetEnclosingNodesOfType(pos *Position, types []string) ([]*Node, error) {
+	node, err := doc.GetClosestNodeByPosition(pos)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Node
+
+	for ; node != nil; node = node.Parent() {
+		if slices.Contains(types, node.Type()) {
+			list = append(list, node)
+		}
+	}
+
+	return list, nil
+}
+
+// Types of closest node of position and its ancestors, from root to node, like ["program", "lexical_declaration"]
+func (doc *TextDocument) GetNodePath(pos *Position) ([]string, error) {
+	nodes, err := doc.nodePath(pos)
+
+	if err != nil {
+		return nil, err
+	}
+
+	types := make([]string, len(nodes))
+
+	for i, node := range nodes {
+		types[i] = node.Type()
+	}
+
+	return types, nil
+}
+
+// Same as GetNodePath() plus range of each node, for clickable breadcrumbs
+func (doc *TextDocument) GetNodePathWithRanges(pos *Position) ([]string, []Range, error) {
+	nodes, err := doc.nodePath(pos)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	types := make([]string, len(nodes))
+	ranges := make([]Range, len(nodes))
+
+	for i, node := range nodes {
+		r, err := doc.NodeToRange(node)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		types[i] = node.Type()
+		ranges[i] = *r
+	}
+
+	return types, ranges, nil
+}
+
+// Closest node of position and its ancestors, root first
+func (doc *TextDocument) nodePath(pos *Position) ([]*Node, error) {
+	node, err := doc.GetClosestNodeByPosition(pos)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []*Node
+
+	for ; node != nil; node = node.Parent() {
+		nodes = append(nodes, node)
+	}
+
+	slices.Reverse(nodes)
+
+	return nodes, nil
+}
+
+// True when closest node of position or one of its ancestors has type in types, like ["comment", "string"].
+// False without error when there is no Tree
+func (doc *TextDocument) IsPositionInNodeType(pos *Position, types []string) (bool, error) {
+	node, err := doc.GetClosestNodeByPosition(pos)
+
+	if errors.Is(err, ErrNoTree) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	for ; node != nil; node = node.Parent() {
+		if slices.Contains(types, node.Type()) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// Ranges of open and close brackets where one of them is next to position. pairs is map of open to close bracket,
+// like {"(": ")"}. Bracket before position is checked first. Matching bracket is searched in siblings,
+// so brackets inside of strings or comments are not matched. Returns nil ranges when no bracket or no match
+func (doc *TextDocument) MatchBracket(pos *Position, pairs map[string]string) (*Range, *Range, error) {
+	nodes, err := doc.GetNodesByRange(pos, nil)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	point, err := doc.PositionToPoint(pos)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closes := make(map[string]string, len(pairs))
+
+	for open, close := range pairs {
+		closes[close] = open
+	}
+
+	var bracket *Node
+
+	for _, node := range nodes {
+		_, isOpen := pairs[node.Type()]
+		_, isClose := closes[node.Type()]
+
+		if node.IsNamed() || (!isOpen && !isClose) {
+			continue
+		}
+
+		if bracket == nil || node.EndPoint() == *point {
+			bracket = node
+		}
+	}
+
+	if bracket == nil {
+		return nil, nil, nil
+	}
+
+	open, isOpen := bracket.Type(), true
+	close, ok := pairs[open]
+
+	if !ok {
+		close, open, isOpen = open, closes[open], false
+	}
+
+	next := (*Node).NextSibling
+	same, other := open, close
+
+	if !isOpen {
+		next = (*Node).PrevSibling
+		same, other = close, open
+	}
+
+	depth := 0
+	var match *Node
+
+	for sibling := next(bracket); sibling != nil; sibling = next(sibling) {
+		switch sibling.Type() {
+		case same:
+			depth++
+
+		case other:
+			if depth == 0 {
+				match = sibling
+			}
+
+			depth--
+		}
+
+		if match != nil {
+			break
+		}
+	}
+
+	if match == nil {
+		return nil, nil, nil
+	}
+
+	if !isOpen {
+		bracket, match = match, bracket
+	}
+
+	openRange, err := doc.NodeToRange(bracket)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	closeRange, err := doc.NodeToRange(match)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return openRange, closeRange, nil
+}
+
+// For each position chain of ranges from closest named node to root node, for "expand selection".
+// Nodes with same range as their child are skipped
+func (doc *TextDocument) GetSelectionRanges(positions []*Position) ([]*proto.SelectionRange, error) {
+	list := make([]*proto.SelectionRange, len(positions))
+
+	for i, pos := range positions {
+		node, err := doc.GetClosestNodeByPosition(pos)
+
+		if err != nil {
+			return nil, err
+		}
+
+		var first, last *proto.SelectionRange
+
+		for ; node != nil; node = node.Parent() {
+			r, err := doc.NodeToRange(node)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if last != nil && last.Range == *r {
+				continue
+			}
+
+			item := &proto.SelectionRange{
+				Range: *r,
+			}
+
+			if last == nil {
+				first = item
+			} else {
+				last.Parent = item
+			}
+
+			last = item
+		}
+
+		list[i] = first
+	}
+
+	return list, nil
+}
+
+// Diagnostics of ERROR and MISSING nodes of Tree
+func (doc *TextDocument) GetSyntaxDiagnostics() ([]proto.Diagnostic, error) {
+	return doc.syntaxDiagnostics(nil, nil)
+}
+
+// Same as GetSyntaxDiagnostics() but only subtrees which touch range are walked. Diagnostics which end
+// at range start or start at range end are included, so missing nodes at range edges are not lost.
+// Reversed range is normalized
+func (doc *TextDocument) GetSyntaxDiagnosticsInRange(start *Position, end *Position) ([]proto.Diagnostic, error) {
+	startPoint, endPoint, err := doc.rangeToPoints(start, end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return doc.syntaxDiagnostics(startPoint, endPoint)
+}
+
+// Walk whole Tree when start and end are nil
+func (doc *TextDocument) syntaxDiagnostics(start *Point, end *Point) ([]proto.Diagnostic, error) {
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]proto.Diagnostic, 0)
+
+	c := sitter.NewTreeCursor(root)
+	defer c.Close()
+
+	VisitNode(c, func(node *Node) int8 {
+		if start != nil {
+			if pointBefore(node.EndPoint(), *start) {
+				return 1
+			}
+
+			if pointBefore(*end, node.StartPoint()) {
+				return -1
+			}
+		}
+
+		if !node.HasError() {
+			return 1
+		}
+
+		if !node.IsError() && !node.IsMissing() {
+			return 0
+		}
+
+		var diagnostic *proto.Diagnostic
+
+		diagnostic, err = doc.nodeDiagnostic(node)
+
+		if err != nil {
+			return -1
+		}
+
+		list = append(list, *diagnostic)
+
+		return 1
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+func pointBefore(a Point, b Point) bool {
+	return a.Row < b.Row || (a.Row == b.Row && a.Column < b.Column)
+}
+
+func (doc *TextDocument) nodeDiagnostic(node *Node) (*proto.Diagnostic, error) {
+	r, err := doc.NodeToRange(node)
+
+	if err != nil {
+		return nil, err
+	}
+
+	severity := proto.DiagnosticSeverityError
+	message := "Syntax error"
+
+	if node.IsMissing() {
+		message = "Missing " + node.Type()
+	}
+
+	return &proto.Diagnostic{
+		Range:    *r,
+		Severity: &severity,
+		Message:  message,
+	}, nil
+}
+
+// Folding ranges of named nodes which type is key of kinds and which span more than one line.
+// Value of kinds is kind of folding range, like "comment" or "region", empty string means no kind
+func (doc *TextDocument) GetFoldingRanges(kinds map[string]string) ([]proto.FoldingRange, error) {
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]proto.FoldingRange, 0)
+
+	c := sitter.NewTreeCursor(root)
+	defer c.Close()
+
+	VisitNode(c, func(node *Node) int8 {
+		kind, ok := kinds[node.Type()]
+
+		if !ok || !node.IsNamed() || node.StartPoint().Row == node.EndPoint().Row {
+			return 0
+		}
+
+		var r *Range
+
+		r, err = doc.NodeToRange(node)
+
+		if err != nil {
+			return -1
+		}
+
+		if r.Start.Line == r.End.Line {
+			return 0
+		}
+
+		item := proto.FoldingRange{
+			StartLine:      r.Start.Line,
+			StartCharacter: &r.Start.Character,
+			EndLine:        r.End.Line,
+			EndCharacter:   &r.End.Character,
+		}
+
+		if kind != "" {
+			item.Kind = &kind
+		}
+
+		list = append(list, item)
+
+		return 0
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return list, nil
+}
+
+// Hierarchical symbols of document. Each match of query should have capture named nameCapture with name of symbol
+// and other capture with whole symbol node, like "(function_declaration name: (identifier) @name) @symbol".
+// Kind of symbol is kindMap value of symbol node type, nodes with type not in kindMap are skipped.
+// Symbols are nested by containment of their nodes
+func (doc *TextDocument) GetDocumentSymbols(query *sitter.Query, nameCapture string, kindMap map[string]proto.SymbolKind) ([]proto.DocumentSymbol, error) {
+	root, err := doc.RootNode()
+
+	if err != nil {
+		return nil, err
+	}
+
+	qc := sitter.NewQueryCursor()
+	qc.Exec(query, root)
+	defer qc.Close()
+
+	symbols := make([]*documentSymbol, 0)
+	predicates := compileQueryPredicates(query)
+
+	for {
+		match, ok := qc.NextMatch()
+
+		if !ok {
+			break
+		}
+
+		if predicates != nil && !doc.matchPredicates(match, predicates[match.PatternIndex]) {
+			continue
+		}
+
+		var nameNode, symbolNode *Node
+
+		for _, cap := range match.Captures {
+			if query.CaptureNameForId(cap.Index) == nameCapture {
+				nameNode = cap.Node
+			} else if symbolNode == nil {
+				symbolNode = cap.Node
+			}
+		}
+
+		if nameNode == nil || symbolNode == nil {
+			continue
+		}
+
+		kind, ok := kindMap[symbolNode.Type()]
+
+		if !ok {
+			continue
+		}
+
+		r, err := doc.NodeToRange(symbolNode)
+
+		if err != nil {
+			return nil, err
+		}
+
+		selection, err := doc.NodeToRange(nameNode)
+
+		if err != nil {
+			return nil, err
+		}
+
+		symbols = append(symbols, &documentSymbol{
+			DocumentSymbol: proto.DocumentSymbol{
+				Name:           doc.NodeText(nameNode),
+				Kind:           kind,
+				Range:          *r,
+				SelectionRange: *selection,
+			},
+			start: symbolNode.StartByte(),
+			end:   symbolNode.EndByte(),
+		})
+	}
+
+	sort.SliceStable(symbols, func(i, j int) bool {
+		a, b := symbols[i], symbols[j]
+
+		return a.start < b.start || (a.start == b.start && a.end > b.end)
+	})
+
+	top := &documentSymbol{}
+	stack := []*documentSymbol{top}
+
+	for _, symbol := range symbols {
+		for len(stack) > 1 && stack[len(stack)-1].end < symbol.end {
+			stack = stack[:len(stack)-1]
+		}
+
+		parent := stack[len(stack)-1]
+		parent.children = append(parent.children, symbol)
+		stack = append(stack, symbol)
+	}
+
+	return convertDocumentSymbols(top.children), nil
+}
+
+// HighlightCaptures encoded as LSP semantic tokens. Multi-line captures are splitted to token per line
+func (doc *TextDocument) ConvertHighlightCaptures(legend HighlightLegend) ([]UInt, error) {
+	err := doc.checkTree()
+
+	if err != nil {
+		return nil, err
+	}
+
+	doc.UpdateHighlightCaptures()
+
+	tokens, _, err := doc.encodeHighlightCaptures(doc.HighlightCaptures, legend)
+
+	return tokens, err
+}
+
+// Same as ConvertHighlightCaptures() but only for captures overlapping range, for semanticTokens/range request.
+// First token is relative to document start
+func (doc *TextDocument) ConvertHighlightCapturesByRange(start *Position, end *Position, legend HighlightLegend) ([]UInt, error) {
+	startPoint, err := doc.PositionToPoint(start)
+
+	if err != nil {
+		return nil, err
+	}
+
+	endPoint, err := doc.PositionToPoint(end)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = doc.checkTree()
+
+	if err != nil {
+		return nil, err
+	}
+
+	list := doc.GetHighlightCapturesByRange(startPoint, endPoint)
+	tokens, _, err := doc.encodeHighlightCaptures(list, legend)
+
+	return tokens, err
+}
+
+// Highlight tokens with absolute positions where consecutive tokens of same TokenType which touch each other
+// on same line are merged into one, so editor has less decorations to apply
+func (doc *TextDocument) GetMergedHighlightRanges(legend HighlightLegend) ([]Token, error) {
+	err := doc.checkTree()
+
+	if err != nil {
+		return nil, err
+	}
+
+	doc.UpdateHighlightCaptures()
+
+	tokens, _, err := doc.highlightTokens(doc.HighlightCaptures, legend)
+
+	if err != nil {
+		return nil, err
+	}
+
+	merged := tokens[:0]
+
+	for _, token := range tokens {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+
+			if last.TokenType == token.TokenType && last.Line == token.Line && last.Character+last.Length == token.Character {
+				last.Length += token.Length
+				continue
+			}
+		}
+
+		merged = append(merged, token)
+	}
+
+	return merged, nil
+}
+
+// Same as ConvertHighlightCaptures() but tokens are passed to emit one by one instead of collecting them to slice,
+// so memory is not allocated for all encoded tokens. Error of emit stops encoding and is returned
+func (doc *TextDocument) ConvertHighlightCapturesFunc(legend HighlightLegend, emit func(line UInt, char UInt, length UInt, typ UInt, mods UInt) error) error {
+	err := doc.checkTree()
+
+	if err != nil {
+		return err
+	}
+
+	doc.UpdateHighlightCaptures()
+
+	return doc.eachEncodedHighlightToken(doc.HighlightCaptures, legend, func(_ *sitter.QueryCapture, token Token) error {
+		return emit(token.Line, token.Character, token.Length, token.Type, token.Modifiers)
+	})
+}
+
+// Encode captures as semantic tokens where each token position is relative to previous one.
+// Tokens are sorted by position, captures with same start by length, longer first, so deltas are never negative.
+// Returns captures in order of tokens
+func (doc *TextDocument) encodeHighlightCaptures(list []*sitter.QueryCapture, legend HighlightLegend) ([]UInt, []*sitter.QueryCapture, error) {
+	tokens := make([]UInt, 0, len(list)*5)
+	sorted := make([]*sitter.QueryCapture, 0, len(list))
+
+	err := doc.eachEncodedHighlightToken(list, legend, func(cap *sitter.QueryCapture, token Token) error {
+		tokens = append(tokens, token.Line, token.Character, token.Length, token.Type, token.Modifiers)
+		sorted = append(sorted, cap)
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tokens, sorted, nil
+}
+
+// Same as eachHighlightToken() but position of each token is relative to previous one
+func (doc *TextDocument) eachEncodedHighlightToken(list []*sitter.QueryCapture, legend HighlightLegend, fn func(*sitter.QueryCapture, Token) error) error {
+	var prev Position
+
+	return doc.eachHighlightToken(list, legend, func(cap *sitter.QueryCapture, token Token) error {
+		start := token.Position
+
+		token.Line -= prev.Line
+
+		if token.Line == 0 {
+			token.Character -= prev.Character
+		}
+
+		prev = start
+
+		return fn(cap, token)
+	})
+}
+
+// Tokens of captures with absolute positions, sorted like in encodeHighlightCaptures() and resolved by
+// TokenConflictResolution. Returns captures in order of tokens
+func (doc *TextDocument) highlightTokens(list []*sitter.QueryCapture, legend HighlightLegend) ([]Token, []*sitter.QueryCapture, error) {
+	tokens := make([]Token, 0, len(list))
+	sorted := make([]*sitter.QueryCapture, 0, len(list))
+
+	err := doc.eachHighlightToken(list, legend, func(cap *sitter.QueryCapture, token Token) error {
+		tokens = append(tokens, token)
+		sorted = append(sorted, cap)
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tokens, sorted, nil
+}
+
+// Call fn with tokens of each capture in order of highlightTokens(). Tokens are made only when capture is reached,
+// captures are sorted by byte ranges, which is same as sorting by positions. Multi-line capture has token for each line,
+// all with same capture. Stops with error of fn
+func (doc *TextDocument) eachHighlightToken(list []*sitter.QueryCapture, legend HighlightLegend, fn func(*sitter.QueryCapture, Token) error) error {
+	types := make([]TokenType, len(list))
+	ranges := make([]byteRange, len(list))
+	order := make([]int, 0, len(list))
+
+	for i, cap := range list {
+		tokenType, ok, err := doc.captureType(cap, legend)
+
+		if err != nil {
+			return err
+		}
+
+		// dropped by mapper, so it does not take part in conflicts resolution
+		if !ok {
+			continue
+		}
+
+		types[i] = tokenType
+		ranges[i] = byteRange{cap.Node.StartByte(), cap.Node.EndByte()}
+		order = append(order, i)
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := ranges[order[i]], ranges[order[j]]
+
+		if a.start != b.start {
+			return a.start < b.start
+		}
+
+		return a.end > b.end
+	})
+
+	if doc.TokenConflictResolution != KeepAllTokens {
+		order = doc.resolveTokenConflicts(order, ranges, list)
+	}
+
+	// tokens of next lines of multi-line captures, sorted by position, so nested captures are passed before them
+	var pending []captureLineToken
+
+	flush := func(pos *Position) error {
+		for len(pending) > 0 && (pos == nil || ComparePositions(&pending[0].Position, pos) <= 0) {
+			err := fn(pending[0].cap, pending[0].Token)
+
+			if err != nil {
+				return err
+			}
+
+			pending = pending[1:]
+		}
+
+		return nil
+	}
+
+	for _, index := range order {
+		cap := list[index]
+		tokens, err := doc.captureTokens(cap, types[index])
+
+		if err != nil {
+			return err
+		}
+
+		if len(tokens) == 0 {
+			continue
+		}
+
+		err = flush(&tokens[0].Position)
+
+		if err != nil {
+			return err
+		}
+
+		err = fn(cap, tokens[0])
+
+		if err != nil {
+			return err
+		}
+
+		for _, token := range tokens[1:] {
+			i := sort.Search(len(pending), func(i int) bool {
+				return ComparePositions(&pending[i].Position, &token.Position) > 0
+			})
+
+			pending = slices.Insert(pending, i, captureLineToken{cap, token})
+		}
+	}
+
+	return flush(nil)
+}
+
+type captureLineToken struct {
+	cap *sitter.QueryCapture
+	Token
+}
+
+// Map capture names to token types with fn instead of legend in ConvertHighlightCaptures() and other conversions
+// of captures to tokens. Captures for which fn returns false are dropped. nil fn means legend will be used
+func (doc *TextDocument) SetCaptureMapper(fn func(cap *sitter.QueryCapture, name string) (TokenType, bool)) {
+	doc.captureMapper = fn
+}
+
+// Type of capture from captureMapper or from legend by capture index. False when capture is dropped by mapper
+func (doc *TextDocument) captureType(cap *sitter.QueryCapture, legend HighlightLegend) (TokenType, bool, error) {
+	if doc.captureMapper != nil {
+		tokenType, ok := doc.captureMapper(cap, doc.CaptureName(cap))
+
+		return tokenType, ok, nil
+	}
+
+	if int(cap.Index) >= len(legend) {
+		return TokenType{}, false, fmt.Errorf("capture index %d is out of legend range (%d)", cap.Index, len(legend))
+	}
+
+	return legend[cap.Index], true, nil
+}
+
+// Tokens of capture with absolute positions, one per line because semantic tokens can not span lines.
+// Line terminators and empty lines are not included, zero length capture has one token
+func (doc *TextDocument) captureTokens(cap *sitter.QueryCapture, tokenType TokenType) ([]Token, error) {
+	start, err := doc.PointToPosition(cap.Node.StartPoint())
+
+	if err != nil {
+		return nil, err
+	}
+
+	startByte, endByte, err := doc.NodeToByteRange(cap.Node)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := make([]Token, 0, 1)
+	pos := *start
+	offset := startByte
+
+	for {
+		lineEnd := doc.lineEnd(pos.Line)
+		end := min(endByte, lineEnd)
+
+		if end > offset || startByte == endByte {
+			tokens = append(tokens, Token{
+				Position:  pos,
+				TokenType: tokenType,
+				Length:    doc.byteRangeLengthInChars(offset, end),
+			})
+		}
+
+		if endByte <= lineEnd || pos.Line+1 >= UInt(len(doc.Lines)) {
+			break
+		}
+
+		pos = Position{Line: pos.Line + 1}
+		offset = doc.Lines[pos.Line]
+	}
+
+	return tokens, nil
+}
+
+// Indexes of order without zero length captures and captures which lose to overlapping ones by TokenConflictResolution
+func (doc *TextDocument) resolveTokenConflicts(order []int, ranges []byteRange, list []*sitter.QueryCapture) []int {
+	candidates := make([]int, 0, len(order))
+
+	for _, i := range order {
+		if ranges[i].start < ranges[i].end {
+			candidates = append(candidates, i)
+		}
+	}
+
+	var patterns map[*sitter.QueryCapture]uint16
+
+	if doc.TokenConflictResolution == KeepPatternPriorityToken {
+		patterns = doc.highlightCapturePatterns()
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+
+		if doc.TokenConflictResolution == KeepPriorityToken && list[a].Index != list[b].Index {
+			return list[a].Index < list[b].Index
+		}
+
+		if patterns != nil && patterns[list[a]] != patterns[list[b]] {
+			return patterns[list[a]] < patterns[list[b]]
+		}
+
+		return ranges[a].end-ranges[a].start < ranges[b].end-ranges[b].start
+	})
+
+	// kept ranges do not overlap, so they are sorted by start and by end
+	kept := make([]byteRange, 0, len(candidates))
+	keep := make([]bool, len(ranges))
+
+	for _, i := range candidates {
+		r := ranges[i]
+		j := sort.Search(len(kept), func(j int) bool {
+			return kept[j].end > r.start
+		})
+
+		if j < len(kept) && kept[j].start < r.end {
+			continue
+		}
+
+		kept = slices.Insert(kept, j, r)
+		keep[i] = true
+	}
+
+	result := make([]int, 0, len(kept))
+
+	for _, i := range order {
+		if keep[i] {
+			result = append(result, i)
+		}
+	}
+
+	return result
+}
+
+// Diff result of ConvertHighlightCaptures() with prev result of it.
+// prev should be encoded tokens and not captures because nodes of old tree are not valid after reparse.
+// Start and Delete of edits are measured in integers of encoded tokens, like in semantic tokens delta of LSP
+func (doc *TextDocument) ConvertHighlightCapturesDelta(prev []UInt, legend HighlightLegend) ([]HighlightEdit, error) {
+	if len(prev)%5 != 0 {
+		return nil, fmt.Errorf("prev tokens length %d is not multiple of 5", len(prev))
+	}
+
+	err := doc.checkTree()
+
+	if err != nil {
+		return nil, err
+	}
+
+	doc.UpdateHighlightCaptures()
+
+	tokens, captures, err := doc.encodeHighlightCaptures(doc.HighlightCaptures, legend)
+
+	if err != nil {
+		return nil, err
+	}
+
+	edits := make([]HighlightEdit, 0, 1)
+	prevCount := len(prev)
+	count := len(tokens)
+	max := min(prevCount, count)
+	start := 0
+
+	for start < max && equalTokens(prev[start:start+5], tokens[start:start+5]) {
+		start += 5
+	}
+
+	end := 0
+
+	for end < max-start && equalTokens(prev[prevCount-end-5:prevCount-end], tokens[count-end-5:count-end]) {
+		end += 5
+	}
+
+	if start == prevCount && start == count {
+		return edits, nil
+	}
+
+	edits = append(edits, HighlightEdit{
+		Start:  UInt(start),
+		Delete: UInt(prevCount - start - end),
+		Insert: captures[start/5 : (count-end)/5],
+		Data:   tokens[start : count-end],
+	})
+
+	return edits, nil
+}
+
+// Compare Node with points range
+//
+// -1 - node before range
+// 0 - node inside range
+// 1 - node overlaps range
+// 2 - node after range
+func CompareNodeWithRange(node *Node, rangeStart *Point, rangeEnd *Point) int8 {
+	start := node.StartPoint()
+	end := node.EndPoint()
+	zeroRange := rangeStart.Row == rangeEnd.Row && rangeStart.Column == rangeEnd.Column
+
+	if zeroRange &&
+		((start.Row == rangeStart.Row && start.Column == rangeStart.Column) ||
+			(end.Row == rangeEnd.Row && end.Column == rangeEnd.Column)) {
+		return 1
+	}
+
+	if end.Row < rangeStart.Row || (rangeStart.Row == end.Row && end.Column <= rangeStart.Column) {
+		return -1
+	}
+
+	if (rangeStart.Row < start.Row || rangeStart.Row == start.Row && rangeStart.Column <= start.Column) &&
+		(rangeEnd.Row > end.Row || rangeEnd.Row == end.Row && rangeEnd.Column >= end.Column) {
+		return 0
+	}
+
+	if rangeEnd.Row < start.Row || (rangeEnd.Row == start.Row && rangeEnd.Column <= start.Column) {
+		return 2
+	}
+
+	return 1
+}
+
+func NodeOverlapsRange(node *Node, rangeStart *Point, rangeEnd *Point) bool {
+	res := CompareNodeWithRange(node, rangeStart, rangeEnd)
+
+	return res == 0 || res == 1
+}
+
+// Walk through Tree starting from cursor node and its next siblings, without recursion so deep trees are safe.
+// compare function should return: -1 to stop walking, 0 for go inside, 1 to go to next sibling.
+// After walking cursor will be on one of starting siblings
+func VisitNode(cursor *sitter.TreeCursor, compare func(*Node) int8) {
+	depth := 0
+
+	defer func() {
+		for ; depth > 0; depth-- {
+			cursor.GoToParent()
+		}
+	}()
+
+	for {
+		action := compare(cursor.CurrentNode())
+
+		if action < 0 {
+			return
+		}
+
+		if action == 0 && cursor.GoToFirstChild() {
+			depth++
+			continue
+		}
+
+		for !cursor.GoToNextSibling() {
+			if depth == 0 {
+				return
+			}
+
+			cursor.GoToParent()
+			depth--
+		}
+	}
+}
+
+// Ranges of inserted text of edits since last parse, moved by next edits
+func (doc *TextDocument) editedRanges() []byteRange {
+	ranges := make([]byteRange, len(doc.edits))
+
+	for i, e := range doc.edits {
+		r := byteRange{e.start, e.newEnd}
+
+		for _, next := range doc.edits[i+1:] {
+			r = next.shift(r)
+		}
+
+		ranges[i] = r
+	}
+
+	return ranges
+}
+
+// Byte ranges where new node differs from node of edited old tree.
+// Same subtrees are found by node id, because incremental parse reuses subtrees of old tree
+func diffNodes(a *Node, b *Node, ranges []byteRange) []byteRange {
+	if sameNode(a, b) {
+		return ranges
+	}
+
+	if a.Symbol() != b.Symbol() || a.ChildCount() == 0 || b.ChildCount() == 0 {
+		return append(ranges, byteRange{min(a.StartByte(), b.StartByte()), max(a.EndByte(), b.EndByte())})
+	}
+
+	oldChildren := nodeChildren(a)
+	newChildren := nodeChildren(b)
+	count := len(oldChildren)
+	newCount := len(newChildren)
+	first := 0
+
+	for first < count && first < newCount && sameNode(oldChildren[first], newChildren[first]) {
+		first++
+	}
+
+	last := 0
+
+	for last < count-first && last < newCount-first && sameNode(oldChildren[count-1-last], newChildren[newCount-1-last]) {
+		last++
+	}
+
+	if count == newCount {
+		for i := first; i < count-last; i++ {
+			ranges = diffNodes(oldChildren[i], newChildren[i], ranges)
+		}
+
+		return ranges
+	}
+
+	r := byteRange{max(a.EndByte(), b.EndByte()), 0}
+
+	for _, children := range [][]*Node{oldChildren[first : count-last], newChildren[first : newCount-last]} {
+		for _, child := range children {
+			r.start = min(r.start, child.StartByte())
+			r.end = max(r.end, child.EndByte())
+		}
+	}
+
+	return append(ranges, r)
+}
+
+// Start of first node which differs in old and new tree, or start when there are no changes before it.
+// Same as first range of diffNodes(), but children after start aren't compared
+func firstChangedByte(a *Node, b *Node, start UInt) UInt {
+	if sameNode(a, b) {
+		return start
+	}
+
+	if a.Symbol() != b.Symbol() || a.ChildCount() == 0 || b.ChildCount() == 0 {
+		return min(a.StartByte(), b.StartByte(), start)
+	}
+
+	oldCursor := sitter.NewTreeCursor(a)
+	defer oldCursor.Close()
+
+	newCursor := sitter.NewTreeCursor(b)
+	defer newCursor.Close()
+
+	count := min(a.ChildCount(), b.ChildCount())
+	ok := oldCursor.GoToFirstChild() && newCursor.GoToFirstChild()
+
+	for i := UInt(0); ok; i++ {
+		oldChild := oldCursor.CurrentNode()
+		newChild := newCursor.CurrentNode()
+		newStart := newChild.StartByte()
+
+		// reused child has same position, because previous children are same
+		if oldChild.ID() == newChild.ID() {
+			if newStart >= start {
+				return start
+			}
+		} else if min(oldChild.StartByte(), newStart) >= start {
+			return start
+		} else if !sameNode(oldChild, newChild) {
+			if a.ChildCount() != b.ChildCount() {
+				return min(oldChild.StartByte(), newStart, start)
+			}
+
+			first := firstChangedByte(oldChild, newChild, start)
+
+			if first < start {
+				return first
+			}
+		}
+
+		ok = i+1 < count && oldCursor.GoToNextSibling() && newCursor.GoToNextSibling()
+	}
+
+	// one of nodes has more children after same ones
+	if a.ChildCount() > count {
+		return min(a.Child(int(count)).StartByte(), start)
+	}
+
+	if b.ChildCount() > count {
+		return min(b.Child(int(count)).StartByte(), start)
+	}
+
+	return start
+}
+
+// Children with cursor, because node.Child(i) searches child from first one
+func nodeChildren(node *Node) []*Node {
+	c := sitter.NewTreeCursor(node)
+	defer c.Close()
+
+	list := make([]*Node, 0, node.ChildCount())
+
+	for ok := c.GoToFirstChild(); ok; ok = c.GoToNextSibling() {
+		list = append(list, c.CurrentNode())
+	}
+
+	return list
+}
+
+// Small leaves are stored inside of parent node, so their id changes with parent.
+// Text of leaf with same range could be changed only by edit, which is checked separately
+func sameNode(a *Node, b *Node) bool {
+	if a.StartByte() != b.StartByte() {
+		return false
+	}
+
+	if a.ID() == b.ID() {
+		return true
+	}
+
+	return a.ChildCount() == 0 && b.ChildCount() == 0 &&
+		a.Symbol() == b.Symbol() && a.EndByte() == b.EndByte() && a.IsMissing() == b.IsMissing()
+}
+
+// Move byte range of text before edit to text after edit. Range which overlaps edit is extended to whole new text of edit
+func (e byteEdit) shift(r byteRange) byteRange {
+	start, end := r.start, r.end
+
+	if start > e.start {
+		if start >= e.oldEnd {
+			start = start - e.oldEnd + e.newEnd
+		} else {
+			start = e.start
+		}
+	}
+
+	if end > e.start {
+		if end >= e.oldEnd {
+			end = end - e.oldEnd + e.newEnd
+		} else {
+			end = e.newEnd
+		}
+	}
+
+	return byteRange{start, end}
+}
+
+// Default isWordChar of WordRangeAtPosition(), [A-Za-z0-9_]
+func IsWordChar(char rune) bool {
+	return char == '_' ||
+		(char >= 'a' && char <= 'z') ||
+		(char >= 'A' && char <= 'Z') ||
+		(char >= '0' && char <= '9')
+}
+
+func BitMask(indexes []UInt) UInt {
+	value := UInt(0)
+
+	for _, index := range indexes {
+		bit := math.Pow(2, float64(index))
+		value = value | UInt(bit)
+	}
+
+	return value
+}
+
+// BitMask() of indexes of names in legend, like modifiers of semantic tokens legend of server
+func ModifierMask(names []string, legend []string) (UInt, error) {
+	indexes := make([]UInt, len(names))
+
+	for i, name := range names {
+		index := slices.Index(legend, name)
+
+		if index < 0 {
+			return 0, fmt.Errorf("modifier %q is not in legend", name)
+		}
+
+		indexes[i] = UInt(index)
+	}
+
+	return BitMask(indexes), nil
+}
+
+// Length of rune in units of PositionEncoding
+func (doc *TextDocument) runeLength(char rune, size int) UInt {
+	switch doc.PositionEncoding {
+	case UTF8:
+		return UInt(size)
+
+	case UTF32:
+		return 1
+
+	case Grapheme:
+		if isGraphemeExtend(char) {
+			return 0
+		}
+
+		return 1
+
+	default:
+		if char >= 0x10000 {
+			return 2
+		}
+
+		return 1
+	}
+}
+
+// Rune which continues grapheme cluster of previous rune
+func isGraphemeExtend(char rune) bool {
+	return char == 0x200D || (char >= 0x1F3FB && char <= 0x1F3FF) || unicode.In(char, unicode.Mn, unicode.Me, unicode.Mc)
+}
+
+func convertDocumentSymbols(list []*documentSymbol) []proto.DocumentSymbol {
+	symbols := make([]proto.DocumentSymbol, len(list))
+
+	for i, item := range list {
+		symbols[i] = item.DocumentSymbol
+
+		if len(item.children) > 0 {
+			symbols[i].Children = convertDocumentSymbols(item.children)
+		}
+	}
+
+	return symbols
+}
+
+func contextOrBackground(ctx *context.Context) context.Context {
+	if ctx == nil {
+		return context.Background()
+	}
+
+	return *ctx
+}
+
+func equalTokens(a []UInt, b []UInt) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func shouldIgnore(ignore *Ignore, node *Node) bool {
+	if ignore == nil {
+		return false
+	}
+
+	return (ignore.Missing && node.IsMissing()) ||
+		(ignore.Extra && node.IsExtra()) ||
+		(ignore.Error && node.IsError()) ||
+		(ignore.Null && node.IsNull()) ||
+		(ignore.Named && node.IsNamed()) ||
+		(ignore.Anonymous && !node.IsNamed())
+}
+
+// Document will be used only through returned wrapper, so it should not be used directly after this call
+func NewSyncTextDocument(doc *TextDocument) *SyncTextDocument {
+	doc.shared = true
+	doc.UpdateHighlightCaptures()
+
+	return &SyncTextDocument{
+		doc: doc,
+	}
+}
+
+// Call fn under read lock. fn should not change document
+func (sd *SyncTextDocument) Read(fn func(doc *TextDocument)) {
+	sd.mu.RLock()
+	defer sd.mu.RUnlock()
+
+	fn(sd.doc)
+}
+
+// Call fn under write lock. Highlight captures will be updated after fn so readers will not update them
+func (sd *SyncTextDocument) Write(fn func(doc *TextDocument) error) error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	err := fn(sd.doc)
+	sd.doc.UpdateHighlightCaptures()
+
+	return err
+}
+
+func (sd *SyncTextDocument) Change(e *ChangeEvent) error {
+	return sd.ChangeCtx(e, nil)
+}
+
+func (sd *SyncTextDocument) ChangeCtx(e *ChangeEvent, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.ChangeCtx(e, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) ChangeMany(events []*ChangeEvent, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.ChangeMany(events, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) ChangeVersioned(version int32, e *ChangeEvent) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.ChangeVersioned(version, e)
+	})
+}
+
+func (sd *SyncTextDocument) ApplyDidChange(changes []ChangeEvent, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.ApplyDidChange(changes, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) ApplyDidChangeParams(params *proto.DidChangeTextDocumentParams, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.ApplyDidChangeParams(params, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) SetText(text string) error {
+	return sd.SetTextCtx(text, nil)
+}
+
+func (sd *SyncTextDocument) SetTextCtx(text string, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.SetTextCtx(text, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) SetTextIncremental(text string, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.SetTextIncremental(text, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) ReplaceNode(node *Node, text string, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.ReplaceNode(node, text, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) SetParser(parser *sitter.Parser) error {
+	return sd.SetParserCtx(parser, nil)
+}
+
+func (sd *SyncTextDocument) SetParserCtx(parser *sitter.Parser, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.SetParserCtx(parser, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) SetHighlightQuery(query *sitter.Query, ignore *Ignore) {
+	sd.Write(func(doc *TextDocument) error {
+		doc.SetHighlightQuery(query, ignore)
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) SetCaptureMapper(fn func(cap *sitter.QueryCapture, name string) (TokenType, bool)) {
+	sd.Write(func(doc *TextDocument) error {
+		doc.SetCaptureMapper(fn)
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) SetParseTimeout(d time.Duration) {
+	sd.Write(func(doc *TextDocument) error {
+		doc.SetParseTimeout(d)
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) RegisterGrammar(name string, parser *sitter.Parser, detect func(doc *TextDocument) bool) {
+	sd.Write(func(doc *TextDocument) error {
+		doc.RegisterGrammar(name, parser, detect)
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) DetectGrammar() (name string, err error) {
+	err = sd.Write(func(doc *TextDocument) error {
+		name, err = doc.DetectGrammar()
+		return err
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) Clone() (doc *TextDocument) {
+	sd.Read(func(d *TextDocument) {
+		doc = d.Clone()
+	})
+
+	return
+}
+
+// Returns copy of Text
+func (sd *SyncTextDocument) Text() (text string) {
+	sd.Read(func(doc *TextDocument) {
+		text = doc.Text
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) HasTree() (ok bool) {
+	sd.Read(func(doc *TextDocument) {
+		ok = doc.HasTree()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) PositionsToByteIndexes(positions []*Position) (list []UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		list, err = doc.PositionsToByteIndexes(positions)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) Bytes() (bytes []byte) {
+	sd.Read(func(doc *TextDocument) {
+		bytes = doc.Bytes()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) RootNode() (node *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, err = doc.RootNode()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) LastChangedRanges() (ranges []Range) {
+	sd.Read(func(doc *TextDocument) {
+		ranges = doc.LastChangedRanges()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNodesByRange(start *Position, end *Position) (nodes []*Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		nodes, err = doc.GetNodesByRange(start, end)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNodesByByteRange(start UInt, end UInt) (nodes []*Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		nodes, err = doc.GetNodesByByteRange(start, end)
+	})
+
+	return
+}
+
+// compare is called under read lock
+func (sd *SyncTextDocument) VisitNodesInRange(start *Point, end *Point, compare func(*Node) int8) (err error) {
+	sd.Read(func(doc *TextDocument) {
+		err = doc.VisitNodesInRange(start, end, compare)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNodeByPosition(pos *Position) (node *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, err = doc.GetNodeByPosition(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetClosestNodeByPosition(pos *Position) (node *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, err = doc.GetClosestNodeByPosition(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetSiblingNodes(pos *Position) (prev *Node, current *Node, next *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		prev, current, next, err = doc.GetSiblingNodes(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetIdentifierAtPosition(pos *Position, identifierTypes []string) (node *Node, text string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, text, err = doc.GetIdentifierAtPosition(pos, identifierTypes)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) FindIdentifierOccurrences(name string, types []string) (list []*Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		list, err = doc.FindIdentifierOccurrences(name, types)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetContainingNode(start *Position, end *Position) (node *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, err = doc.GetContainingNode(start, end)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNamedDescendantForRange(start *Position, end *Position) (node *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, err = doc.GetNamedDescendantForRange(start, end)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNodeByStableRange(r *Range) (node *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, err = doc.GetNodeByStableRange(r)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ShiftRange(r *Range, edit *ChangeEvent) (res *Range) {
+	sd.Read(func(doc *TextDocument) {
+		res = doc.ShiftRange(r, edit)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetContainedNodes(start *Position, end *Position) (nodes []*Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		nodes, err = doc.GetContainedNodes(start, end)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNodePath(pos *Position) (types []string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		types, err = doc.GetNodePath(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNodePathWithRanges(pos *Position) (types []string, ranges []Range, err error) {
+	sd.Read(func(doc *TextDocument) {
+		types, ranges, err = doc.GetNodePathWithRanges(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) IsPositionInNodeType(pos *Position, types []string) (ok bool, err error) {
+	sd.Read(func(doc *TextDocument) {
+		ok, err = doc.IsPositionInNodeType(pos, types)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) RenameIdentifier(name string, newName string, types []string) (edits []proto.TextEdit, err error) {
+	sd.Read(func(doc *TextDocument) {
+		edits, err = doc.RenameIdentifier(name, newName, types)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetHighlightCaptureByPosition(pos *Position) (cap *sitter.QueryCapture, err error) {
+	sd.Read(func(doc *TextDocument) {
+		cap, err = doc.GetHighlightCaptureByPosition(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetTokenAtPosition(pos *Position, legend HighlightLegend) (token *Token, err error) {
+	sd.Read(func(doc *TextDocument) {
+		token, err = doc.GetTokenAtPosition(pos, legend)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetHighlightCaptureNameByPosition(pos *Position) (name string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		name, err = doc.GetHighlightCaptureNameByPosition(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ConvertHighlightCaptures(legend HighlightLegend) (tokens []UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		tokens, err = doc.ConvertHighlightCaptures(legend)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ConvertHighlightCapturesFunc(legend HighlightLegend, emit func(line UInt, char UInt, length UInt, typ UInt, mods UInt) error) (err error) {
+	sd.Read(func(doc *TextDocument) {
+		err = doc.ConvertHighlightCapturesFunc(legend, emit)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ChangeResult(e *ChangeEvent, ctx *context.Context) (r *Range, err error) {
+	err = sd.Write(func(doc *TextDocument) error {
+		r, err = doc.ChangeResult(e, ctx)
+		return err
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ChangeBytes(start UInt, end UInt, text string, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.ChangeBytes(start, end, text, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) SetTextDiff(text string, ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.SetTextDiff(text, ctx)
+	})
+}
+
+func (sd *SyncTextDocument) Reset(text string) {
+	sd.Write(func(doc *TextDocument) error {
+		doc.Reset(text)
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) UpdateLines() {
+	sd.Write(func(doc *TextDocument) error {
+		doc.UpdateLines()
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) UpdateTree(ctx *context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.UpdateTree(ctx)
+	})
+}
+
+func (sd *SyncTextDocument) SetParserKeepTree(parser *sitter.Parser) {
+	sd.Write(func(doc *TextDocument) error {
+		doc.SetParserKeepTree(parser)
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) UpdateHighlightCaptures() {
+	sd.Write(func(doc *TextDocument) error {
+		doc.UpdateHighlightCaptures()
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) UpdateHighlightCapturesCtx(ctx context.Context) error {
+	return sd.Write(func(doc *TextDocument) error {
+		return doc.UpdateHighlightCapturesCtx(ctx)
+	})
+}
+
+func (sd *SyncTextDocument) AddInjection(language *sitter.Language, query *sitter.Query, region Range) (inj *Injection, err error) {
+	err = sd.Write(func(doc *TextDocument) error {
+		inj, err = doc.AddInjection(language, query, region)
+		return err
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) Close() {
+	sd.Write(func(doc *TextDocument) error {
+		doc.Close()
+		return nil
+	})
+}
+
+func (sd *SyncTextDocument) TreeDirty() (dirty bool) {
+	sd.Read(func(doc *TextDocument) {
+		dirty = doc.TreeDirty()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) HasFinalNewline() (ok bool) {
+	sd.Read(func(doc *TextDocument) {
+		ok = doc.HasFinalNewline()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) LineCount() (count UInt) {
+	sd.Read(func(doc *TextDocument) {
+		count = doc.LineCount()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) EndPosition() (pos *Position) {
+	sd.Read(func(doc *TextDocument) {
+		pos = doc.EndPosition()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) FullRange() (r *Range) {
+	sd.Read(func(doc *TextDocument) {
+		r = doc.FullRange()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) EachLine(fn func(line UInt, text string) bool) {
+	sd.Read(func(doc *TextDocument) {
+		doc.EachLine(fn)
+	})
+}
+
+func (sd *SyncTextDocument) GetLineText(line UInt) (text string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		text, err = doc.GetLineText(line)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetLineIndentation(line UInt) (spaces UInt, tabs UInt, text string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		spaces, tabs, text, err = doc.GetLineIndentation(line)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) IsEmptyLine(line UInt) (ok bool, err error) {
+	sd.Read(func(doc *TextDocument) {
+		ok, err = doc.IsEmptyLine(line)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) LineRange(line UInt) (r *Range, err error) {
+	sd.Read(func(doc *TextDocument) {
+		r, err = doc.LineRange(line)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) LineMinMaxByteIndex(line UInt) (min UInt, max UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		min, max, err = doc.LineMinMaxByteIndex(line)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) LineLengthInChars(line UInt) (length UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		length, err = doc.LineLengthInChars(line)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) EndOfLinePosition(line UInt) (pos *Position, err error) {
+	sd.Read(func(doc *TextDocument) {
+		pos, err = doc.EndOfLinePosition(line)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetTextByRange(r *Range) (text string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		text, err = doc.GetTextByRange(r)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ClampPosition(pos *Position) (res *Position) {
+	sd.Read(func(doc *TextDocument) {
+		res = doc.ClampPosition(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) PositionToByteIndex(pos *Position) (index UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		index, err = doc.PositionToByteIndex(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) PositionToPoint(pos *Position) (point *Point, err error) {
+	sd.Read(func(doc *TextDocument) {
+		point, err = doc.PositionToPoint(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) PositionToUTF16Offset(pos *Position) (offset UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		offset, err = doc.PositionToUTF16Offset(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) PositionToVisualColumn(pos *Position) (column UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		column, err = doc.PositionToVisualColumn(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) UTF16OffsetToPosition(offset UInt) (pos *Position, err error) {
+	sd.Read(func(doc *TextDocument) {
+		pos, err = doc.UTF16OffsetToPosition(offset)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ByteIndexLine(index UInt) (line UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		line, err = doc.ByteIndexLine(index)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ByteIndexToPoint(index UInt) (point *Point, err error) {
+	sd.Read(func(doc *TextDocument) {
+		point, err = doc.ByteIndexToPoint(index)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ByteIndexToPosition(index UInt) (pos *Position, err error) {
+	sd.Read(func(doc *TextDocument) {
+		pos, err = doc.ByteIndexToPosition(index)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ByteRangeToRange(start UInt, end UInt) (r *Range, err error) {
+	sd.Read(func(doc *TextDocument) {
+		r, err = doc.ByteRangeToRange(start, end)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) LineByteIndexToPosition(line UInt, index UInt) (pos *Position, err error) {
+	sd.Read(func(doc *TextDocument) {
+		pos, err = doc.LineByteIndexToPosition(line, index)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) PointToPosition(point Point) (pos *Position, err error) {
+	sd.Read(func(doc *TextDocument) {
+		pos, err = doc.PointToPosition(point)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) RangeToSitterRange(r *Range) (res *sitter.Range, err error) {
+	sd.Read(func(doc *TextDocument) {
+		res, err = doc.RangeToSitterRange(r)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNonSpaceTextAroundPosition(pos *Position) (text string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		text, err = doc.GetNonSpaceTextAroundPosition(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNonSpaceTextAroundPositionFunc(pos *Position, isBoundary func(rune) bool) (text string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		text, err = doc.GetNonSpaceTextAroundPositionFunc(pos, isBoundary)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) WordRangeAtPosition(pos *Position, isWordChar func(rune) bool) (r *Range, text string, err error) {
+	sd.Read(func(doc *TextDocument) {
+		r, text, err = doc.WordRangeAtPosition(pos, isWordChar)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) MatchBracket(pos *Position, pairs map[string]string) (open *Range, close *Range, err error) {
+	sd.Read(func(doc *TextDocument) {
+		open, close, err = doc.MatchBracket(pos, pairs)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) NodeText(node *Node) (text string) {
+	sd.Read(func(doc *TextDocument) {
+		text = doc.NodeText(node)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) NodeByteRange(node *Node) (start UInt, end UInt) {
+	sd.Read(func(doc *TextDocument) {
+		start, end = doc.NodeByteRange(node)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) NodeByteLength(node *Node) (length UInt) {
+	sd.Read(func(doc *TextDocument) {
+		length = doc.NodeByteLength(node)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) NodeToByteRange(node *Node) (start UInt, end UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		start, end, err = doc.NodeToByteRange(node)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) NodeStartPosition(node *Node) (pos *Position, err error) {
+	sd.Read(func(doc *TextDocument) {
+		pos, err = doc.NodeStartPosition(node)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) NodeEndPosition(node *Node) (pos *Position, err error) {
+	sd.Read(func(doc *TextDocument) {
+		pos, err = doc.NodeEndPosition(node)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) NodeToRange(node *Node) (r *proto.Range, err error) {
+	sd.Read(func(doc *TextDocument) {
+		r, err = doc.NodeToRange(node)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNodeAtByteIndex(index UInt) (node *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, err = doc.GetNodeAtByteIndex(index)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetNodesByRangeOpts(start *Position, end *Position, opts NodeRangeOptions) (nodes []*Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		nodes, err = doc.GetNodesByRangeOpts(start, end, opts)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetAncestorByPosition(pos *Position, types []string) (node *Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		node, err = doc.GetAncestorByPosition(pos, types)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetEnclosingNodesOfType(pos *Position, types []string) (nodes []*Node, err error) {
+	sd.Read(func(doc *TextDocument) {
+		nodes, err = doc.GetEnclosingNodesOfType(pos, types)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetSelectionRanges(positions []*Position) (ranges []*proto.SelectionRange, err error) {
+	sd.Read(func(doc *TextDocument) {
+		ranges, err = doc.GetSelectionRanges(positions)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetSyntaxDiagnostics() (list []proto.Diagnostic, err error) {
+	sd.Read(func(doc *TextDocument) {
+		list, err = doc.GetSyntaxDiagnostics()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetSyntaxDiagnosticsInRange(start *Position, end *Position) (list []proto.Diagnostic, err error) {
+	sd.Read(func(doc *TextDocument) {
+		list, err = doc.GetSyntaxDiagnosticsInRange(start, end)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetFoldingRanges(kinds map[string]string) (list []proto.FoldingRange, err error) {
+	sd.Read(func(doc *TextDocument) {
+		list, err = doc.GetFoldingRanges(kinds)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetDocumentSymbols(query *sitter.Query, nameCapture string, kindMap map[string]proto.SymbolKind) (symbols []proto.DocumentSymbol, err error) {
+	sd.Read(func(doc *TextDocument) {
+		symbols, err = doc.GetDocumentSymbols(query, nameCapture, kindMap)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ParseRegion(language *sitter.Language, region Range) (tree *sitter.Tree, err error) {
+	sd.Read(func(doc *TextDocument) {
+		tree, err = doc.ParseRegion(language, region)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) QueryCaptures(query *sitter.Query, root *Node, ignore *Ignore) (list []*sitter.QueryCapture) {
+	sd.Read(func(doc *TextDocument) {
+		list = doc.QueryCaptures(query, root, ignore)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) CaptureName(cap *sitter.QueryCapture) (name string) {
+	sd.Read(func(doc *TextDocument) {
+		name = doc.CaptureName(cap)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) EachHighlightCapture(root *Node, fn func(*sitter.QueryCapture) bool) {
+	sd.Read(func(doc *TextDocument) {
+		doc.EachHighlightCapture(root, fn)
+	})
+}
+
+func (sd *SyncTextDocument) GetHighlightCapturesInLine(line UInt) (list []*sitter.QueryCapture) {
+	sd.Read(func(doc *TextDocument) {
+		list = doc.GetHighlightCapturesInLine(line)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetHighlightCapturesInNode(root *Node) (list []*sitter.QueryCapture) {
+	sd.Read(func(doc *TextDocument) {
+		list = doc.GetHighlightCapturesInNode(root)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetHighlightCapturesByRange(start *Point, end *Point) (list []*sitter.QueryCapture) {
+	sd.Read(func(doc *TextDocument) {
+		list = doc.GetHighlightCapturesByRange(start, end)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetHighlightCapturesWithPatterns() (list []HighlightCapture) {
+	sd.Read(func(doc *TextDocument) {
+		list = doc.GetHighlightCapturesWithPatterns()
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetClosestHighlightCaptureByPosition(pos *Position) (prev *sitter.QueryCapture, target *sitter.QueryCapture, next *sitter.QueryCapture, err error) {
+	sd.Read(func(doc *TextDocument) {
+		prev, target, next, err = doc.GetClosestHighlightCaptureByPosition(pos)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) GetMergedHighlightRanges(legend HighlightLegend) (tokens []Token, err error) {
+	sd.Read(func(doc *TextDocument) {
+		tokens, err = doc.GetMergedHighlightRanges(legend)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ConvertHighlightCapturesByRange(start *Position, end *Position, legend HighlightLegend) (tokens []UInt, err error) {
+	sd.Read(func(doc *TextDocument) {
+		tokens, err = doc.ConvertHighlightCapturesByRange(start, end, legend)
+	})
+
+	return
+}
+
+func (sd *SyncTextDocument) ConvertHighlightCapturesDelta(prev []UInt, legend HighlightLegend) (edits []HighlightEdit, err error) {
+	sd.Read(func(doc *TextDocument) {
+		edits, err = doc.ConvertHighlightCapturesDelta(prev, legend)
+	})
+
+	return
 }
@@ -1,10 +1,21 @@
 package textdocument_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/redexp/textdocument"
 	sitter "github.com/smacker/go-tree-sitter"
+	"github.com/smacker/go-tree-sitter/css"
 	js "github.com/smacker/go-tree-sitter/javascript"
 	proto "github.com/tliron/glsp/protocol_3_16"
 )
@@ -39,6 +50,375 @@ func TestUpdateLines(t *testing.T) {
 	}
 }
 
+func TestReset(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2\nvar z = 3")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	lines := doc.Lines
+	doc.Reset("let a\nlet b")
+
+	if doc.Tree != nil || doc.HighlightCaptures != nil {
+		t.Errorf("Tree and HighlightCaptures should be nil")
+	}
+
+	if &lines[0] != &doc.Lines[0] {
+		t.Errorf("Lines backing array should be reused")
+	}
+
+	if len(doc.Lines) != 2 || doc.Lines[1] != 6 || doc.TextLength != 11 {
+		t.Errorf("wrong lines %v", doc.Lines)
+	}
+
+	pos, err := doc.ByteIndexToPosition(8)
+
+	if err != nil || pos.Line != 1 || pos.Character != 2 {
+		t.Errorf("pos %v err %v expect {1, 2}", pos, err)
+	}
+
+	err = doc.UpdateTree(nil)
+
+	if err != nil {
+		t.Fatalf("UpdateTree err %s", err)
+	}
+
+	doc.UpdateHighlightCaptures()
+
+	if len(doc.HighlightCaptures) != 2 {
+		t.Errorf("HighlightCaptures len %d expect 2", len(doc.HighlightCaptures))
+	}
+}
+
+func TestClose(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = `a {}`")
+	doc.SetParser(createParser())
+	doc.AddInjection(css.GetLanguage(), nil, *textdocument.NewRange(0, 9, 0, 13))
+
+	doc.Close()
+
+	if doc.Tree != nil || len(doc.Injections) != 0 {
+		t.Errorf("Tree and Injections should be closed")
+	}
+
+	doc.Close()
+}
+
+func TestClone(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = `a {}`")
+	doc.SetParser(createParser())
+	doc.AddInjection(css.GetLanguage(), nil, *textdocument.NewRange(1, 9, 1, 13))
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	clone := doc.Clone()
+	defer clone.Close()
+
+	if !clone.HighlightCapturesDirty || clone.HighlightCaptures != nil {
+		t.Errorf("clone captures should be dirty")
+	}
+
+	err := clone.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 4, 0, 5),
+		Text:  "abc",
+	})
+
+	if err != nil {
+		t.Fatalf("change err %s", err)
+	}
+
+	clone.UpdateHighlightCaptures()
+
+	if len(clone.HighlightCaptures) != 2 || clone.HighlightCaptures[1].Node.StartByte() != 16 {
+		t.Errorf("clone captures %v", clone.HighlightCaptures)
+	}
+
+	if doc.Text != "var x = 1\nvar y = `a {}`" || len(doc.Lines) != 2 || doc.Tree.RootNode().EndByte() != doc.TextLength {
+		t.Errorf("original changed %q %v", doc.Text, doc.Lines)
+	}
+
+	if len(doc.HighlightCaptures) != 2 || doc.HighlightCaptures[1].Node.StartByte() != 14 || doc.HighlightCaptures[1].Node.Content([]byte(doc.Text)) != "y" {
+		t.Errorf("original captures %v", doc.HighlightCaptures)
+	}
+
+	if len(clone.Injections) != 1 || clone.Injections[0] == doc.Injections[0] || clone.Injections[0].Tree == doc.Injections[0].Tree {
+		t.Errorf("injections should be copied")
+	}
+
+	doc.Close()
+
+	if clone.Tree.RootNode().Type() != "program" || clone.Injections[0].Tree.RootNode().Type() != "stylesheet" {
+		t.Errorf("clone trees closed with original")
+	}
+}
+
+func TestIsEmptyLine(t *testing.T) {
+	list := []struct {
+		Text  string
+		Empty []bool
+	}{
+		{"", []bool{true}},
+		{"a", []bool{false}},
+		{"a\n", []bool{false, true}},
+		{"a\r\n\r\nb", []bool{false, true, false}},
+		{"\n \n", []bool{true, false, true}},
+		{"\r\r", []bool{true, true, true}},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+
+		for line, expect := range item.Empty {
+			empty, err := doc.IsEmptyLine(textdocument.UInt(line))
+
+			if err != nil || empty != expect {
+				t.Errorf("%d.%d empty %v err %v expect %v", i, line, empty, err, expect)
+			}
+		}
+
+		if _, err := doc.IsEmptyLine(textdocument.UInt(len(item.Empty))); err == nil {
+			t.Errorf("%d line out of range should return error", i)
+		}
+	}
+}
+
+func TestLineCount(t *testing.T) {
+	list := []struct {
+		Text         string
+		Count        uint32
+		FinalNewline bool
+		LastLine     uint32
+	}{
+		{"", 0, false, 0},
+		{"a", 1, false, 0},
+		{"a\n", 1, true, 1},
+		{"a\r\nb", 2, false, 1},
+		{"a\nb\r\n", 2, true, 2},
+		{"a\n\n", 2, true, 2},
+		{"\n", 1, true, 1},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+
+		if doc.LineCount() != item.Count {
+			t.Errorf("%d LineCount %d expect %d", i, doc.LineCount(), item.Count)
+		}
+
+		if doc.HasFinalNewline() != item.FinalNewline {
+			t.Errorf("%d HasFinalNewline %v expect %v", i, doc.HasFinalNewline(), item.FinalNewline)
+		}
+
+		index, err := doc.PositionToByteIndex(&textdocument.Position{Line: item.LastLine, Character: 0})
+
+		if err != nil {
+			t.Errorf("%d last line err %s", i, err)
+		}
+
+		if item.FinalNewline && index != doc.TextLength {
+			t.Errorf("%d last line index %d expect %d", i, index, doc.TextLength)
+		}
+
+		_, err = doc.PositionToByteIndex(&textdocument.Position{Line: item.LastLine + 1, Character: 0})
+
+		if err == nil {
+			t.Errorf("%d line after last should return error", i)
+		}
+	}
+}
+
+func TestNewTextDocumentFromReader(t *testing.T) {
+	text := getDoc().Text
+	doc, err := textdocument.NewTextDocumentFromReader(iotest.OneByteReader(strings.NewReader(text)))
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if doc.Text != text {
+		t.Errorf("text '%s' expect '%s'", doc.Text, text)
+	}
+
+	if len(doc.Lines) != 3 {
+		t.Errorf("Lines should be len 3, actual %d", len(doc.Lines))
+	}
+
+	_, err = textdocument.NewTextDocumentFromReader(iotest.ErrReader(errors.New("read error")))
+
+	if err == nil {
+		t.Errorf("should return error")
+	}
+}
+
+func TestLineEnding(t *testing.T) {
+	list := []struct {
+		Text    string
+		Lines   []uint32
+		Ending  string
+		Node    []uint32
+		NodeEnd []uint32
+	}{
+		{"var x = 1\nvar y = 2", []uint32{0, 10}, "\n", []uint32{1, 4}, []uint32{1, 5}},
+		{"var x = 1\r\nvar y = 2\r\n", []uint32{0, 11, 22}, "\r\n", []uint32{1, 4}, []uint32{1, 5}},
+		{"var x = 1\rvar y = 2\r\nvar z = 3", []uint32{0, 10, 21}, "\r", []uint32{2, 4}, []uint32{2, 5}},
+		{"var x = 1", []uint32{0}, "", []uint32{0, 4}, []uint32{0, 5}},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+		doc.SetParser(createParser())
+
+		if doc.LineEnding != item.Ending {
+			t.Errorf("%d LineEnding %q expect %q", i, doc.LineEnding, item.Ending)
+		}
+
+		if len(doc.Lines) != len(item.Lines) {
+			t.Errorf("%d Lines %v expect %v", i, doc.Lines, item.Lines)
+			continue
+		}
+
+		for n, offset := range item.Lines {
+			if doc.Lines[n] != offset {
+				t.Errorf("%d Lines %v expect %v", i, doc.Lines, item.Lines)
+				break
+			}
+		}
+
+		text, err := doc.GetNonSpaceTextAroundPosition(&textdocument.Position{Line: 0, Character: 8})
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+		} else if text != "1" {
+			t.Errorf("%d text %q expect '1'", i, text)
+		}
+
+		_, err = doc.PositionToByteIndex(&textdocument.Position{Line: 0, Character: 10})
+
+		if err == nil {
+			t.Errorf("%d line terminator should not be addressable", i)
+		}
+
+		node, err := doc.GetNodeByPosition(&textdocument.Position{Line: item.Node[0], Character: item.Node[1]})
+
+		if err != nil || node == nil {
+			t.Errorf("%d node %v err %v", i, node, err)
+			continue
+		}
+
+		r, err := doc.NodeToRange(node)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if r.Start.Line != item.Node[0] || r.Start.Character != item.Node[1] || r.End.Line != item.NodeEnd[0] || r.End.Character != item.NodeEnd[1] {
+			t.Errorf("%d node range %v expect %v - %v", i, r, item.Node, item.NodeEnd)
+		}
+	}
+
+	doc := textdocument.NewTextDocument("a\rb\r\nc")
+	doc.SetParser(createParser())
+
+	err := doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(1, 1, 2, 0),
+		Text:  "\r",
+	})
+
+	if err != nil {
+		t.Fatalf("Change err %s", err)
+	}
+
+	if doc.Text != "a\rb\rc" || len(doc.Lines) != 3 {
+		t.Errorf("text %q lines %v", doc.Text, doc.Lines)
+	}
+}
+
+func TestChangeLines(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	parts := []string{"a", "bc", "⌘", "\n", "\r\n", "\n\n", " ", "\r"}
+	random := func(max int) string {
+		text := ""
+		count := r.Intn(max)
+
+		for i := 0; i < count; i++ {
+			part := parts[r.Intn(len(parts))]
+
+			// lone CR only sometimes to test both ways of updating lines
+			if part == "\r" && r.Intn(10) > 0 {
+				continue
+			}
+
+			text += part
+		}
+
+		return text
+	}
+
+	doc := textdocument.NewTextDocument(random(50))
+	applied := 0
+
+	for i := 0; i < 2000; i++ {
+		if i%200 == 0 {
+			doc.SetText(random(50))
+		}
+
+		start := r.Intn(len(doc.Text) + 1)
+		end := start + r.Intn(len(doc.Text)-start+1)
+
+		startPos, err1 := doc.ByteIndexToPosition(uint32(start))
+		endPos, err2 := doc.ByteIndexToPosition(uint32(end))
+
+		// index inside of multi byte char or line terminator
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		if index, _ := doc.PositionToByteIndex(startPos); index != uint32(start) {
+			continue
+		}
+
+		if index, _ := doc.PositionToByteIndex(endPos); index != uint32(end) {
+			continue
+		}
+
+		text := random(6)
+		check := doc.Text[:start] + text + doc.Text[end:]
+
+		err := doc.Change(&textdocument.ChangeEvent{
+			Range: &textdocument.Range{Start: *startPos, End: *endPos},
+			Text:  text,
+		})
+
+		if err != nil {
+			t.Fatalf("%d err %s", i, err)
+		}
+
+		if doc.Text != check {
+			t.Fatalf("%d text %q expect %q", i, doc.Text, check)
+		}
+
+		applied++
+		full := textdocument.NewTextDocument(check)
+
+		if len(doc.Lines) != len(full.Lines) || doc.LineEnding != full.LineEnding || doc.TextLength != full.TextLength {
+			t.Fatalf("%d lines %v %q expect %v %q for %q", i, doc.Lines, doc.LineEnding, full.Lines, full.LineEnding, check)
+		}
+
+		for n := range full.Lines {
+			if doc.Lines[n] != full.Lines[n] {
+				t.Fatalf("%d lines %v expect %v for %q", i, doc.Lines, full.Lines, check)
+			}
+		}
+	}
+
+	if applied < 1000 {
+		t.Errorf("only %d changes applied", applied)
+	}
+}
+
 func TestChange(t *testing.T) {
 	doc := getDoc()
 
@@ -99,490 +479,4780 @@ func TestChange(t *testing.T) {
 	}
 }
 
-func TestPositionToByteIndex(t *testing.T) {
-	doc := getDoc()
+func TestChangeFull(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+	doc.SetParser(createParser())
 
-	list := [][]uint32{
-		{0, 0, 0, 0},
-		{0, 2, 4, 0},
-		{0, 4, 6, 1},
-		{1, 0, 6, 0},
-		{1, 2, 8, 0},
-		{1, 5, 11, 1},
-		{2, 0, 11, 0},
-		{2, 3, 16, 0},
-		{2, 4, 17, 1},
-		{3, 0, 0, 1},
+	text := "let y = 2\nlet z = 3"
+	err := doc.Change(&textdocument.ChangeEvent{
+		Text: text,
+	})
+
+	if err != nil {
+		t.Fatalf("Change err %s", err)
 	}
 
-	for i, item := range list {
-		index, err := doc.PositionToByteIndex(&proto.Position{
-			Line:      item[0],
-			Character: item[1],
-		})
+	if doc.Text != text {
+		t.Errorf("text '%s' expect '%s'", doc.Text, text)
+	}
 
-		if item[3] == 1 {
-			if err == nil {
-				t.Errorf("%d should return error", i)
-			}
-			continue
-		}
+	if len(doc.Lines) != 2 {
+		t.Errorf("Lines should be len 2, actual %d", len(doc.Lines))
+	}
 
-		if err != nil {
-			t.Errorf("PositionToByteIndex err: %s", err.Error())
-		}
+	node, err := doc.GetNodeByPosition(&textdocument.Position{Line: 1, Character: 4})
 
-		if index != item[2] {
-			t.Errorf("%d index %d expect %d", i, index, item[2])
-		}
+	if err != nil {
+		t.Fatalf("GetNodeByPosition err %s", err)
 	}
-}
 
-func TestByteIndexToPosition(t *testing.T) {
-	doc := getDoc()
+	if value := node.Content([]byte(doc.Text)); value != "z" {
+		t.Errorf("node '%s' expect 'z'", value)
+	}
 
-	list := [][]uint32{
-		{0, 0, 0},
-		{3, 0, 1},
-		{4, 0, 2},
-		{7, 1, 1},
-		{15, 2, 2},
-		{16, 2, 3},
-		{17, 3, 0},
+	err = doc.ChangeMany([]*textdocument.ChangeEvent{
+		{
+			Range: textdocument.NewRange(0, 0, 0, 3),
+			Text:  "var",
+		},
+		{
+			Text: "const a = 1",
+		},
+		{
+			Range: textdocument.NewRange(0, 6, 0, 7),
+			Text:  "b",
+		},
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("ChangeMany err %s", err)
 	}
 
-	for i, item := range list {
-		if i == 6 {
-			doc.SetText(doc.Text + "\n")
-		}
+	if doc.Text != "const b = 1" {
+		t.Errorf("text '%s' expect 'const b = 1'", doc.Text)
+	}
 
-		pos, err := doc.ByteIndexToPosition(item[0])
+	if doc.Tree.RootNode().HasError() {
+		t.Errorf("tree has error %s", doc.Tree.RootNode())
+	}
 
-		if err != nil {
+	// full replacement without previous edits, then edit of new text in same batch
+	err = doc.ChangeMany([]*textdocument.ChangeEvent{
+		{
+			Text: "function foo() { return 1 }",
+		},
+		{
+			Range: textdocument.NewRange(0, 9, 0, 12),
+			Text:  "barbaz",
+		},
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("ChangeMany err %s", err)
+	}
+
+	expect := "(program (function_declaration name: (identifier) parameters: (formal_parameters) body: (statement_block (return_statement (number)))))"
+
+	if tree := doc.Tree.RootNode().String(); tree != expect {
+		t.Errorf("tree %s expect %s", tree, expect)
+	}
+}
+
+func TestChangeResult(t *testing.T) {
+	text := "var x = 1\nvar ⌘ = 2"
+
+	list := []struct {
+		Range  *textdocument.Range
+		Text   string
+		Result *textdocument.Range
+	}{
+		{textdocument.NewRange(0, 4, 0, 5), "abc", textdocument.NewRange(0, 4, 0, 7)},
+		{textdocument.NewRange(0, 9, 1, 0), ";\n\nlet ", textdocument.NewRange(0, 9, 2, 4)},
+		{textdocument.NewRange(1, 4, 1, 5), "⌘⌘", textdocument.NewRange(1, 4, 1, 6)},
+		{textdocument.NewRange(1, 0, 1, 9), "", textdocument.NewRange(1, 0, 1, 0)},
+		{nil, "a\r\nb", textdocument.NewRange(0, 0, 1, 1)},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(text)
+		doc.SetParser(createParser())
+
+		r, err := doc.ChangeResult(&textdocument.ChangeEvent{
+			Range: item.Range,
+			Text:  item.Text,
+		}, nil)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if *r != *item.Result {
+			t.Errorf("%d range %v expect %v", i, r, item.Result)
+		}
+
+		inserted, err := doc.GetTextByRange(r)
+
+		if err != nil || inserted != item.Text {
+			t.Errorf("%d text %q expect %q (%v)", i, inserted, item.Text, err)
+		}
+	}
+}
+
+func TestChangeUpdatesHighlights(t *testing.T) {
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident"), getLang())
+
+	list := []func(doc *textdocument.TextDocument) error{
+		func(doc *textdocument.TextDocument) error {
+			return doc.Change(&textdocument.ChangeEvent{Range: textdocument.NewRange(0, 4, 0, 5), Text: "abc"})
+		},
+		func(doc *textdocument.TextDocument) error {
+			return doc.Change(&textdocument.ChangeEvent{Text: "var abc = 1"})
+		},
+		func(doc *textdocument.TextDocument) error {
+			return doc.ChangeMany([]*textdocument.ChangeEvent{{Range: textdocument.NewRange(0, 4, 0, 5), Text: "abc"}}, nil)
+		},
+		func(doc *textdocument.TextDocument) error {
+			return doc.ChangeBytes(4, 5, "abc", nil)
+		},
+	}
+
+	for i, change := range list {
+		doc := textdocument.NewTextDocument("var x = 1")
+		doc.SetParser(createParser())
+		doc.SetHighlightQuery(q, nil)
+
+		err := change(doc)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if doc.HighlightCapturesDirty || len(doc.HighlightCaptures) != 1 || doc.NodeText(doc.HighlightCaptures[0].Node) != "abc" {
+			t.Errorf("%d captures %v dirty %v", i, doc.HighlightCaptures, doc.HighlightCapturesDirty)
+		}
+	}
+
+	doc := textdocument.NewTextDocument("var x = 1")
+	doc.SetParser(createParser())
+	doc.SetHighlightQuery(q, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := doc.ChangeBytes(4, 5, "abc", &ctx); err == nil {
+		t.Errorf("canceled ctx should return error")
+	}
+}
+
+func TestChangeBytes(t *testing.T) {
+	text := "var x = 1\nvar ⌘ = 2"
+
+	list := []struct {
+		Range *textdocument.Range
+		Start uint32
+		End   uint32
+		Text  string
+	}{
+		{textdocument.NewRange(0, 4, 0, 5), 4, 5, "abc"},
+		{textdocument.NewRange(0, 9, 1, 0), 9, 10, ";\n\n"},
+		{textdocument.NewRange(1, 4, 1, 5), 14, 17, "y"},
+		{textdocument.NewRange(1, 9, 1, 9), 21, 21, " + 1"},
+	}
+
+	for i, item := range list {
+		one := textdocument.NewTextDocument(text)
+		one.SetParser(createParser())
+
+		err := one.Change(&textdocument.ChangeEvent{
+			Range: item.Range,
+			Text:  item.Text,
+		})
+
+		if err != nil {
+			t.Errorf("%d Change err %s", i, err)
+			continue
+		}
+
+		bytes := textdocument.NewTextDocument(text)
+		bytes.SetParser(createParser())
+
+		err = bytes.ChangeBytes(item.Start, item.End, item.Text, nil)
+
+		if err != nil {
+			t.Errorf("%d ChangeBytes err %s", i, err)
+			continue
+		}
+
+		if bytes.Text != one.Text {
+			t.Errorf("%d text '%s' expect '%s'", i, bytes.Text, one.Text)
+		}
+
+		if bytes.Tree.RootNode().String() != one.Tree.RootNode().String() {
+			t.Errorf("%d tree %s expect %s", i, bytes.Tree.RootNode(), one.Tree.RootNode())
+		}
+	}
+
+	doc := textdocument.NewTextDocument(text)
+
+	if doc.ChangeBytes(5, 4, "", nil) == nil {
+		t.Errorf("reversed range should return error")
+	}
+
+	if doc.ChangeBytes(5, 100, "", nil) == nil {
+		t.Errorf("out of range should return error")
+	}
+}
+
+func TestSetTextDiff(t *testing.T) {
+	text := "var x = 1;\r\nvar ⌘ = 2;\n"
+
+	list := []string{
+		"var x = 1;\r\nvar ⌘ = 2;\n",
+		"var xy = 1;\r\nvar ⌘ = 2;\n",
+		"var x = 1;\nvar ⌘ = 2;\n",
+		"var x = 1;\r\r\nvar ⌘ = 2;\n",
+		"var x = 1;\r\nvar ⌗ = 2;\n",
+		"var x = 1;\r\nvar ⌘ = 2;\nx++",
+		"x++;var x = 1;\r\nvar ⌘ = 2;\n",
+		"",
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(text)
+		doc.SetParser(createParser())
+
+		err := doc.SetTextDiff(item, nil)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		check := textdocument.NewTextDocument(item)
+		check.SetParser(createParser())
+
+		if doc.Text != item {
+			t.Errorf("%d text %q expect %q", i, doc.Text, item)
+		}
+
+		if fmt.Sprint(doc.Lines) != fmt.Sprint(check.Lines) {
+			t.Errorf("%d lines %v expect %v", i, doc.Lines, check.Lines)
+		}
+
+		if doc.Tree.RootNode().String() != check.Tree.RootNode().String() {
+			t.Errorf("%d tree %s expect %s", i, doc.Tree.RootNode(), check.Tree.RootNode())
+		}
+	}
+}
+
+func TestSetTextIncremental(t *testing.T) {
+	text := "var x = 1;\nvar y = 2;\nvar z = 3;"
+
+	list := []struct {
+		Text  string
+		Large bool
+		Full  bool
+	}{
+		{"var x = 1;\nvar y = 20;\nvar z = 3;", false, false},
+		{"var x = 1;\nvar y = 20;\nvar z = 3;", true, false},
+		{"let a = [1, 2, 3, 4, 5, 6, 7, 8];\nvar z = 3;", false, false},
+		{"let a = [1, 2, 3, 4, 5, 6, 7, 8];\nvar z = 3;", true, true},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(text)
+		doc.SetParser(createParser())
+		doc.TrackChangedRanges = true
+		doc.FullReparseLargeDiff = item.Large
+
+		err := doc.SetTextIncremental(item.Text, nil)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		check := createParser().Parse(nil, []byte(item.Text)).RootNode().String()
+
+		if doc.Tree.RootNode().String() != check {
+			t.Errorf("%d tree %s expect %s", i, doc.Tree.RootNode(), check)
+		}
+
+		ranges := doc.LastChangedRanges()
+		full := len(ranges) == 1 && ranges[0] == textdocument.Range{End: *doc.EndPosition()}
+
+		if full != item.Full {
+			t.Errorf("%d full reparse %v expect %v, ranges %v", i, full, item.Full, ranges)
+		}
+	}
+}
+
+func TestSetParserKeepTree(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+	doc.SetParser(createParser())
+
+	tree := doc.Tree
+	doc.SetParserKeepTree(createParser())
+
+	if doc.Tree != tree {
+		t.Errorf("tree should be kept")
+	}
+
+	err := doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 4, 0, 5),
+		Text:  "y",
+	})
+
+	if err != nil {
+		t.Fatalf("Change err %s", err)
+	}
+
+	check := createParser().Parse(nil, []byte(doc.Text)).RootNode().String()
+
+	if doc.Tree.RootNode().String() != check {
+		t.Errorf("tree %s expect %s", doc.Tree.RootNode(), check)
+	}
+}
+
+func TestTreeDirty(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+
+	if !doc.TreeDirty() {
+		t.Errorf("document without parser should be dirty")
+	}
+
+	doc.SetParser(createParser())
+
+	if doc.TreeDirty() {
+		t.Errorf("parsed document should not be dirty")
+	}
+
+	// parser without language can not parse
+	doc.SetParserKeepTree(sitter.NewParser())
+
+	err := doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 8, 0, 9),
+		Text:  "100",
+	})
+
+	if err == nil {
+		t.Fatalf("Change should return parse error")
+	}
+
+	if !doc.TreeDirty() {
+		t.Errorf("document should be dirty after failed parse")
+	}
+
+	pos := &textdocument.Position{Line: 0, Character: 4}
+
+	if _, err := doc.GetNodeByPosition(pos); !errors.Is(err, textdocument.ErrTreeDirty) {
+		t.Errorf("GetNodeByPosition err %v expect ErrTreeDirty", err)
+	}
+
+	if _, err := doc.GetClosestNodeByPosition(pos); !errors.Is(err, textdocument.ErrTreeDirty) {
+		t.Errorf("GetClosestNodeByPosition err %v expect ErrTreeDirty", err)
+	}
+
+	if _, err := doc.GetSyntaxDiagnostics(); !errors.Is(err, textdocument.ErrTreeDirty) {
+		t.Errorf("GetSyntaxDiagnostics err %v expect ErrTreeDirty", err)
+	}
+
+	doc.SetParserKeepTree(createParser())
+	err = doc.UpdateTree(nil)
+
+	if err != nil {
+		t.Fatalf("UpdateTree err %s", err)
+	}
+
+	if doc.TreeDirty() {
+		t.Errorf("document should not be dirty after parse")
+	}
+
+	node, err := doc.GetNodeByPosition(&textdocument.Position{Line: 0, Character: 10})
+
+	if err != nil || node.Content([]byte(doc.Text)) != "100" {
+		t.Errorf("node %v err %v expect 100", node, err)
+	}
+}
+
+func TestNoParser(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+	pos := &textdocument.Position{Line: 0, Character: 4}
+
+	if doc.HasTree() {
+		t.Errorf("document without parser should not have tree")
+	}
+
+	if _, err := doc.GetNodeByPosition(pos); !errors.Is(err, textdocument.ErrNoParser) {
+		t.Errorf("GetNodeByPosition err %v expect ErrNoParser", err)
+	}
+
+	if _, err := doc.GetClosestNodeByPosition(pos); !errors.Is(err, textdocument.ErrNoParser) {
+		t.Errorf("GetClosestNodeByPosition err %v expect ErrNoParser", err)
+	}
+
+	if _, err := doc.GetAncestorByPosition(pos, nil); !errors.Is(err, textdocument.ErrNoParser) {
+		t.Errorf("GetAncestorByPosition err %v expect ErrNoParser", err)
+	}
+
+	err := doc.VisitNodesInRange(&textdocument.Point{}, &textdocument.Point{}, func(*textdocument.Node) int8 { return 0 })
+
+	if !errors.Is(err, textdocument.ErrNoParser) {
+		t.Errorf("VisitNodesInRange err %v expect ErrNoParser", err)
+	}
+
+	if _, err := doc.GetSyntaxDiagnostics(); !errors.Is(err, textdocument.ErrNoParser) {
+		t.Errorf("GetSyntaxDiagnostics err %v expect ErrNoParser", err)
+	}
+
+	if _, err := doc.GetFoldingRanges(nil); !errors.Is(err, textdocument.ErrNoParser) {
+		t.Errorf("GetFoldingRanges err %v expect ErrNoParser", err)
+	}
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @name"), getLang())
+
+	if _, err := doc.GetDocumentSymbols(q, "name", nil); !errors.Is(err, textdocument.ErrNoParser) {
+		t.Errorf("GetDocumentSymbols err %v expect ErrNoParser", err)
+	}
+
+	doc.SetParser(createParser())
+
+	if !doc.HasTree() {
+		t.Errorf("parsed document should have tree")
+	}
+
+	node, err := doc.GetNodeByPosition(pos)
+
+	if err != nil || node == nil {
+		t.Errorf("node %v err %v", node, err)
+	}
+}
+
+func TestRootNode(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+
+	if _, err := doc.RootNode(); !errors.Is(err, textdocument.ErrNoParser) || !errors.Is(err, textdocument.ErrNoTree) {
+		t.Errorf("err %v expect ErrNoParser", err)
+	}
+
+	doc.SetParserKeepTree(createParser())
+
+	root, err := doc.RootNode()
+
+	if err != nil || root == nil || root.Type() != "program" {
+		t.Fatalf("root %v err %v", root, err)
+	}
+
+	if doc.Tree == nil {
+		t.Errorf("tree should be parsed on demand")
+	}
+
+	doc.SetParserKeepTree(sitter.NewParser())
+	doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 8, 0, 9),
+		Text:  "2",
+	})
+
+	if _, err := doc.RootNode(); !errors.Is(err, textdocument.ErrTreeDirty) {
+		t.Errorf("err %v expect ErrTreeDirty", err)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+	doc.SetParser(createParser())
+
+	bytes := doc.Bytes()
+
+	if string(bytes) != doc.Text {
+		t.Errorf("bytes %q expect %q", bytes, doc.Text)
+	}
+
+	if &doc.Bytes()[0] != &bytes[0] {
+		t.Errorf("bytes should be cached")
+	}
+
+	doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 8, 0, 9),
+		Text:  "2",
+	})
+
+	if string(doc.Bytes()) != "var x = 2" {
+		t.Errorf("bytes %q after change", doc.Bytes())
+	}
+
+	doc.SetText("")
+
+	if len(doc.Bytes()) != 0 {
+		t.Errorf("bytes %q of empty text", doc.Bytes())
+	}
+}
+
+func TestChangeInsertDelete(t *testing.T) {
+	text := "var x = 1;\r\nvar y = 2;\nvar z = 3;"
+
+	list := []struct {
+		Range *textdocument.Range
+		Text  string
+	}{
+		{textdocument.NewRange(0, 8, 0, 8), "100"},
+		{textdocument.NewRange(1, 4, 1, 4), "yy\n;var "},
+		{textdocument.NewRange(0, 8, 0, 9), ""},
+		{textdocument.NewRange(0, 10, 2, 0), ""},
+		{textdocument.NewRange(1, 0, 1, 0), "\r\n"},
+		{textdocument.NewRange(0, 3, 0, 3), "\r"},
+	}
+
+	nodes := func(root *sitter.Node) []string {
+		list := make([]string, 0)
+		c := sitter.NewTreeCursor(root)
+		defer c.Close()
+
+		textdocument.VisitNode(c, func(node *textdocument.Node) int8 {
+			list = append(list, fmt.Sprintf("%s %v %v", node.Type(), node.StartPoint(), node.EndPoint()))
+			return 0
+		})
+
+		return list
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(text)
+		doc.SetParser(createParser())
+
+		err := doc.Change(&textdocument.ChangeEvent{Range: item.Range, Text: item.Text})
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		actual := nodes(doc.Tree.RootNode())
+		expect := nodes(createParser().Parse(nil, []byte(doc.Text)).RootNode())
+
+		if !slices.Equal(actual, expect) {
+			t.Errorf("%d nodes %v expect %v", i, actual, expect)
+		}
+	}
+}
+
+func TestReplaceNode(t *testing.T) {
+	doc := textdocument.NewTextDocument("var ⌘ = 1;\r\nf(⌘, 2);")
+	doc.PositionEncoding = textdocument.UTF16
+	doc.SetParser(createParser())
+
+	node, _ := doc.GetNodeByPosition(&textdocument.Position{Line: 1, Character: 5})
+
+	err := doc.ReplaceNode(node, "[3, 4]", nil)
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expect := "var ⌘ = 1;\r\nf(⌘, [3, 4]);"
+
+	if doc.Text != expect {
+		t.Errorf("text %q expect %q", doc.Text, expect)
+	}
+
+	check := createParser().Parse(nil, []byte(doc.Text)).RootNode().String()
+
+	if doc.Tree.RootNode().String() != check {
+		t.Errorf("tree %s expect %s", doc.Tree.RootNode(), check)
+	}
+
+	other := textdocument.NewTextDocument(strings.Repeat(" ", 50) + "x")
+	other.SetParser(createParser())
+	node, _ = other.GetNodeByPosition(&textdocument.Position{Line: 0, Character: 50})
+
+	if err := doc.ReplaceNode(node, "y", nil); err == nil || doc.Text != expect {
+		t.Errorf("node out of text err %v text %q", err, doc.Text)
+	}
+}
+
+func TestChangeReversedRange(t *testing.T) {
+	text := "var x = 1\nvar y = 2"
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	list := []*textdocument.Range{
+		textdocument.NewRange(0, 5, 0, 4),
+		textdocument.NewRange(1, 0, 0, 9),
+	}
+
+	for i, r := range list {
+		err := doc.Change(&textdocument.ChangeEvent{Range: r, Text: "z"})
+
+		if err == nil {
+			t.Errorf("%d reversed range should return error", i)
+		}
+
+		if doc.Text != text || doc.TreeDirty() {
+			t.Errorf("%d text %q should not be changed", i, doc.Text)
+		}
+	}
+
+	// lenient clamping can make range reversed too
+	doc.Lenient = true
+
+	err := doc.Change(&textdocument.ChangeEvent{Range: textdocument.NewRange(5, 0, 1, 0), Text: "z"})
+
+	if err == nil || doc.Text != text {
+		t.Errorf("lenient reversed range err %v text %q", err, doc.Text)
+	}
+}
+
+func TestDetectGrammar(t *testing.T) {
+	cssParser := sitter.NewParser()
+	cssParser.SetLanguage(css.GetLanguage())
+
+	doc := textdocument.NewTextDocument("a { color: red }")
+	doc.RegisterGrammar("css", cssParser, func(doc *textdocument.TextDocument) bool {
+		return strings.HasPrefix(doc.Text, "a {")
+	})
+	doc.RegisterGrammar("js", createParser(), func(doc *textdocument.TextDocument) bool {
+		return strings.HasPrefix(doc.Text, "var ")
+	})
+
+	list := []struct {
+		Text string
+		Name string
+		Root string
+	}{
+		{"a { color: red }", "css", "stylesheet"},
+		{"a { color: blue }", "css", "stylesheet"},
+		{"var x = 1;", "js", "program"},
+		{"x", "", "program"},
+	}
+
+	for i, item := range list {
+		err := doc.SetText(item.Text)
+
+		if err != nil {
+			t.Errorf("%d set text err %s", i, err)
+			continue
+		}
+
+		name, err := doc.DetectGrammar()
+
+		if err != nil || name != item.Name {
+			t.Errorf("%d name %q err %v expect %q", i, name, err, item.Name)
+			continue
+		}
+
+		if root, _ := doc.RootNode(); root == nil || root.Type() != item.Root {
+			t.Errorf("%d root %v expect %s", i, root, item.Root)
+		}
+	}
+
+	doc.RegisterGrammar("css", cssParser, func(doc *textdocument.TextDocument) bool {
+		return true
+	})
+
+	if name, _ := doc.DetectGrammar(); name != "css" || doc.Tree.RootNode().Type() != "stylesheet" {
+		t.Errorf("replaced grammar %q", name)
+	}
+}
+
+func TestParseTimeout(t *testing.T) {
+	text := strings.Repeat("var x = [1, 2, 3, {a: 'b'}];\n", 10000)
+	doc := textdocument.NewTextDocument("var x = 1")
+	doc.SetParser(createParser())
+	doc.SetParseTimeout(time.Nanosecond)
+
+	tree := doc.Tree
+	err := doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 0, 0, 9),
+		Text:  text,
+	})
+
+	if !errors.Is(err, textdocument.ErrParseTimeout) {
+		t.Fatalf("err %v expect ErrParseTimeout", err)
+	}
+
+	if doc.Tree != tree || !doc.TreeDirty() {
+		t.Errorf("old tree should be kept and document should be dirty")
+	}
+
+	doc.SetParseTimeout(0)
+
+	if err := doc.UpdateTree(nil); err != nil || doc.TreeDirty() {
+		t.Errorf("UpdateTree err %v", err)
+	}
+
+	// halted parse should not be resumed by next parse
+	text = strings.Repeat("function f() { return [1, 2, 3, {a: 'b'}]; }\n", 10000)
+	doc = textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+	doc.SetParseTimeout(50 * time.Microsecond)
+
+	err = doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 9, 0, 10),
+		Text:  "g",
+	})
+
+	if !errors.Is(err, textdocument.ErrParseTimeout) {
+		t.Fatalf("err %v expect ErrParseTimeout", err)
+	}
+
+	doc.SetParseTimeout(0)
+
+	err = doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(5, 0, 5, 44),
+		Text:  "const zz = 1;",
+	})
+
+	if err != nil {
+		t.Fatalf("change err %s", err)
+	}
+
+	fresh := textdocument.NewTextDocument(doc.Text)
+	fresh.SetParser(createParser())
+
+	if doc.Tree.RootNode().String() != fresh.Tree.RootNode().String() {
+		t.Errorf("tree %s expect %s", doc.Tree.RootNode().NamedChild(5), fresh.Tree.RootNode().NamedChild(5))
+	}
+}
+
+func TestSetTextAfterFailedParse(t *testing.T) {
+	doc := textdocument.NewTextDocument(strings.Repeat("var x = (1 + 2) * 3;\n", 10000))
+	doc.SetParser(createParser())
+	doc.SetParseTimeout(50 * time.Microsecond)
+
+	err := doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 4, 0, 5),
+		Text:  "y",
+	})
+
+	if !errors.Is(err, textdocument.ErrParseTimeout) {
+		t.Fatalf("err %v expect ErrParseTimeout", err)
+	}
+
+	doc.SetParseTimeout(0)
+
+	// edited Tree of old text should not be reused for new text
+	err = doc.SetText("var q = [1,2,3];\n" + strings.Repeat("x;\n", 100))
+
+	if err != nil {
+		t.Fatalf("SetText err %s", err)
+	}
+
+	fresh := textdocument.NewTextDocument(doc.Text)
+	fresh.SetParser(createParser())
+
+	if root := doc.Tree.RootNode(); root.EndByte() != doc.TextLength || root.String() != fresh.Tree.RootNode().String() {
+		t.Errorf("tree %d %s", root.EndByte(), root.NamedChild(0))
+	}
+}
+
+func TestChangeMany(t *testing.T) {
+	text := "var x = 1\nvar y = 2"
+	events := []*textdocument.ChangeEvent{
+		{
+			Range: textdocument.NewRange(0, 4, 0, 5),
+			Text:  "abc",
+		},
+		{
+			Range: textdocument.NewRange(0, 7, 1, 3),
+			Text:  " = 5;\nlet",
+		},
+		{
+			Range: textdocument.NewRange(1, 9, 1, 9),
+			Text:  "\nx + abc",
+		},
+	}
+
+	many := textdocument.NewTextDocument(text)
+	many.SetParser(createParser())
+
+	err := many.ChangeMany(events, nil)
+
+	if err != nil {
+		t.Fatalf("ChangeMany err %s", err)
+	}
+
+	one := textdocument.NewTextDocument(text)
+	one.SetParser(createParser())
+
+	for i, e := range events {
+		err := one.Change(e)
+
+		if err != nil {
+			t.Fatalf("%d Change err %s", i, err)
+		}
+	}
+
+	check := "var abc = 5;\nlet y = 2\nx + abc"
+
+	if many.Text != check {
+		t.Errorf("text '%s' expect '%s'", many.Text, check)
+	}
+
+	if many.Text != one.Text {
+		t.Errorf("text '%s' expect '%s'", many.Text, one.Text)
+	}
+
+	if many.Tree.RootNode().String() != one.Tree.RootNode().String() {
+		t.Errorf("tree %s expect %s", many.Tree.RootNode(), one.Tree.RootNode())
+	}
+}
+
+func TestChangeVersioned(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+	doc.SetParser(createParser())
+	doc.Version = 1
+
+	list := []struct {
+		Version int32
+		Char    uint32
+		Insert  string
+		Error   error
+		Text    string
+	}{
+		{2, 4, "a", nil, "var a = 1"},
+		{2, 4, "b", textdocument.ErrStaleVersion, "var a = 1"},
+		{1, 4, "b", textdocument.ErrStaleVersion, "var a = 1"},
+		{5, 4, "b", nil, "var b = 1"},
+		{6, 100, "c", nil, "var b = 1"},
+		{7, 4, "c", nil, "var c = 1"},
+	}
+
+	for i, item := range list {
+		before := doc.Version
+
+		err := doc.ChangeVersioned(item.Version, &textdocument.ChangeEvent{
+			Range: textdocument.NewRange(0, item.Char, 0, item.Char+1),
+			Text:  item.Insert,
+		})
+
+		if item.Char == 100 {
+			if err == nil || doc.Version != before {
+				t.Errorf("%d invalid change should return error and keep version, err %v version %d", i, err, doc.Version)
+			}
+			continue
+		}
+
+		if !errors.Is(err, item.Error) {
+			t.Errorf("%d err %v expect %v", i, err, item.Error)
+		}
+
+		if item.Error == nil && doc.Version != item.Version {
+			t.Errorf("%d version %d expect %d", i, doc.Version, item.Version)
+		}
+
+		if doc.Text != item.Text {
+			t.Errorf("%d text %q expect %q", i, doc.Text, item.Text)
+		}
+	}
+}
+
+func TestApplyDidChange(t *testing.T) {
+	text := "var x = 1\nvar y = 2"
+	check := "let z = 3\nz + abc"
+
+	changes := []textdocument.ChangeEvent{
+		{Range: textdocument.NewRange(0, 4, 0, 5), Text: "abc"},
+		{Text: "let z = 3"},
+		{Range: textdocument.NewRange(0, 9, 0, 9), Text: "\nz + abc"},
+	}
+
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	err := doc.ApplyDidChange(changes, nil)
+
+	if err != nil {
+		t.Fatalf("ApplyDidChange err %s", err)
+	}
+
+	expect := textdocument.NewTextDocument(check)
+	expect.SetParser(createParser())
+
+	if doc.Text != check || doc.Tree.RootNode().String() != expect.Tree.RootNode().String() {
+		t.Errorf("text %q tree %s expect %q %s", doc.Text, doc.Tree.RootNode(), check, expect.Tree.RootNode())
+	}
+
+	doc = textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	err = doc.ApplyDidChangeParams(&proto.DidChangeTextDocumentParams{
+		ContentChanges: []any{
+			changes[0],
+			proto.TextDocumentContentChangeEventWhole{Text: "let z = 3"},
+			&changes[2],
+		},
+	}, nil)
+
+	if err != nil {
+		t.Fatalf("ApplyDidChangeParams err %s", err)
+	}
+
+	if doc.Text != check || doc.Tree.RootNode().String() != expect.Tree.RootNode().String() {
+		t.Errorf("params text %q tree %s expect %q %s", doc.Text, doc.Tree.RootNode(), check, expect.Tree.RootNode())
+	}
+
+	err = doc.ApplyDidChangeParams(&proto.DidChangeTextDocumentParams{
+		ContentChanges: []any{"text"},
+	}, nil)
+
+	if err == nil {
+		t.Errorf("unknown change type should return error")
+	}
+}
+
+func TestPositionToByteIndex(t *testing.T) {
+	doc := getDoc()
+
+	list := [][]uint32{
+		{0, 0, 0, 0},
+		{0, 2, 4, 0},
+		{0, 4, 6, 1},
+		{1, 0, 6, 0},
+		{1, 2, 8, 0},
+		{1, 5, 11, 1},
+		{2, 0, 11, 0},
+		{2, 3, 16, 0},
+		{2, 4, 17, 1},
+		{3, 0, 0, 1},
+	}
+
+	for i, item := range list {
+		index, err := doc.PositionToByteIndex(&proto.Position{
+			Line:      item[0],
+			Character: item[1],
+		})
+
+		if item[3] == 1 {
+			if err == nil {
+				t.Errorf("%d should return error", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("PositionToByteIndex err: %s", err.Error())
+		}
+
+		if index != item[2] {
+			t.Errorf("%d index %d expect %d", i, index, item[2])
+		}
+	}
+}
+
+func TestPositionsToByteIndexes(t *testing.T) {
+	doc := textdocument.NewTextDocument("a😀b\r\n⌘c\n😀x\n")
+
+	for _, encoding := range []textdocument.PositionEncoding{textdocument.UTF8, textdocument.UTF16, textdocument.UTF32, textdocument.Grapheme} {
+		doc.PositionEncoding = encoding
+
+		var positions []*textdocument.Position
+
+		for line := textdocument.UInt(0); line < doc.LineCount(); line++ {
+			length, _ := doc.LineLengthInChars(line)
+
+			for char := textdocument.UInt(0); char <= length; char++ {
+				pos := &textdocument.Position{Line: line, Character: char}
+
+				if _, err := doc.PositionToByteIndex(pos); err == nil {
+					positions = append(positions, pos)
+				}
+			}
+		}
+
+		slices.Reverse(positions)
+		positions = append(positions, positions[3], positions[0])
+
+		list, err := doc.PositionsToByteIndexes(positions)
+
+		if err != nil {
+			t.Errorf("%d err %s", encoding, err)
+			continue
+		}
+
+		for i, pos := range positions {
+			index, _ := doc.PositionToByteIndex(pos)
+
+			if list[i] != index {
+				t.Errorf("%d.%d pos %v index %d expect %d", encoding, i, pos, list[i], index)
+			}
+		}
+	}
+
+	doc.PositionEncoding = textdocument.UTF16
+
+	_, err := doc.PositionsToByteIndexes([]*textdocument.Position{{Line: 0, Character: 2}, {Line: 0, Character: 0}})
+
+	if err == nil {
+		t.Errorf("position inside of surrogate pair should return error")
+	}
+
+	doc.Lenient = true
+
+	list, err := doc.PositionsToByteIndexes([]*textdocument.Position{{Line: 9, Character: 0}, {Line: 1, Character: 9}})
+
+	if err != nil || list[0] != doc.TextLength || list[1] != 12 {
+		t.Errorf("lenient indexes %v err %v", list, err)
+	}
+}
+
+func TestUTF16Offset(t *testing.T) {
+	doc := textdocument.NewTextDocument("a😀b\r\n⌘c\n😀")
+
+	list := []struct {
+		Line   uint32
+		Char   uint32
+		Offset uint32
+	}{
+		{0, 0, 0},
+		{0, 1, 1},
+		{0, 3, 3},
+		{0, 4, 4},
+		{1, 0, 6},
+		{1, 2, 8},
+		{2, 0, 9},
+		{2, 2, 11},
+	}
+
+	for i, item := range list {
+		offset, err := doc.PositionToUTF16Offset(&textdocument.Position{Line: item.Line, Character: item.Char})
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if offset != item.Offset {
+			t.Errorf("%d offset %d expect %d", i, offset, item.Offset)
+		}
+
+		pos, err := doc.UTF16OffsetToPosition(item.Offset)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if pos.Line != item.Line || pos.Character != item.Char {
+			t.Errorf("%d pos %v expect {%d, %d}", i, pos, item.Line, item.Char)
+		}
+	}
+
+	for _, offset := range []uint32{2, 10, 12} {
+		_, err := doc.UTF16OffsetToPosition(offset)
+
+		if err == nil {
+			t.Errorf("offset %d should return error", offset)
+		}
+	}
+}
+
+func TestGraphemeEncoding(t *testing.T) {
+	doc := textdocument.NewTextDocument("a = 'e\u0301👍🏽';\nb")
+	doc.PositionEncoding = textdocument.Grapheme
+	doc.SetParser(createParser())
+
+	if length, _ := doc.LineLengthInChars(0); length != 9 {
+		t.Errorf("line length %d expect 9", length)
+	}
+
+	list := []struct {
+		Pos   *textdocument.Position
+		Index textdocument.UInt
+	}{
+		{&textdocument.Position{Line: 0, Character: 5}, 5},
+		{&textdocument.Position{Line: 0, Character: 6}, 8},
+		{&textdocument.Position{Line: 0, Character: 7}, 16},
+		{&textdocument.Position{Line: 0, Character: 9}, 18},
+		{&textdocument.Position{Line: 1, Character: 1}, 20},
+	}
+
+	for i, item := range list {
+		index, err := doc.PositionToByteIndex(item.Pos)
+
+		if err != nil || index != item.Index {
+			t.Errorf("%d index %d err %v expect %d", i, index, err, item.Index)
+			continue
+		}
+
+		pos, err := doc.ByteIndexToPosition(index)
+
+		if err != nil || *pos != *item.Pos {
+			t.Errorf("%d pos %v err %v expect %v", i, pos, err, item.Pos)
+		}
+	}
+
+	if clamp := doc.ClampPosition(&textdocument.Position{Line: 0, Character: 20}); clamp.Character != 9 {
+		t.Errorf("clamp %v expect 9", clamp)
+	}
+
+	err := doc.Change(&textdocument.ChangeEvent{Range: textdocument.NewRange(0, 5, 0, 7), Text: "x"})
+
+	if err != nil || doc.Text != "a = 'x';\nb" || doc.Tree.RootNode().HasError() {
+		t.Errorf("text %q err %v", doc.Text, err)
+	}
+}
+
+func TestClampPosition(t *testing.T) {
+	doc := textdocument.NewTextDocument("a😀b\r\n⌘c")
+
+	list := []struct {
+		Encoding textdocument.PositionEncoding
+		Pos      []uint32
+		Clamp    []uint32
+	}{
+		{textdocument.UTF16, []uint32{0, 0}, []uint32{0, 0}},
+		{textdocument.UTF16, []uint32{0, 2}, []uint32{0, 1}},
+		{textdocument.UTF16, []uint32{0, 3}, []uint32{0, 3}},
+		{textdocument.UTF16, []uint32{0, 5}, []uint32{0, 4}},
+		{textdocument.UTF16, []uint32{1, 9}, []uint32{1, 2}},
+		{textdocument.UTF16, []uint32{5, 0}, []uint32{1, 2}},
+		{textdocument.UTF32, []uint32{0, 5}, []uint32{0, 3}},
+		{textdocument.UTF8, []uint32{1, 2}, []uint32{1, 0}},
+		{textdocument.UTF8, []uint32{1, 9}, []uint32{1, 4}},
+	}
+
+	for i, item := range list {
+		doc.PositionEncoding = item.Encoding
+
+		pos := doc.ClampPosition(&textdocument.Position{Line: item.Pos[0], Character: item.Pos[1]})
+
+		if pos.Line != item.Clamp[0] || pos.Character != item.Clamp[1] {
+			t.Errorf("%d pos %v expect %v", i, pos, item.Clamp)
+		}
+	}
+
+	doc.PositionEncoding = textdocument.UTF16
+	doc.Lenient = true
+
+	index, err := doc.PositionToByteIndex(&textdocument.Position{Line: 0, Character: 10})
+
+	if err != nil || index != 6 {
+		t.Errorf("lenient index %d err %v expect 6", index, err)
+	}
+
+	point, err := doc.PositionToPoint(&textdocument.Position{Line: 3, Character: 0})
+
+	if err != nil || point.Row != 1 || point.Column != 4 {
+		t.Errorf("lenient point %v err %v expect {1, 4}", point, err)
+	}
+}
+
+func TestLenientChange(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2")
+	doc.SetParser(createParser())
+	doc.Lenient = true
+
+	err := doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(1, 20, 5, 0),
+		Text:  ";",
+	})
+
+	if err != nil {
+		t.Fatalf("Change err %s", err)
+	}
+
+	if doc.Text != "var x = 1\nvar y = 2;" {
+		t.Errorf("text %q", doc.Text)
+	}
+
+	check := createParser().Parse(nil, []byte(doc.Text)).RootNode().String()
+
+	if doc.Tree.RootNode().String() != check {
+		t.Errorf("tree %s expect %s", doc.Tree.RootNode(), check)
+	}
+}
+
+func TestByteIndexToPosition(t *testing.T) {
+	doc := getDoc()
+
+	list := [][]uint32{
+		{0, 0, 0},
+		{3, 0, 1},
+		{4, 0, 2},
+		{7, 1, 1},
+		{15, 2, 2},
+		{16, 2, 3},
+		{17, 3, 0},
+	}
+
+	for i, item := range list {
+		if i == 6 {
+			doc.SetText(doc.Text + "\n")
+		}
+
+		pos, err := doc.ByteIndexToPosition(item[0])
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+		}
+
+		if pos.Line != item[1] || pos.Character != item[2] {
+			t.Errorf("%d pos (%d, %d) expected (%d, %d)", i, pos.Line, pos.Character, item[1], item[2])
+		}
+	}
+}
+
+func TestByteIndexToPoint(t *testing.T) {
+	// rows are splitted only by "\n"
+	doc := textdocument.NewTextDocument("a\r\nb\rc\n")
+
+	list := [][]uint32{
+		{0, 0, 0},
+		{2, 0, 2},
+		{3, 1, 0},
+		{5, 1, 2},
+		{7, 2, 0},
+	}
+
+	for i, item := range list {
+		point, err := doc.ByteIndexToPoint(item[0])
+
+		if err != nil || point.Row != item[1] || point.Column != item[2] {
+			t.Errorf("%d point %v err %v expect %v", i, point, err, item[1:])
+		}
+	}
+
+	if _, err := doc.ByteIndexToPoint(8); err == nil {
+		t.Errorf("index after text should return error")
+	}
+}
+
+func TestByteIndexToPositionAtEnd(t *testing.T) {
+	list := []struct {
+		Text string
+		Line uint32
+		Char uint32
+	}{
+		{"", 0, 0},
+		{"ab", 0, 2},
+		{"ab\ncd", 1, 2},
+		{"ab\ncd\n", 2, 0},
+		{"ab\r\n", 1, 0},
+		{"ab\r", 1, 0},
+		{"a⌘", 0, 2},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+
+		pos, err := doc.ByteIndexToPosition(doc.TextLength)
+
+		if err != nil || pos.Line != item.Line || pos.Character != item.Char {
+			t.Errorf("%d pos %v err %v expect (%d, %d)", i, pos, err, item.Line, item.Char)
+			continue
+		}
+
+		if *pos != *doc.EndPosition() {
+			t.Errorf("%d pos %v expect end position %v", i, pos, doc.EndPosition())
+		}
+
+		if _, err := doc.ByteIndexToPosition(doc.TextLength + 1); err == nil {
+			t.Errorf("%d index after end should return error", i)
+		}
+	}
+}
+
+func TestByteRangeToRange(t *testing.T) {
+	doc := getDoc()
+
+	list := [][]uint32{
+		{0, 0, 0, 0, 0, 0, 0},
+		{0, 4, 0, 0, 0, 2, 0},
+		{3, 8, 0, 1, 1, 2, 0},
+		{6, 16, 1, 0, 2, 3, 0},
+		{8, 4, 0, 0, 0, 0, 1},
+		{6, 17, 0, 0, 0, 0, 1},
+	}
+
+	for i, item := range list {
+		r, err := doc.ByteRangeToRange(item[0], item[1])
+
+		if item[6] == 1 {
+			if err == nil {
+				t.Errorf("%d should return error", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if r.Start.Line != item[2] || r.Start.Character != item[3] || r.End.Line != item[4] || r.End.Character != item[5] {
+			t.Errorf("%d range %v expect %v", i, r, item[2:6])
+		}
+	}
+}
+
+func TestPointToPosition(t *testing.T) {
+	doc := getDoc()
+
+	list := [][]uint32{
+		{0, 0, 0, 0},
+		{0, 3, 0, 1},
+		{1, 0, 1, 0},
+		{1, 2, 1, 2},
+		{2, 0, 2, 0},
+		{2, 4, 2, 2},
+	}
+
+	for i, item := range list {
+		pos, err := doc.PointToPosition(textdocument.Point{
+			Row:    item[0],
+			Column: item[1],
+		})
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+		}
+
+		if pos.Line != item[2] {
+			t.Errorf("%d pos.Line %d expect %d", i, pos.Line, item[2])
+		}
+
+		if pos.Character != item[3] {
+			t.Errorf("%d pos.Character %d expect %d", i, pos.Character, item[3])
+		}
+	}
+}
+
+func TestByteIndexLine(t *testing.T) {
+	list := []struct {
+		Text  string
+		Index uint32
+		Line  uint32
+	}{
+		{"", 0, 0},
+		{"abc", 3, 0},
+		{"ab\ncd", 2, 0},
+		{"ab\ncd", 3, 1},
+		{"ab\ncd", 5, 1},
+		{"ab\r\ncd\n", 3, 0},
+		{"ab\r\ncd\n", 4, 1},
+		{"ab\r\ncd\n", 6, 1},
+		{"ab\r\ncd\n", 7, 2},
+		{"\n\n\n", 2, 2},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+		line, err := doc.ByteIndexLine(item.Index)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if line != item.Line {
+			t.Errorf("%d line %d expect %d", i, line, item.Line)
+		}
+	}
+
+	doc := textdocument.NewTextDocument("abc")
+
+	if _, err := doc.ByteIndexLine(4); err == nil {
+		t.Errorf("out of range should return error")
+	}
+}
+
+func TestLineByteIndexToPosition(t *testing.T) {
+	doc := getDoc()
+
+	list := [][]uint32{
+		{0, 0, 0, 0, 0},
+		{0, 3, 0, 1, 0},
+		{0, 4, 0, 2, 0},
+		{0, 5, 0, 3, 0},
+		{1, 0, 1, 0, 0},
+		{1, 2, 1, 2, 0},
+		{1, 5, 0, 0, 1},
+		{2, 3, 2, 1, 0},
+		{2, 4, 2, 2, 0},
+		{2, 5, 2, 3, 0},
+		{0, 6, 0, 0, 1},
+		{2, 6, 0, 0, 1},
+	}
+
+	for i, item := range list {
+		pos, err := doc.LineByteIndexToPosition(item[0], item[1])
+
+		if item[4] == 1 {
+			if err == nil {
+				t.Errorf("%d should be error but it returns %v for {%d, %d}", i, pos, item[0], item[1])
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+			continue
+		}
+
+		if pos.Line != item[2] || pos.Character != item[3] {
+			t.Errorf("%d wrong pos %v expect {%d, %d}", i, pos, item[2], item[3])
+		}
+	}
+}
+
+func TestLineByteIndexToPositionEncodingChange(t *testing.T) {
+	doc := textdocument.NewTextDocument("a😀😀b")
+	doc.PositionEncoding = textdocument.UTF32
+
+	if pos, err := doc.LineByteIndexToPosition(0, 5); err != nil || pos.Character != 2 {
+		t.Errorf("utf32 pos %v err %v expect 2", pos, err)
+	}
+
+	// column of previous lookup was counted in UTF-32
+	doc.PositionEncoding = textdocument.UTF16
+
+	if pos, err := doc.LineByteIndexToPosition(0, 9); err != nil || pos.Character != 5 {
+		t.Errorf("utf16 pos %v err %v expect 5", pos, err)
+	}
+}
+
+func TestGetTextByRange(t *testing.T) {
+	doc := textdocument.NewTextDocument("⌘sd\r\n\nqwer\n")
+
+	list := []struct {
+		Range *textdocument.Range
+		Text  string
+		Error bool
+	}{
+		{textdocument.NewRange(0, 0, 0, 3), "⌘sd", false},
+		{textdocument.NewRange(0, 1, 2, 2), "sd\r\n\nqw", false},
+		{textdocument.NewRange(1, 0, 1, 0), "", false},
+		{textdocument.NewRange(2, 4, 3, 0), "\n", false},
+		{textdocument.NewRange(3, 0, 3, 0), "", false},
+		{textdocument.NewRange(0, 2, 0, 1), "s", false},
+		{textdocument.NewRange(2, 2, 0, 1), "sd\r\n\nqw", false},
+		{textdocument.NewRange(0, 0, 4, 0), "", true},
+	}
+
+	for i, item := range list {
+		text, err := doc.GetTextByRange(item.Range)
+
+		if item.Error {
+			if err == nil {
+				t.Errorf("%d should return error", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if text != item.Text {
+			t.Errorf("%d text %q expect %q", i, text, item.Text)
+		}
+	}
+
+	lines := []string{"⌘sd", "", "qwer", ""}
+
+	for i, line := range lines {
+		text, err := doc.GetLineText(uint32(i))
+
+		if err != nil {
+			t.Errorf("line %d err %s", i, err)
+			continue
+		}
+
+		if text != line {
+			t.Errorf("line %d text %q expect %q", i, text, line)
+		}
+	}
+
+	_, err := doc.GetLineText(4)
+
+	if err == nil {
+		t.Errorf("line 4 should return error")
+	}
+}
+
+func TestUTF8Positions(t *testing.T) {
+	doc := textdocument.NewTextDocument("a😀b\r\n⌘c\n")
+	doc.PositionEncoding = textdocument.UTF8
+
+	list := []struct {
+		Line      uint32
+		Character uint32
+		Index     uint32
+		Err       bool
+	}{
+		{0, 0, 0, false},
+		{0, 1, 1, false},
+		{0, 2, 0, true},
+		{0, 5, 5, false},
+		{0, 6, 6, false},
+		{0, 7, 0, true},
+		{1, 3, 11, false},
+		{1, 4, 12, false},
+		{2, 0, 13, false},
+	}
+
+	for i, item := range list {
+		index, err := doc.PositionToByteIndex(&textdocument.Position{Line: item.Line, Character: item.Character})
+
+		if (err != nil) != item.Err || index != item.Index {
+			t.Errorf("%d index %d err %v expect %d", i, index, err, item.Index)
+		}
+
+		if item.Err {
+			continue
+		}
+
+		pos, err := doc.ByteIndexToPosition(item.Index)
+
+		if err != nil || pos.Line != item.Line || pos.Character != item.Character {
+			t.Errorf("%d pos %v err %v", i, pos, err)
+		}
+	}
+
+	// inside of line terminator is clamped to line end
+	pos, err := doc.LineByteIndexToPosition(0, 7)
+
+	if err != nil || pos.Line != 0 || pos.Character != 6 {
+		t.Errorf("pos %v err %v expect 0:6", pos, err)
+	}
+
+	pos, err = doc.LineByteIndexToPosition(0, 8)
+
+	if err == nil {
+		t.Errorf("pos %v should be out of range", pos)
+	}
+}
+
+func TestNodeToRangeCRLF(t *testing.T) {
+	doc := textdocument.NewTextDocument("// hi\r\nlet a = 1;\r\n")
+	doc.SetParser(createParser())
+
+	for _, encoding := range []textdocument.PositionEncoding{textdocument.UTF8, textdocument.UTF16} {
+		doc.PositionEncoding = encoding
+
+		// comment node includes "\r", because tree-sitter rows are splitted only by "\n"
+		comment := doc.Tree.RootNode().NamedChild(0)
+		r, err := doc.NodeToRange(comment)
+
+		if err != nil || *r != *textdocument.NewRange(0, 0, 0, 5) {
+			t.Errorf("%d %s range %v err %v", encoding, comment.Type(), r, err)
+		}
+	}
+}
+
+func TestEndPosition(t *testing.T) {
+	list := []struct {
+		Text     string
+		Encoding textdocument.PositionEncoding
+		End      []uint32
+		LineEnds []uint32
+	}{
+		{"", textdocument.UTF16, []uint32{0, 0}, []uint32{0}},
+		{"a😀b\r\n⌘c", textdocument.UTF16, []uint32{1, 2}, []uint32{4, 2}},
+		{"a😀b\r\n⌘c", textdocument.UTF8, []uint32{1, 4}, []uint32{6, 4}},
+		{"a😀b\r\n⌘c\r\n", textdocument.UTF32, []uint32{2, 0}, []uint32{3, 2, 0}},
+		{"a\rb\n\n", textdocument.UTF16, []uint32{3, 0}, []uint32{1, 1, 0, 0}},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+		doc.PositionEncoding = item.Encoding
+		end := doc.EndPosition()
+
+		if end.Line != item.End[0] || end.Character != item.End[1] {
+			t.Errorf("%d end %v expect %v", i, end, item.End)
+		}
+
+		if r := doc.FullRange(); r.Start != (textdocument.Position{}) || r.End != *end {
+			t.Errorf("%d full range %v expect end %v", i, r, end)
+		}
+
+		for line, char := range item.LineEnds {
+			pos, err := doc.EndOfLinePosition(uint32(line))
+
+			if err != nil || pos.Line != uint32(line) || pos.Character != char {
+				t.Errorf("%d:%d pos %v err %v expect %d", i, line, pos, err, char)
+			}
+		}
+
+		_, err := doc.EndOfLinePosition(uint32(len(item.LineEnds)))
+
+		if err == nil {
+			t.Errorf("%d line after last should return error", i)
+		}
+	}
+}
+
+func TestEachLine(t *testing.T) {
+	list := []struct {
+		Text  string
+		Stop  uint32
+		Lines []string
+	}{
+		{"", 9, []string{""}},
+		{"a\r\nb\rc⌘\n", 9, []string{"a", "b", "c⌘", ""}},
+		{"a\nb\nc", 1, []string{"a", "b"}},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+		lines := make([]string, 0)
+
+		doc.EachLine(func(line uint32, text string) bool {
+			if line != uint32(len(lines)) {
+				t.Errorf("%d wrong line %d", i, line)
+			}
+
+			lines = append(lines, text)
+
+			return line < item.Stop
+		})
+
+		if !slices.Equal(lines, item.Lines) {
+			t.Errorf("%d lines %q expect %q", i, lines, item.Lines)
+		}
+	}
+}
+
+func TestGetLineIndentation(t *testing.T) {
+	doc := textdocument.NewTextDocument("a\n  \tb\r\n\t \t\n    ⌘ c\n\u00a0d")
+
+	list := []struct {
+		Spaces uint32
+		Tabs   uint32
+		Text   string
+	}{
+		{0, 0, ""},
+		{2, 1, "  \t"},
+		{1, 2, "\t \t"},
+		{4, 0, "    "},
+		{0, 0, ""},
+	}
+
+	for i, item := range list {
+		spaces, tabs, text, err := doc.GetLineIndentation(uint32(i))
+
+		if err != nil || spaces != item.Spaces || tabs != item.Tabs || text != item.Text {
+			t.Errorf("%d indentation %d %d %q err %v", i, spaces, tabs, text, err)
+		}
+	}
+
+	_, _, _, err := doc.GetLineIndentation(5)
+
+	if err == nil {
+		t.Errorf("line 5 should return error")
+	}
+}
+
+func TestLineRange(t *testing.T) {
+	doc := textdocument.NewTextDocument("a😀b\r\n\n⌘c\n")
+
+	list := []struct {
+		Encoding textdocument.PositionEncoding
+		Lengths  []uint32
+	}{
+		{textdocument.UTF16, []uint32{4, 0, 2, 0}},
+		{textdocument.UTF32, []uint32{3, 0, 2, 0}},
+		{textdocument.UTF8, []uint32{6, 0, 4, 0}},
+	}
+
+	for i, item := range list {
+		doc.PositionEncoding = item.Encoding
+
+		for line, length := range item.Lengths {
+			value, err := doc.LineLengthInChars(uint32(line))
+
+			if err != nil {
+				t.Errorf("%d:%d err %s", i, line, err)
+				continue
+			}
+
+			if value != length {
+				t.Errorf("%d:%d length %d expect %d", i, line, value, length)
+			}
+
+			r, err := doc.LineRange(uint32(line))
+
+			if err != nil {
+				t.Errorf("%d:%d err %s", i, line, err)
+				continue
+			}
+
+			if r.Start.Line != uint32(line) || r.Start.Character != 0 || r.End.Line != uint32(line) || r.End.Character != length {
+				t.Errorf("%d:%d range %v", i, line, r)
+			}
+		}
+	}
+
+	_, err := doc.LineRange(4)
+
+	if err == nil {
+		t.Errorf("line 4 should return error")
+	}
+}
+
+func TestPositionToVisualColumn(t *testing.T) {
+	doc := textdocument.NewTextDocument("\tx\ta\n  \t⌘\tb")
+
+	list := []struct {
+		TabWidth uint32
+		Line     uint32
+		Char     uint32
+		Column   uint32
+	}{
+		{0, 0, 0, 0},
+		{0, 0, 3, 3},
+		{0, 1, 5, 5},
+		{4, 0, 1, 4},
+		{4, 0, 3, 8},
+		{4, 0, 4, 9},
+		{4, 1, 3, 4},
+		{4, 1, 5, 8},
+		{2, 1, 3, 4},
+		{2, 1, 5, 6},
+	}
+
+	for i, item := range list {
+		doc.TabWidth = item.TabWidth
+
+		column, err := doc.PositionToVisualColumn(&textdocument.Position{Line: item.Line, Character: item.Char})
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if column != item.Column {
+			t.Errorf("%d column %d expect %d", i, column, item.Column)
+		}
+	}
+}
+
+func TestGetNonSpaceTextAroundPosition(t *testing.T) {
+	doc := textdocument.NewTextDocument("asd\nwer zxc")
+
+	type Test struct {
+		Line uint32
+		Char uint32
+		Text string
+	}
+
+	list := []Test{
+		{
+			Line: 0,
+			Char: 0,
+			Text: "asd",
+		},
+		{
+			Line: 0,
+			Char: 1,
+			Text: "asd",
+		},
+		{
+			Line: 1,
+			Char: 0,
+			Text: "wer",
+		},
+		{
+			Line: 1,
+			Char: 1,
+			Text: "wer",
+		},
+		{
+			Line: 1,
+			Char: 3,
+			Text: "wer",
+		},
+		{
+			Line: 1,
+			Char: 4,
+			Text: "zxc",
+		},
+		{
+			Line: 1,
+			Char: 5,
+			Text: "zxc",
+		},
+		{
+			Line: 1,
+			Char: 7,
+			Text: "zxc",
+		},
+	}
+
+	for i, item := range list {
+		text, err := doc.GetNonSpaceTextAroundPosition(&textdocument.Position{
+			Line:      item.Line,
+			Character: item.Char,
+		})
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+			continue
+		}
+
+		if text != item.Text {
+			t.Errorf("%d wrong text '%s' expected '%s'", i, text, item.Text)
+		}
+	}
+}
+
+func TestGetNonSpaceTextAroundPositionFunc(t *testing.T) {
+	doc := textdocument.NewTextDocument("a\tb c,d")
+
+	list := []struct {
+		Char       uint32
+		IsBoundary func(rune) bool
+		Text       string
+	}{
+		{0, nil, "a"},
+		{2, nil, "b"},
+		{5, nil, "c,d"},
+		{5, func(char rune) bool { return char == ' ' || char == ',' }, "c"},
+		{7, func(char rune) bool { return char == ' ' || char == ',' }, "d"},
+	}
+
+	for i, item := range list {
+		text, err := doc.GetNonSpaceTextAroundPositionFunc(&textdocument.Position{Line: 0, Character: item.Char}, item.IsBoundary)
+
+		if err != nil || text != item.Text {
+			t.Errorf("%d text %q err %v expect %q", i, text, err, item.Text)
+		}
+	}
+
+	if text, _ := doc.GetNonSpaceTextAroundPosition(&textdocument.Position{Line: 0, Character: 0}); text != "a\tb" {
+		t.Errorf("text %q expect %q", text, "a\tb")
+	}
+}
+
+func TestWordRangeAtPosition(t *testing.T) {
+	doc := textdocument.NewTextDocument("foo.bar_1(x)\n⌘abc-def")
+
+	list := []struct {
+		Line  uint32
+		Char  uint32
+		Text  string
+		Range []uint32
+	}{
+		{0, 0, "foo", []uint32{0, 0, 0, 3}},
+		{0, 3, "foo", []uint32{0, 0, 0, 3}},
+		{0, 4, "bar_1", []uint32{0, 4, 0, 9}},
+		{0, 10, "x", []uint32{0, 10, 0, 11}},
+		{0, 12, "", []uint32{0, 12, 0, 12}},
+		{1, 1, "abc", []uint32{1, 1, 1, 4}},
+		{1, 0, "", []uint32{1, 0, 1, 0}},
+		{1, 8, "def", []uint32{1, 5, 1, 8}},
+	}
+
+	for i, item := range list {
+		r, text, err := doc.WordRangeAtPosition(&textdocument.Position{Line: item.Line, Character: item.Char}, nil)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if text != item.Text {
+			t.Errorf("%d text '%s' expect '%s'", i, text, item.Text)
+		}
+
+		if r.Start.Line != item.Range[0] || r.Start.Character != item.Range[1] || r.End.Line != item.Range[2] || r.End.Character != item.Range[3] {
+			t.Errorf("%d range %v expect %v", i, r, item.Range)
+		}
+	}
+
+	_, text, _ := doc.WordRangeAtPosition(&textdocument.Position{Line: 1, Character: 2}, func(char rune) bool {
+		return char != '⌘' && char != ' '
+	})
+
+	if text != "abc-def" {
+		t.Errorf("custom text '%s' expect 'abc-def'", text)
+	}
+}
+
+func TestNodeStartEndPosition(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = '😀⌘'")
+	doc.SetParser(createParser())
+
+	node, err := doc.GetAncestorByPosition(&textdocument.Position{Line: 1, Character: 9}, []string{"string"})
+
+	if err != nil || node == nil {
+		t.Fatalf("node %v err %v", node, err)
+	}
+
+	start, err := doc.NodeStartPosition(node)
+
+	if err != nil || start.Line != 1 || start.Character != 8 {
+		t.Errorf("start %v expect 1:8 (%v)", start, err)
+	}
+
+	end, err := doc.NodeEndPosition(node)
+
+	if err != nil || end.Line != 1 || end.Character != 13 {
+		t.Errorf("end %v expect 1:13 (%v)", end, err)
+	}
+}
+
+func TestNodeByteRange(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = '😀⌘'")
+	doc.SetParser(createParser())
+
+	node, err := doc.GetAncestorByPosition(&textdocument.Position{Line: 0, Character: 9}, []string{"string"})
+
+	if err != nil || node == nil {
+		t.Fatalf("node %v err %v", node, err)
+	}
+
+	start, end := doc.NodeByteRange(node)
+
+	if start != 8 || end != 17 {
+		t.Errorf("byte range %d-%d expect 8-17", start, end)
+	}
+
+	if doc.NodeByteLength(node) != 9 {
+		t.Errorf("byte length %d expect 9", doc.NodeByteLength(node))
+	}
+
+	if start, end, err := doc.NodeToByteRange(node); err != nil || start != 8 || end != 17 {
+		t.Errorf("to byte range %d-%d err %v expect 8-17", start, end, err)
+	}
+
+	if r, err := doc.NodeToRange(node); err != nil || r.Start.Character != 8 || r.End.Character != 13 {
+		t.Errorf("range %v err %v expect 8-13", r, err)
+	}
+
+	other := textdocument.NewTextDocument("x")
+
+	if _, _, err := other.NodeToByteRange(node); err == nil {
+		t.Errorf("node out of text should return error")
+	}
+}
+
+func TestHighlightTokenLength(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = '😀⌘'")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(string) @string"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	legend := textdocument.HighlightLegend{{Type: 1}}
+
+	list := []struct {
+		Encoding textdocument.PositionEncoding
+		Tokens   []uint32
+	}{
+		{textdocument.UTF16, []uint32{0, 8, 5, 1, 0}},
+		{textdocument.UTF8, []uint32{0, 8, 9, 1, 0}},
+		{textdocument.UTF32, []uint32{0, 8, 4, 1, 0}},
+	}
+
+	for i, item := range list {
+		doc.PositionEncoding = item.Encoding
+
+		tokens, err := doc.ConvertHighlightCaptures(legend)
+
+		if err != nil || !slices.Equal(tokens, item.Tokens) {
+			t.Errorf("%d tokens %v err %v expect %v", i, tokens, err, item.Tokens)
+		}
+	}
+}
+
+func TestNodeText(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = '😀⌘'\nif (a { b }")
+	doc.SetParser(createParser())
+
+	texts := make([]string, 0)
+	missing := 0
+
+	c := sitter.NewTreeCursor(doc.Tree.RootNode())
+	defer c.Close()
+
+	textdocument.VisitNode(c, func(node *sitter.Node) int8 {
+		if node.IsMissing() {
+			missing++
+
+			if doc.NodeText(node) != "" {
+				t.Errorf("missing node text %q expect empty", doc.NodeText(node))
+			}
+		}
+
+		if node.ChildCount() == 0 {
+			texts = append(texts, doc.NodeText(node))
+		}
+
+		if doc.NodeText(node) != node.Content([]byte(doc.Text)) {
+			t.Errorf("node %s text %q expect %q", node.Type(), doc.NodeText(node), node.Content([]byte(doc.Text)))
+		}
+
+		return 0
+	})
+
+	if missing == 0 {
+		t.Errorf("should have missing node")
+	}
+
+	if strings.Join(texts, "") != strings.ReplaceAll(strings.ReplaceAll(doc.Text, " ", ""), "\n", "") {
+		t.Errorf("leaves text %v", texts)
+	}
+}
+
+func TestGetNodesByRange(t *testing.T) {
+	text := "var x = 1\nvar y = 2\nvar z = 3"
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	list := []struct {
+		StartLine uint32
+		StartChar uint32
+		EndLine   uint32
+		EndChar   uint32
+		Values    []string
+	}{
+		{0, 4, 0, 9, []string{"x = 1"}},
+		{0, 1, 0, 5, []string{"var", "x"}},
+		{0, 8, 2, 1, []string{"1", "var y = 2", "var"}},
+		{1, 0, 1, 9, []string{"var y = 2"}},
+		{1, 0, 2, 0, []string{"var y = 2"}},
+		{2, 8, 2, 9, []string{"3"}},
+	}
+
+	for i, item := range list {
+		start := proto.Position{
+			Line:      item.StartLine,
+			Character: item.StartChar,
+		}
+		end := proto.Position{
+			Line:      item.EndLine,
+			Character: item.EndChar,
+		}
+		nodes, err := doc.GetNodesByRange(&start, &end)
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+			continue
+		}
+
+		values := make([]string, len(nodes))
+
+		for i, node := range nodes {
+			values[i] = node.Content([]byte(text))
+		}
+
+		if len(values) != len(item.Values) {
+			t.Errorf("%d values: %v expect %v", i, values, item.Values)
+			continue
+		}
+
+		for j, value := range item.Values {
+			if values[j] != value {
+				t.Errorf("%d:%d value: '%s' expect '%s'", i, j, values[j], value)
+			}
+		}
+	}
+}
+
+func TestGetNodesByByteRange(t *testing.T) {
+	text := "var x = 1\r\nvar ⌘ = 2\nvar z = 3"
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	list := []*textdocument.Range{
+		textdocument.NewRange(0, 4, 0, 9),
+		textdocument.NewRange(0, 8, 2, 1),
+		textdocument.NewRange(1, 4, 1, 5),
+		textdocument.NewRange(2, 8, 2, 8),
+	}
+
+	for i, r := range list {
+		expect, err := doc.GetNodesByRange(&r.Start, &r.End)
+
+		if err != nil {
+			t.Fatalf("%d err %s", i, err)
+		}
+
+		start, _ := doc.PositionToByteIndex(&r.Start)
+		end, _ := doc.PositionToByteIndex(&r.End)
+
+		for _, args := range [][]textdocument.UInt{{start, end}, {end, start}} {
+			nodes, err := doc.GetNodesByByteRange(args[0], args[1])
+
+			if err != nil {
+				t.Errorf("%d err %s", i, err)
+				continue
+			}
+
+			if fmt.Sprint(nodes) != fmt.Sprint(expect) {
+				t.Errorf("%d nodes %v expect %v", i, nodes, expect)
+			}
+		}
+	}
+
+	if _, err := doc.GetNodesByByteRange(0, doc.TextLength+1); err == nil {
+		t.Errorf("out of range index should return error")
+	}
+}
+
+func TestGetNodesByRangeReversed(t *testing.T) {
+	text := "var x = 1\nvar y = 2\nvar z = 3"
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	list := []*textdocument.Range{
+		textdocument.NewRange(0, 1, 0, 5),
+		textdocument.NewRange(0, 8, 2, 1),
+		textdocument.NewRange(1, 0, 1, 9),
+	}
+
+	for i, r := range list {
+		forward, err := doc.GetNodesByRange(&r.Start, &r.End)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		backward, err := doc.GetNodesByRange(&r.End, &r.Start)
+
+		if err != nil {
+			t.Errorf("%d reversed err %s", i, err)
+			continue
+		}
+
+		if fmt.Sprint(forward) != fmt.Sprint(backward) {
+			t.Errorf("%d reversed nodes %v expect %v", i, backward, forward)
+		}
+	}
+
+	r := textdocument.NormalizeRange(textdocument.NewRange(2, 1, 0, 8))
+
+	if *r != *textdocument.NewRange(0, 8, 2, 1) {
+		t.Errorf("normalized range %v", r)
+	}
+}
+
+func TestComparePositions(t *testing.T) {
+	list := []struct {
+		A      []uint32
+		B      []uint32
+		Result int
+	}{
+		{[]uint32{0, 0}, []uint32{0, 0}, 0},
+		{[]uint32{0, 5}, []uint32{1, 0}, -1},
+		{[]uint32{1, 0}, []uint32{0, 5}, 1},
+		{[]uint32{2, 3}, []uint32{2, 4}, -1},
+		{[]uint32{2, 9}, []uint32{2, 4}, 1},
+	}
+
+	for i, item := range list {
+		a := &textdocument.Position{Line: item.A[0], Character: item.A[1]}
+		b := &textdocument.Position{Line: item.B[0], Character: item.B[1]}
+
+		if res := textdocument.ComparePositions(a, b); res != item.Result {
+			t.Errorf("%d result %d expect %d", i, res, item.Result)
+		}
+	}
+
+	r := textdocument.NewRange(1, 4, 2, 2)
+
+	ranges := []struct {
+		Pos []uint32
+		In  bool
+	}{
+		{[]uint32{1, 3}, false},
+		{[]uint32{1, 4}, true},
+		{[]uint32{1, 100}, true},
+		{[]uint32{2, 0}, true},
+		{[]uint32{2, 2}, true},
+		{[]uint32{2, 3}, false},
+		{[]uint32{0, 5}, false},
+	}
+
+	for i, item := range ranges {
+		pos := &textdocument.Position{Line: item.Pos[0], Character: item.Pos[1]}
+
+		if in := textdocument.PositionInRange(pos, r); in != item.In {
+			t.Errorf("%d in %v expect %v", i, in, item.In)
+		}
+
+		if in := textdocument.PositionInRange(pos, &textdocument.Range{Start: r.End, End: r.Start}); in != item.In {
+			t.Errorf("%d reversed in %v expect %v", i, in, item.In)
+		}
+	}
+}
+
+func TestGetNodesByRangeOpts(t *testing.T) {
+	text := "var x = 1\nvar y = 2\nvar z = 3"
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Range  *textdocument.Range
+		Opts   textdocument.NodeRangeOptions
+		Values string
+	}{
+		{textdocument.NewRange(0, 1, 0, 5), textdocument.NodeRangeOptions{NamedOnly: true}, "x"},
+		{textdocument.NewRange(0, 8, 2, 1), textdocument.NodeRangeOptions{NamedOnly: true}, "1|var y = 2"},
+		{textdocument.NewRange(0, 4, 0, 9), textdocument.NodeRangeOptions{MaxDepth: 1}, "var x = 1"},
+		{textdocument.NewRange(0, 4, 0, 9), textdocument.NodeRangeOptions{MaxDepth: 2}, "x = 1"},
+		{textdocument.NewRange(0, 0, 2, 9), textdocument.NodeRangeOptions{Types: []string{"identifier"}}, "x|y|z"},
+		{textdocument.NewRange(0, 0, 1, 9), textdocument.NodeRangeOptions{Types: []string{"variable_declarator"}}, "x = 1|y = 2"},
+	}
+
+	for i, item := range list {
+		nodes, err := doc.GetNodesByRangeOpts(&item.Range.Start, &item.Range.End, item.Opts)
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+			continue
+		}
+
+		values := make([]string, len(nodes))
+
+		for j, node := range nodes {
+			values[j] = node.Content([]byte(text))
+		}
+
+		if strings.Join(values, "|") != item.Values {
+			t.Errorf("%d values: %v expect %s", i, values, item.Values)
+		}
+	}
+}
+
+func TestGetNodeByPosition(t *testing.T) {
+	text := "var x = 1\nvar y =  2\nvar z = 3"
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	list := []struct {
+		StartLine uint32
+		StartChar uint32
+		Value     string
+	}{
+		{0, 4, "x"},
+		{0, 1, "var"},
+		{0, 8, "1"},
+		{1, 0, "var"},
+		{1, 5, "y"},
+		{1, 8, ""},
+		{2, 9, "3"},
+	}
+
+	for i, item := range list {
+		start := proto.Position{
+			Line:      item.StartLine,
+			Character: item.StartChar,
+		}
+		node, err := doc.GetNodeByPosition(&start)
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+			continue
+		}
+
+		if node == nil {
+			if item.Value == "" {
+				continue
+			}
+
+			t.Errorf("%d node nil, pos: %v", i, item)
+			continue
+		}
+
+		value := node.Content([]byte(text))
+
+		if item.Value != value {
+			t.Errorf("%d value: '%s' expect '%s'", i, value, item.Value)
+		}
+	}
+}
+
+func TestMatchBracket(t *testing.T) {
+	doc := textdocument.NewTextDocument("f(a, [b, (c)], \")\")\nif (x) {\n  y()\n}")
+	doc.SetParser(createParser())
+
+	pairs := map[string]string{
+		"(": ")",
+		"[": "]",
+		"{": "}",
+	}
+
+	list := []struct {
+		Pos   []uint32
+		Open  []uint32
+		Close []uint32
+	}{
+		{[]uint32{0, 1}, []uint32{0, 1}, []uint32{0, 18}},
+		{[]uint32{0, 2}, []uint32{0, 1}, []uint32{0, 18}},
+		{[]uint32{0, 19}, []uint32{0, 1}, []uint32{0, 18}},
+		{[]uint32{0, 5}, []uint32{0, 5}, []uint32{0, 12}},
+		{[]uint32{0, 10}, []uint32{0, 9}, []uint32{0, 11}},
+		{[]uint32{0, 12}, []uint32{0, 9}, []uint32{0, 11}},
+		{[]uint32{0, 16}, nil, nil},
+		{[]uint32{0, 3}, nil, nil},
+		{[]uint32{1, 7}, []uint32{1, 7}, []uint32{3, 0}},
+		{[]uint32{3, 1}, []uint32{1, 7}, []uint32{3, 0}},
+	}
+
+	for i, item := range list {
+		open, close, err := doc.MatchBracket(&textdocument.Position{Line: item.Pos[0], Character: item.Pos[1]}, pairs)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if item.Open == nil {
+			if open != nil || close != nil {
+				t.Errorf("%d ranges %v %v expect nil", i, open, close)
+			}
+			continue
+		}
+
+		if open == nil || close == nil {
+			t.Errorf("%d ranges are nil", i)
+			continue
+		}
+
+		if open.Start.Line != item.Open[0] || open.Start.Character != item.Open[1] || close.Start.Line != item.Close[0] || close.Start.Character != item.Close[1] {
+			t.Errorf("%d ranges %v %v expect %v %v", i, open.Start, close.Start, item.Open, item.Close)
+		}
+	}
+}
+
+func TestGetSelectionRanges(t *testing.T) {
+	doc := textdocument.NewTextDocument("function f() {\n  return a + b\n}")
+	doc.SetParser(createParser())
+
+	list, err := doc.GetSelectionRanges([]*textdocument.Position{
+		{Line: 1, Character: 13},
+		{Line: 0, Character: 9},
+	})
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	checks := []string{
+		"1:13-1:14 1:9-1:14 1:2-1:14 0:13-2:1 0:0-2:1",
+		"0:9-0:10 0:0-2:1",
+	}
+
+	for i, check := range checks {
+		values := make([]string, 0)
+
+		for item := list[i]; item != nil; item = item.Parent {
+			r := item.Range
+			values = append(values, fmt.Sprintf("%d:%d-%d:%d", r.Start.Line, r.Start.Character, r.End.Line, r.End.Character))
+		}
+
+		if strings.Join(values, " ") != check {
+			t.Errorf("%d ranges %v expect %s", i, values, check)
+		}
+	}
+}
+
+func TestGetSyntaxDiagnostics(t *testing.T) {
+	list := []struct {
+		Text     string
+		Messages []string
+		Ranges   [][]uint32
+	}{
+		{"var x = 1", []string{}, [][]uint32{}},
+		{"if (x { y }", []string{"Missing )"}, [][]uint32{{0, 5, 0, 5}}},
+		{"var x = (1", []string{"Syntax error"}, [][]uint32{{0, 0, 0, 10}}},
+		{"var x = 1\nvar y = 2 3 4 5;", []string{"Syntax error"}, [][]uint32{{1, 10, 1, 15}}},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+		doc.SetParser(createParser())
+
+		diagnostics, err := doc.GetSyntaxDiagnostics()
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if len(diagnostics) != len(item.Messages) {
+			t.Errorf("%d diagnostics %v expect %v", i, diagnostics, item.Messages)
+			continue
+		}
+
+		for n, d := range diagnostics {
+			r := item.Ranges[n]
+
+			if d.Message != item.Messages[n] {
+				t.Errorf("%d:%d message '%s' expect '%s'", i, n, d.Message, item.Messages[n])
+			}
+
+			if d.Range.Start.Line != r[0] || d.Range.Start.Character != r[1] || d.Range.End.Line != r[2] || d.Range.End.Character != r[3] {
+				t.Errorf("%d:%d range %v expect %v", i, n, d.Range, r)
+			}
+
+			if d.Severity == nil || *d.Severity != proto.DiagnosticSeverityError {
+				t.Errorf("%d:%d wrong severity", i, n)
+			}
+		}
+	}
+}
+
+func TestGetSyntaxDiagnosticsInRange(t *testing.T) {
+	doc := textdocument.NewTextDocument("if (x { y }\nvar a = 1\nvar y = 2 3 4 5;")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Range    *textdocument.Range
+		Messages []string
+	}{
+		{textdocument.NewRange(0, 0, 0, 5), []string{"Missing )"}},
+		{textdocument.NewRange(0, 5, 0, 5), []string{"Missing )"}},
+		{textdocument.NewRange(1, 0, 1, 9), []string{}},
+		{textdocument.NewRange(2, 15, 2, 16), []string{"Syntax error"}},
+		{textdocument.NewRange(2, 16, 1, 0), []string{"Syntax error"}},
+		{textdocument.NewRange(0, 0, 2, 0), []string{"Missing )"}},
+		{doc.FullRange(), []string{"Missing )", "Syntax error"}},
+	}
+
+	for i, item := range list {
+		diagnostics, err := doc.GetSyntaxDiagnosticsInRange(&item.Range.Start, &item.Range.End)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		messages := make([]string, len(diagnostics))
+
+		for n, d := range diagnostics {
+			messages[n] = d.Message
+		}
+
+		if !slices.Equal(messages, item.Messages) {
+			t.Errorf("%d messages %v expect %v", i, messages, item.Messages)
+		}
+	}
+}
+
+func TestGetNodeAtByteIndex(t *testing.T) {
+	text := "var 😀 = 1\nvar y =  2"
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Index uint32
+		Value string
+	}{
+		{0, "var"},
+		{4, "😀"},
+		{11, "1"},
+		{13, "var"},
+		{17, "y"},
+		{21, ""},
+		{23, "2"},
+	}
+
+	for i, item := range list {
+		node, err := doc.GetNodeAtByteIndex(item.Index)
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+			continue
+		}
+
+		if node == nil {
+			if item.Value != "" {
+				t.Errorf("%d node nil expect '%s'", i, item.Value)
+			}
+			continue
+		}
+
+		if value := node.Content([]byte(text)); value != item.Value {
+			t.Errorf("%d value: '%s' expect '%s'", i, value, item.Value)
+		}
+	}
+
+	_, err := doc.GetNodeAtByteIndex(100)
+
+	if err == nil {
+		t.Errorf("should return error")
+	}
+}
+
+func TestGetAncestorByPosition(t *testing.T) {
+	doc := textdocument.NewTextDocument("function f() {\n  if (x) {\n    return y + 1\n  }\n}")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Line  uint32
+		Char  uint32
+		Types []string
+		Type  string
+	}{
+		{2, 11, []string{"statement_block"}, "statement_block"},
+		{2, 11, []string{"function_declaration"}, "function_declaration"},
+		{2, 11, []string{"if_statement", "function_declaration"}, "if_statement"},
+		{2, 11, nil, "binary_expression"},
+		{2, 11, []string{"class_declaration"}, ""},
+		{0, 9, []string{"function_declaration"}, "function_declaration"},
+		{2, 11, []string{"identifier", "binary_expression"}, "identifier"},
+		{0, 9, []string{"identifier"}, "identifier"},
+	}
+
+	for i, item := range list {
+		node, err := doc.GetAncestorByPosition(&textdocument.Position{Line: item.Line, Character: item.Char}, item.Types)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if node == nil {
+			if item.Type != "" {
+				t.Errorf("%d node is nil expect %s", i, item.Type)
+			}
+			continue
+		}
+
+		if node.Type() != item.Type {
+			t.Errorf("%d type %s expect %s", i, node.Type(), item.Type)
+		}
+	}
+}
+
+func TestGetIdentifierAtPosition(t *testing.T) {
+	doc := textdocument.NewTextDocument("var abc = x.prop + 1")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Char  uint32
+		Types []string
+		Text  string
+	}{
+		{5, nil, "abc"},
+		{4, nil, "abc"},
+		{10, nil, "x"},
+		{8, nil, ""},
+		{17, nil, ""},
+		{13, nil, ""},
+		{13, []string{"identifier", "property_identifier"}, "prop"},
+		{19, []string{"number"}, "1"},
+	}
+
+	for i, item := range list {
+		node, text, err := doc.GetIdentifierAtPosition(&textdocument.Position{Line: 0, Character: item.Char}, item.Types)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if text != item.Text || (node == nil) != (item.Text == "") {
+			t.Errorf("%d node %v text %q expect %q", i, node, text, item.Text)
+		}
+	}
+}
+
+func TestGetSiblingNodes(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1;\nf(x, 2, y);\nvar z = 3;")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Pos   *textdocument.Position
+		Nodes []string
+	}{
+		{&textdocument.Position{Line: 1, Character: 5}, []string{"x", "2", "y"}},
+		{&textdocument.Position{Line: 1, Character: 2}, []string{"", "x", "2"}},
+		{&textdocument.Position{Line: 1, Character: 8}, []string{"2", "y", ""}},
+		{&textdocument.Position{Line: 0, Character: 0}, []string{"", "var x = 1;", "f(x, 2, y);"}},
+		{&textdocument.Position{Line: 2, Character: 4}, []string{"", "z", "3"}},
+	}
+
+	for i, item := range list {
+		prev, current, next, err := doc.GetSiblingNodes(item.Pos)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		values := make([]string, 3)
+
+		for j, node := range []*textdocument.Node{prev, current, next} {
+			if node != nil {
+				values[j] = doc.NodeText(node)
+			}
+		}
+
+		if !slices.Equal(values, item.Nodes) {
+			t.Errorf("%d nodes %q expect %q", i, values, item.Nodes)
+		}
+	}
+}
+
+func TestGetContainingNode(t *testing.T) {
+	text := "var x = 1;\nf(x, 2);\nvar z = 3;"
+	doc := textdocument.NewTextDocument(text)
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Range     *textdocument.Range
+		Container string
+		Contained []string
+	}{
+		{textdocument.NewRange(0, 0, 1, 8), "program", []string{"var x = 1;", "f(x, 2);"}},
+		{textdocument.NewRange(1, 8, 0, 0), "program", []string{"var x = 1;", "f(x, 2);"}},
+		{textdocument.NewRange(0, 4, 1, 3), "program", []string{"x = 1", ";", "f", "(", "x"}},
+		{textdocument.NewRange(1, 2, 1, 6), "arguments", []string{"x", ",", "2"}},
+		{textdocument.NewRange(1, 2, 1, 2), "identifier", []string{}},
+	}
+
+	for i, item := range list {
+		node, err := doc.GetContainingNode(&item.Range.Start, &item.Range.End)
+
+		if err != nil || node.Type() != item.Container {
+			t.Errorf("%d container %v err %v expect %s", i, node, err, item.Container)
+		}
+
+		if same, _ := doc.GetNamedDescendantForRange(&item.Range.Start, &item.Range.End); !same.Equal(node) {
+			t.Errorf("%d named descendant %v expect %v", i, same, node)
+		}
+
+		nodes, err := doc.GetContainedNodes(&item.Range.Start, &item.Range.End)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		values := make([]string, len(nodes))
+
+		for j, node := range nodes {
+			values[j] = doc.NodeText(node)
+		}
+
+		if !slices.Equal(values, item.Contained) {
+			t.Errorf("%d contained %q expect %q", i, values, item.Contained)
+		}
+	}
+}
+
+func TestShiftRange(t *testing.T) {
+	text := "var x = 1;\nf(x, 2);\nvar z = 3;"
+
+	list := []struct {
+		Range  *textdocument.Range
+		Change *textdocument.ChangeEvent
+		Result *textdocument.Range
+		Text   string
+	}{
+		{textdocument.NewRange(2, 4, 2, 5), &textdocument.ChangeEvent{Range: textdocument.NewRange(2, 0, 2, 0), Text: "yy"}, textdocument.NewRange(2, 6, 2, 7), "z"},
+		{textdocument.NewRange(2, 4, 2, 5), &textdocument.ChangeEvent{Range: textdocument.NewRange(0, 0, 0, 0), Text: "\r\n"}, textdocument.NewRange(3, 4, 3, 5), "z"},
+		{textdocument.NewRange(2, 4, 2, 5), &textdocument.ChangeEvent{Range: textdocument.NewRange(0, 0, 1, 0), Text: ""}, textdocument.NewRange(1, 4, 1, 5), "z"},
+		{textdocument.NewRange(2, 4, 2, 5), &textdocument.ChangeEvent{Range: textdocument.NewRange(1, 8, 2, 3), Text: "/*😀*/"}, textdocument.NewRange(1, 15, 1, 16), "z"},
+		{textdocument.NewRange(2, 4, 2, 5), &textdocument.ChangeEvent{Range: textdocument.NewRange(2, 5, 2, 5), Text: "z"}, textdocument.NewRange(2, 4, 2, 5), ""},
+		{textdocument.NewRange(2, 4, 2, 9), &textdocument.ChangeEvent{Range: textdocument.NewRange(2, 8, 2, 9), Text: "42\n+1"}, textdocument.NewRange(2, 4, 3, 2), "z = 42\n+1"},
+		{textdocument.NewRange(2, 4, 2, 5), &textdocument.ChangeEvent{Range: textdocument.NewRange(2, 0, 2, 5), Text: ""}, nil, ""},
+		{textdocument.NewRange(2, 4, 2, 5), &textdocument.ChangeEvent{Text: "var z;"}, nil, ""},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(text)
+		doc.SetParser(createParser())
+
+		r := doc.ShiftRange(item.Range, item.Change)
+
+		if (r == nil) != (item.Result == nil) || (r != nil && *r != *item.Result) {
+			t.Errorf("%d range %v expect %v", i, r, item.Result)
+			continue
+		}
+
+		if r == nil {
+			continue
+		}
+
+		err := doc.Change(item.Change)
+
+		if err != nil {
+			t.Errorf("%d change err %s", i, err)
+			continue
+		}
+
+		node, err := doc.GetNodeByStableRange(r)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if (node == nil) != (item.Text == "") || (node != nil && doc.NodeText(node) != item.Text) {
+			t.Errorf("%d node %v expect %q", i, node, item.Text)
+		}
+	}
+}
+
+func TestGetNodePath(t *testing.T) {
+	doc := textdocument.NewTextDocument("var a;\nfunction f() {\n  return 1;\n}")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Pos   []uint32
+		Types []string
+	}{
+		{[]uint32{0, 4}, []string{"program", "variable_declaration", "variable_declarator", "identifier"}},
+		{[]uint32{2, 9}, []string{"program", "function_declaration", "statement_block", "return_statement", "number"}},
+		{[]uint32{2, 0}, []string{"program", "function_declaration", "statement_block"}},
+	}
+
+	for i, item := range list {
+		pos := &textdocument.Position{Line: item.Pos[0], Character: item.Pos[1]}
+		types, err := doc.GetNodePath(pos)
+
+		if err != nil || !slices.Equal(types, item.Types) {
+			t.Errorf("%d types %v err %v expect %v", i, types, err, item.Types)
+		}
+
+		types, ranges, err := doc.GetNodePathWithRanges(pos)
+
+		if err != nil || !slices.Equal(types, item.Types) || len(ranges) != len(types) {
+			t.Errorf("%d types %v ranges %v err %v", i, types, ranges, err)
+			continue
+		}
+
+		if ranges[0] != (textdocument.Range{End: *doc.EndPosition()}) {
+			t.Errorf("%d root range %v", i, ranges[0])
+		}
+	}
+
+	_, ranges, _ := doc.GetNodePathWithRanges(&textdocument.Position{Line: 2, Character: 9})
+
+	if ranges[4] != *textdocument.NewRange(2, 9, 2, 10) {
+		t.Errorf("number range %v", ranges[4])
+	}
+}
+
+func TestRenameIdentifier(t *testing.T) {
+	doc := textdocument.NewTextDocument("var ⌘x = 1;\nf(⌘x, '⌘x') + ⌘x")
+	doc.PositionEncoding = textdocument.UTF16
+	doc.SetParser(createParser())
+
+	edits, err := doc.RenameIdentifier("⌘x", "y", nil)
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	expect := []*textdocument.Range{
+		textdocument.NewRange(0, 4, 0, 6),
+		textdocument.NewRange(1, 2, 1, 4),
+		textdocument.NewRange(1, 14, 1, 16),
+	}
+
+	if len(edits) != len(expect) {
+		t.Fatalf("edits %v expect %v", edits, expect)
+	}
+
+	for i, edit := range edits {
+		if edit.Range != *expect[i] || edit.NewText != "y" {
+			t.Errorf("%d edit %v expect %v", i, edit, expect[i])
+		}
+	}
+
+	if doc.Text != "var ⌘x = 1;\nf(⌘x, '⌘x') + ⌘x" {
+		t.Errorf("document should not be changed")
+	}
+
+	edits, err = doc.RenameIdentifier("z", "y", nil)
+
+	if err != nil || len(edits) != 0 {
+		t.Errorf("edits %v err %v expect empty", edits, err)
+	}
+}
+
+func TestIsPositionInNodeType(t *testing.T) {
+	doc := textdocument.NewTextDocument("var s = 'a b'; // c d\nf(x);")
+	types := []string{"comment", "string"}
+
+	if ok, err := doc.IsPositionInNodeType(&textdocument.Position{Line: 0, Character: 10}, types); ok || err != nil {
+		t.Errorf("without tree ok %v err %v", ok, err)
+	}
+
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Pos []uint32
+		Ok  bool
+	}{
+		{[]uint32{0, 0}, false},
+		{[]uint32{0, 8}, true},
+		{[]uint32{0, 10}, true},
+		{[]uint32{0, 14}, false},
+		{[]uint32{0, 19}, true},
+		{[]uint32{1, 2}, false},
+	}
+
+	for i, item := range list {
+		ok, err := doc.IsPositionInNodeType(&textdocument.Position{Line: item.Pos[0], Character: item.Pos[1]}, types)
+
+		if err != nil || ok != item.Ok {
+			t.Errorf("%d ok %v err %v expect %v", i, ok, err, item.Ok)
+		}
+	}
+}
+
+func TestFindIdentifierOccurrences(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1;\nfunction f(x) { return x + xx; }\nvar s = 'x';")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Name   string
+		Types  []string
+		Ranges [][]uint32
+	}{
+		{"x", nil, [][]uint32{{0, 4}, {1, 11}, {1, 23}}},
+		{"xx", nil, [][]uint32{{1, 27}}},
+		{"f", nil, [][]uint32{{1, 9}}},
+		{"x", []string{"string_fragment"}, [][]uint32{{2, 9}}},
+		{"y", nil, [][]uint32{}},
+	}
+
+	for i, item := range list {
+		nodes, err := doc.FindIdentifierOccurrences(item.Name, item.Types)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if len(nodes) != len(item.Ranges) {
+			t.Errorf("%d nodes %d expect %d", i, len(nodes), len(item.Ranges))
+			continue
+		}
+
+		for j, node := range nodes {
+			p := node.StartPoint()
+
+			if p.Row != item.Ranges[j][0] || p.Column != item.Ranges[j][1] {
+				t.Errorf("%d.%d start %v expect %v", i, j, p, item.Ranges[j])
+			}
+		}
+	}
+
+	doc = textdocument.NewTextDocument("var x = 1")
+
+	if _, err := doc.FindIdentifierOccurrences("x", nil); !errors.Is(err, textdocument.ErrNoParser) {
+		t.Errorf("err %v expect ErrNoParser", err)
+	}
+}
+
+func TestGetEnclosingNodesOfType(t *testing.T) {
+	doc := textdocument.NewTextDocument("function f() {\n  if (x) {\n    return y + 1\n  }\n}")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Line  uint32
+		Char  uint32
+		Types []string
+		Nodes string
+	}{
+		{2, 11, []string{"statement_block"}, "statement_block statement_block"},
+		{2, 11, []string{"function_declaration", "if_statement", "identifier"}, "identifier if_statement function_declaration"},
+		{2, 11, []string{"class_declaration"}, ""},
+		{0, 1, []string{"statement_block"}, ""},
+	}
+
+	for i, item := range list {
+		nodes, err := doc.GetEnclosingNodesOfType(&textdocument.Position{Line: item.Line, Character: item.Char}, item.Types)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		values := make([]string, len(nodes))
+
+		for j, node := range nodes {
+			values[j] = node.Type()
+		}
+
+		if strings.Join(values, " ") != item.Nodes {
+			t.Errorf("%d nodes %v expect %s", i, values, item.Nodes)
+		}
+
+		if item.Nodes == "" && nodes != nil {
+			t.Errorf("%d nodes should be nil", i)
+		}
+	}
+}
+
+func TestGetFoldingRanges(t *testing.T) {
+	doc := textdocument.NewTextDocument("/* a\n b */\nfunction f() {\n  if (x) {\n    y()\n  }\n  if (z) { w() }\n}")
+	doc.SetParser(createParser())
+
+	ranges, err := doc.GetFoldingRanges(map[string]string{
+		"comment":         "comment",
+		"statement_block": "",
+	})
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	list := []struct {
+		Start uint32
+		End   uint32
+		Kind  string
+	}{
+		{0, 1, "comment"},
+		{2, 7, ""},
+		{3, 5, ""},
+	}
+
+	if len(ranges) != len(list) {
+		t.Fatalf("ranges %v expect %v", ranges, list)
+	}
+
+	for i, item := range list {
+		r := ranges[i]
+		kind := ""
+
+		if r.Kind != nil {
+			kind = *r.Kind
+		}
+
+		if r.StartLine != item.Start || r.EndLine != item.End || kind != item.Kind {
+			t.Errorf("%d range {%d %d %s} expect %v", i, r.StartLine, r.EndLine, kind, item)
+		}
+	}
+}
+
+func TestUpdateHighlightCapturesCtx(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	doc.HighlightCapturesDirty = true
+	err := doc.UpdateHighlightCapturesCtx(ctx)
+
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("err %v expect context.Canceled", err)
+	}
+
+	if !doc.HighlightCapturesDirty {
+		t.Errorf("HighlightCaptures should stay dirty")
+	}
+
+	err = doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(0, 4, 0, 5),
+		Text:  "z",
+	})
+
+	if err != nil {
+		t.Fatalf("Change err %s", err)
+	}
+
+	if doc.HighlightCapturesDirty || len(doc.HighlightCaptures) != 4 {
+		t.Errorf("HighlightCaptures should be updated by Change")
+	}
+}
+
+func TestQueryCaptures(t *testing.T) {
+	doc := textdocument.NewTextDocument("function a() {}\nvar x = 1\nfunction b() { function c() {} }")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(function_declaration name: (identifier) @name)"), getLang())
+	caps := doc.QueryCaptures(q, doc.Tree.RootNode(), nil)
+	names := []string{"a", "b", "c"}
+
+	if len(caps) != len(names) {
+		t.Fatalf("captures len %d expect %d", len(caps), len(names))
+	}
+
+	for i, name := range names {
+		if value := caps[i].Node.Content([]byte(doc.Text)); value != name {
+			t.Errorf("%d name '%s' expect '%s'", i, value, name)
+		}
+	}
+
+	q, _ = sitter.NewQuery([]byte("(function_declaration) @fn"), getLang())
+	node := doc.Tree.RootNode().NamedChild(2)
+	caps = doc.QueryCaptures(q, node.ChildByFieldName("body"), nil)
+
+	if len(caps) != 1 {
+		t.Errorf("captures in subtree len %d expect 1", len(caps))
+	}
+
+	if doc.HighlightQuery != nil {
+		t.Errorf("HighlightQuery should not be changed")
+	}
+}
+
+func TestQueryCapturesInOneMatch(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1, y = 2")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(variable_declarator name: (identifier) @name value: (number) @value)"), getLang())
+	caps := doc.QueryCaptures(q, doc.Tree.RootNode(), nil)
+	values := make([]string, len(caps))
+
+	for i, cap := range caps {
+		values[i] = q.CaptureNameForId(cap.Index) + ":" + cap.Node.Content([]byte(doc.Text))
+	}
+
+	check := "name:x value:1 name:y value:2"
+
+	if strings.Join(values, " ") != check {
+		t.Errorf("values %v expect %s", values, check)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1;\nvar y = 2;")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n\";\" @punct\n\"=\" @punct"), getLang())
+
+	list := []struct {
+		Ignore *textdocument.Ignore
+		Values []string
+	}{
+		{nil, []string{"x", "=", ";", "y", "=", ";"}},
+		{&textdocument.Ignore{Anonymous: true}, []string{"x", "y"}},
+		{&textdocument.Ignore{Named: true}, []string{"=", ";", "=", ";"}},
+		{&textdocument.Ignore{Named: true, Anonymous: true}, []string{}},
+	}
+
+	for i, item := range list {
+		caps := doc.QueryCaptures(q, doc.Tree.RootNode(), item.Ignore)
+		values := make([]string, len(caps))
+
+		for n, cap := range caps {
+			values[n] = cap.Node.Content([]byte(doc.Text))
+		}
+
+		if strings.Join(values, " ") != strings.Join(item.Values, " ") {
+			t.Errorf("%d values %v expect %v", i, values, item.Values)
+		}
+	}
+}
+
+func TestIgnoreDuplicates(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = y;")
+	doc.SetParser(createParser())
+
+	// x is captured as @ident by both patterns, y only by first one
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(variable_declarator name: (identifier) @ident)\n(variable_declarator name: (identifier) @name)"), getLang())
+
+	list := []struct {
+		Ignore *textdocument.Ignore
+		Values []string
+	}{
+		{nil, []string{"ident:x", "ident:x", "name:x", "ident:y"}},
+		{&textdocument.Ignore{Duplicates: true}, []string{"ident:x", "name:x", "ident:y"}},
+	}
+
+	for i, item := range list {
+		doc.SetHighlightQuery(q, item.Ignore)
+
+		caps := doc.GetHighlightCapturesInNode(doc.Tree.RootNode())
+		values := make([]string, len(caps))
+
+		for n, cap := range caps {
+			values[n] = doc.CaptureName(cap) + ":" + doc.NodeText(cap.Node)
+		}
+
+		slices.Sort(values)
+		slices.Sort(item.Values)
+
+		if !slices.Equal(values, item.Values) {
+			t.Errorf("%d values %v expect %v", i, values, item.Values)
+		}
+
+		if len(doc.HighlightCaptures) != len(item.Values) {
+			t.Errorf("%d HighlightCaptures %d expect %d", i, len(doc.HighlightCaptures), len(item.Values))
+		}
+	}
+}
+
+func TestGetDocumentSymbols(t *testing.T) {
+	doc := textdocument.NewTextDocument("class A {\n  m() {\n    function f() {}\n  }\n}\nfunction g() {}")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte(`
+		(class_declaration name: (identifier) @name) @symbol
+		(method_definition name: (property_identifier) @name) @symbol
+		(function_declaration name: (identifier) @name) @symbol
+	`), getLang())
+
+	symbols, err := doc.GetDocumentSymbols(q, "name", map[string]proto.SymbolKind{
+		"class_declaration":    proto.SymbolKindClass,
+		"method_definition":    proto.SymbolKindMethod,
+		"function_declaration": proto.SymbolKindFunction,
+	})
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	var format func(list []proto.DocumentSymbol) string
+
+	format = func(list []proto.DocumentSymbol) string {
+		values := make([]string, len(list))
+
+		for i, symbol := range list {
+			values[i] = fmt.Sprintf("%s:%d:%d-%d:%d:%d", symbol.Name, symbol.Kind, symbol.Range.Start.Line, symbol.Range.End.Line, symbol.SelectionRange.Start.Character, symbol.SelectionRange.End.Character)
+
+			if len(symbol.Children) > 0 {
+				values[i] += "(" + format(symbol.Children) + ")"
+			}
+		}
+
+		return strings.Join(values, " ")
+	}
+
+	check := "A:5:0-4:6:7(m:6:1-3:2:3(f:12:2-2:13:14)) g:12:5-5:9:10"
+
+	if value := format(symbols); value != check {
+		t.Errorf("symbols %s expect %s", value, check)
+	}
+}
+
+func TestLastChangedRanges(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2\nvar z = 3")
+	doc.TrackChangedRanges = true
+	doc.SetParser(createParser())
+
+	format := func(list []textdocument.Range) string {
+		values := make([]string, len(list))
+
+		for i, r := range list {
+			values[i] = fmt.Sprintf("%d:%d-%d:%d", r.Start.Line, r.Start.Character, r.End.Line, r.End.Character)
+		}
+
+		return strings.Join(values, " ")
+	}
+
+	if value := format(doc.LastChangedRanges()); value != "0:0-2:9" {
+		t.Errorf("ranges after parse %s", value)
+	}
+
+	list := []struct {
+		Events []*textdocument.ChangeEvent
+		Ranges string
+	}{
+		{[]*textdocument.ChangeEvent{{Range: textdocument.NewRange(0, 8, 0, 9), Text: "2"}}, "0:8-0:9"},
+		{[]*textdocument.ChangeEvent{{Range: textdocument.NewRange(1, 4, 1, 5), Text: "yy = 1, b"}}, "1:4-1:17"},
+		{[]*textdocument.ChangeEvent{{Range: textdocument.NewRange(0, 0, 0, 0), Text: "/* "}}, "0:0-0:12"},
+		{[]*textdocument.ChangeEvent{{Range: textdocument.NewRange(0, 0, 0, 3), Text: ""}}, "0:0-0:9"},
+		{[]*textdocument.ChangeEvent{
+			{Range: textdocument.NewRange(0, 4, 0, 5), Text: "a"},
+			{Range: textdocument.NewRange(2, 4, 2, 5), Text: "c"},
+		}, "0:4-0:5 2:4-2:5"},
+		{[]*textdocument.ChangeEvent{{Range: textdocument.NewRange(2, 9, 2, 9), Text: ";"}}, "2:4-2:10"},
+	}
+
+	for i, item := range list {
+		err := doc.ChangeMany(item.Events, nil)
+
+		if err != nil {
+			t.Fatalf("%d change err %s", i, err)
+		}
+
+		if value := format(doc.LastChangedRanges()); value != item.Ranges {
+			t.Errorf("%d ranges %s expect %s", i, value, item.Ranges)
+		}
+	}
+
+	doc.TrackChangedRanges = false
+	doc.Change(&textdocument.ChangeEvent{Range: textdocument.NewRange(0, 0, 0, 0), Text: " "})
+
+	if len(doc.LastChangedRanges()) != 0 {
+		t.Errorf("ranges should not be tracked")
+	}
+}
+
+func TestHighlightEdits(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	parts := []string{"var ", "x", "y1", " = ", "1", "'s'", "\"", "/*", "*/", "// c", "\n", "f(", ")", "{", "}", ";", "`", "function "}
+	random := func(max int) string {
+		text := ""
+		count := r.Intn(max)
+
+		for i := 0; i < count; i++ {
+			text += parts[r.Intn(len(parts))]
+		}
+
+		return text
+	}
+
+	q, _ := sitter.NewQuery([]byte(`
+		(identifier) @variable
+		(number) @number
+		(string) @string
+		(comment) @comment
+		"var" @keyword
+	`), getLang())
+
+	keys := func(list []*sitter.QueryCapture) string {
+		values := make([]string, len(list))
+
+		for i, cap := range list {
+			values[i] = fmt.Sprintf("%d-%d:%d", cap.Node.StartByte(), cap.Node.EndByte(), cap.Index)
+		}
+
+		return strings.Join(values, " ")
+	}
+
+	doc := textdocument.NewTextDocument(random(60))
+	doc.SetParser(createParser())
+	doc.SetHighlightQuery(q, nil)
+
+	for i := 0; i < 200; i++ {
+		count := len(doc.HighlightCaptures)
+		start := r.Intn(len(doc.Text) + 1)
+		end := start + r.Intn(min(len(doc.Text)-start, 10)+1)
+		range_, _ := doc.ByteRangeToRange(uint32(start), uint32(end))
+
+		err := doc.Change(&textdocument.ChangeEvent{
+			Range: range_,
+			Text:  random(4),
+		})
+
+		if err != nil {
+			t.Fatalf("%d change err %s", i, err)
+		}
+
+		if doc.HighlightEdits == nil || doc.HighlightCapturesDirty {
+			t.Fatalf("%d captures not updated", i)
+		}
+
+		current := doc.HighlightCaptures
+
+		for _, edit := range doc.HighlightEdits {
+			inserted := current[edit.Start : int(edit.Start)+len(edit.Insert)]
+
+			if count-int(edit.Delete)+len(edit.Insert) != len(current) || keys(edit.Insert) != keys(inserted) {
+				t.Errorf("%d edit %d %d %s of %d captures %s", i, edit.Start, edit.Delete, keys(edit.Insert), count, keys(current))
+			}
+		}
+	}
+
+	doc.SetText(getLargeText(1000))
+	doc.UpdateHighlightCaptures()
+
+	err := doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(500, 4, 500, 5),
+		Text:  "2",
+	})
+
+	if err != nil {
+		t.Fatalf("change err %s", err)
+	}
+
+	if len(doc.HighlightEdits) != 1 || doc.HighlightEdits[0].Delete != 1 || len(doc.HighlightEdits[0].Insert) != 1 {
+		t.Errorf("edits %v expect one replaced capture", doc.HighlightEdits)
+	}
+
+	doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(500, 9, 500, 9),
+		Text:  " ",
+	})
+
+	if doc.HighlightEdits == nil || len(doc.HighlightEdits) != 0 {
+		t.Errorf("edits %v expect none", doc.HighlightEdits)
+	}
+
+	doc.SetText("var x")
+
+	if doc.HighlightEdits != nil {
+		t.Errorf("edits %v after SetText", doc.HighlightEdits)
+	}
+}
+
+func TestHighlightCapturesAfterEdits(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	parts := []string{"var ", "x", "f", " = ", "1", "'s'", "\"", "/*", "*/", "// c", "\n", "f(", ")", "{", "}", ";", "`", "function "}
+	random := func(max int) string {
+		text := ""
+		count := r.Intn(max)
+
+		for i := 0; i < count; i++ {
+			text += parts[r.Intn(len(parts))]
+		}
+
+		return text
+	}
+
+	q, _ := sitter.NewQuery([]byte(`
+		(call_expression function: (identifier) @function)
+		(identifier) @variable
+		(number) @number
+		(string) @string
+		(comment) @comment
+		"var" @keyword
+	`), getLang())
+
+	keys := func(list []textdocument.HighlightCapture) string {
+		values := make([]string, len(list))
+
+		for i, cap := range list {
+			values[i] = fmt.Sprintf("%d-%d:%d:%d", cap.Node.StartByte(), cap.Node.EndByte(), cap.Index, cap.PatternIndex)
+		}
+
+		return strings.Join(values, " ")
+	}
+
+	doc := textdocument.NewTextDocument(random(200))
+	doc.SetParser(createParser())
+	doc.SetHighlightQuery(q, nil)
+
+	kept := 0
+
+	for i := 0; i < 300; i++ {
+		start := r.Intn(len(doc.Text) + 1)
+		end := start + r.Intn(min(len(doc.Text)-start, 10)+1)
+		range_, _ := doc.ByteRangeToRange(uint32(start), uint32(end))
+		first := doc.HighlightCaptures
+
+		err := doc.Change(&textdocument.ChangeEvent{
+			Range: range_,
+			Text:  random(4),
+		})
+
+		if err != nil {
+			t.Fatalf("%d change err %s", i, err)
+		}
+
+		if len(first) > 0 && len(doc.HighlightCaptures) > 0 && first[0] == doc.HighlightCaptures[0] {
+			kept++
+		}
+
+		expected := textdocument.NewTextDocument(doc.Text)
+		expected.SetParser(createParser())
+		expected.SetHighlightQuery(q, nil)
+
+		actual := keys(doc.GetHighlightCapturesWithPatterns())
+		want := keys(expected.GetHighlightCapturesWithPatterns())
+
+		if actual != want {
+			t.Fatalf("%d captures of %q\n%s\nexpected\n%s", i, doc.Text, actual, want)
+		}
+	}
+
+	if kept == 0 {
+		t.Errorf("captures before edits were never kept")
+	}
+}
+
+func TestGetHighlightCapturesInLine(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\n/* a\n\nb */ var y = 2\nvar zxc = 3")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num\n(comment) @comment"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	list := []string{
+		"x 1",
+		"comment",
+		"comment",
+		"comment y 2",
+		"zxc 3",
+		"",
+	}
+
+	for i, check := range list {
+		values := make([]string, 0)
+
+		for _, cap := range doc.GetHighlightCapturesInLine(uint32(i)) {
+			if cap.Node.Type() == "comment" {
+				values = append(values, "comment")
+			} else {
+				values = append(values, cap.Node.Content([]byte(doc.Text)))
+			}
+		}
+
+		if strings.Join(values, " ") != check {
+			t.Errorf("%d captures %v expect %s", i, values, check)
+		}
+	}
+}
+
+func TestHighlightCapturesSortedAcrossMatch(t *testing.T) {
+	doc := textdocument.NewTextDocument("foo(\n  1,\n  bar\n)")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(call_expression function: (identifier) @fn arguments: (arguments (number) (identifier) @arg))\n(number) @num"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	for i, check := range []string{"foo", "1", "bar", ""} {
+		values := make([]string, 0)
+
+		for _, cap := range doc.GetHighlightCapturesInLine(uint32(i)) {
+			values = append(values, doc.NodeText(cap.Node))
+		}
+
+		if strings.Join(values, " ") != check {
+			t.Errorf("%d captures %v expect %s", i, values, check)
+		}
+	}
+
+	tokens, err := doc.ConvertHighlightCaptures(textdocument.HighlightLegend{{Type: 1}, {Type: 2}, {Type: 3}})
+	expect := []uint32{0, 0, 3, 1, 0, 1, 2, 1, 3, 0, 1, 2, 3, 2, 0}
+
+	if err != nil || !slices.Equal(tokens, expect) {
+		t.Errorf("tokens %v err %v expect %v", tokens, err, expect)
+	}
+}
+
+func TestEachHighlightCapture(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2\nvar zxc = 3")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	values := make([]string, 0)
+
+	doc.EachHighlightCapture(doc.Tree.RootNode(), func(cap *sitter.QueryCapture) bool {
+		values = append(values, cap.Node.Content([]byte(doc.Text)))
+		return len(values) < 4
+	})
+
+	if strings.Join(values, " ") != "x 1 y 2" {
+		t.Errorf("values %v expect [x 1 y 2]", values)
+	}
+}
+
+func TestGetHighlightCaptureNameByPosition(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+	doc.SetParser(createParser())
+
+	if name, _ := doc.GetHighlightCaptureNameByPosition(&textdocument.Position{Line: 0, Character: 4}); name != "" {
+		t.Errorf("name without query %q expect empty", name)
+	}
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @variable.name\n(number) @number"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	list := []struct {
+		Char uint32
+		Name string
+	}{
+		{4, "variable.name"},
+		{8, "number"},
+		{6, ""},
+	}
+
+	for i, item := range list {
+		name, err := doc.GetHighlightCaptureNameByPosition(&textdocument.Position{Line: 0, Character: item.Char})
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if name != item.Name {
+			t.Errorf("%d name %q expect %q", i, name, item.Name)
+		}
+	}
+}
+
+func TestGetTokenAtPosition(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1;\nvar ⌘a = 22")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @variable\n(number) @number"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	legend := textdocument.HighlightLegend{
+		{Type: 3, Modifiers: 1},
+		{Type: 5, Modifiers: 0},
+	}
+
+	list := []struct {
+		Pos   []uint32
+		Token []uint32
+	}{
+		{[]uint32{0, 4}, []uint32{0, 4, 1, 3, 1}},
+		{[]uint32{0, 8}, []uint32{0, 8, 1, 5, 0}},
+		{[]uint32{1, 5}, []uint32{1, 4, 2, 3, 1}},
+		{[]uint32{1, 10}, []uint32{1, 9, 2, 5, 0}},
+		{[]uint32{0, 6}, nil},
+	}
+
+	for i, item := range list {
+		token, err := doc.GetTokenAtPosition(&textdocument.Position{Line: item.Pos[0], Character: item.Pos[1]}, legend)
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if item.Token == nil {
+			if token != nil {
+				t.Errorf("%d token %v expect nil", i, token)
+			}
+			continue
+		}
+
+		values := []uint32{token.Line, token.Character, token.Length, token.Type, token.Modifiers}
+
+		if !slices.Equal(values, item.Token) {
+			t.Errorf("%d token %v expect %v", i, values, item.Token)
+		}
+	}
+
+	if _, err := doc.GetTokenAtPosition(&textdocument.Position{Line: 0, Character: 8}, legend[:1]); err == nil {
+		t.Errorf("short legend should return error")
+	}
+}
+
+func visitNodeRecursive(node *sitter.Node, compare func(*sitter.Node) int8) bool {
+	for ; node != nil; node = node.NextSibling() {
+		action := compare(node)
+
+		if action < 0 {
+			return false
+		}
+
+		if action == 0 && node.ChildCount() > 0 && !visitNodeRecursive(node.Child(0), compare) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestVisitNode(t *testing.T) {
+	depth := 500
+	doc := textdocument.NewTextDocument("x = " + strings.Repeat("[", depth) + "1" + strings.Repeat("]", depth) + "; y = [2, [3]]; z = 4")
+	doc.SetParser(createParser())
+
+	list := []func(node *sitter.Node) int8{
+		func(node *sitter.Node) int8 {
+			return 0
+		},
+		func(node *sitter.Node) int8 {
+			if node.Type() == "array" && node.StartByte() == 4 {
+				return 1
+			}
+
+			return 0
+		},
+		func(node *sitter.Node) int8 {
+			if node.Type() == "number" && node.Content([]byte(doc.Text)) == "3" {
+				return -1
+			}
+
+			return 0
+		},
+		func(node *sitter.Node) int8 {
+			if node.Type() == "number" {
+				return -1
+			}
+
+			return 0
+		},
+	}
+
+	for i, compare := range list {
+		visited := make([]string, 0)
+		expected := make([]string, 0)
+
+		c := sitter.NewTreeCursor(doc.Tree.RootNode())
+
+		textdocument.VisitNode(c, func(node *sitter.Node) int8 {
+			visited = append(visited, fmt.Sprintf("%s:%d", node.Type(), node.StartByte()))
+			return compare(node)
+		})
+
+		if c.CurrentNode().Type() != "program" {
+			t.Errorf("%d cursor should be on start node, actual %s", i, c.CurrentNode().Type())
+		}
+
+		c.Close()
+
+		visitNodeRecursive(doc.Tree.RootNode(), func(node *sitter.Node) int8 {
+			expected = append(expected, fmt.Sprintf("%s:%d", node.Type(), node.StartByte()))
+			return compare(node)
+		})
+
+		if strings.Join(visited, " ") != strings.Join(expected, " ") {
+			t.Errorf("%d visited %d nodes expect %d", i, len(visited), len(expected))
+		}
+	}
+}
+
+func TestVisitNodesInRange(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = [2, 3]\nvar z = 4")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Start   sitter.Point
+		End     sitter.Point
+		Stop    string
+		Visited string
+	}{
+		{sitter.Point{Row: 1, Column: 9}, sitter.Point{Row: 1, Column: 10}, "", "program:0 variable_declaration:10 variable_declarator:14 array:18 number:19"},
+		{sitter.Point{Row: 1, Column: 9}, sitter.Point{Row: 1, Column: 9}, "", "program:0 variable_declaration:10 variable_declarator:14 array:18 [:18 number:19"},
+		{sitter.Point{Row: 0, Column: 8}, sitter.Point{Row: 2, Column: 3}, "variable_declarator", "program:0 variable_declaration:0 variable_declarator:4 variable_declaration:10 var:10 variable_declarator:14 variable_declaration:25 var:25"},
+		{sitter.Point{Row: 1, Column: 0}, sitter.Point{Row: 1, Column: 14}, "array", "program:0 variable_declaration:10 var:10 variable_declarator:14 identifier:14 =:16 array:18"},
+	}
+
+	for i, item := range list {
+		visited := make([]string, 0)
+
+		err := doc.VisitNodesInRange(&item.Start, &item.End, func(node *sitter.Node) int8 {
+			visited = append(visited, fmt.Sprintf("%s:%d", node.Type(), node.StartByte()))
+
+			if node.Type() == item.Stop {
+				return 1
+			}
+
+			if node.Type() == "number" {
+				return -1
+			}
+
+			return 0
+		})
+
+		if err != nil {
+			t.Fatalf("%d err %s", i, err)
+		}
+
+		if strings.Join(visited, " ") != item.Visited {
+			t.Errorf("%d visited %s expect %s", i, strings.Join(visited, " "), item.Visited)
+		}
+	}
+}
+
+func TestQueryPredicates(t *testing.T) {
+	doc := textdocument.NewTextDocument("var Abc = self + console.log(window, x, x == y)")
+	doc.SetParser(createParser())
+
+	list := []struct {
+		Query    string
+		Captures string
+	}{
+		{`((identifier) @const (#match? @const "^[A-Z]"))`, "Abc"},
+		{`((identifier) @var (#not-match? @var "^[A-Z]"))`, "self console window x x y"},
+		{`((identifier) @builtin (#any-of? @builtin "console" "window" "self"))`, "self console window"},
+		{`((identifier) @var (#not-any-of? @var "console" "window" "self" "Abc"))`, "x x y"},
+		{`((identifier) @self (#eq? @self "self"))`, "self"},
+		{`((identifier) @var (#not-eq? @var "x"))`, "Abc self console window y"},
+		{`(binary_expression left: (_) @left right: (_) @right (#eq? @left @right))`, ""},
+		{`(binary_expression left: (_) @left right: (_) @right (#not-eq? @left @right))`, "self console.log(window, x, x == y) x y"},
+		{`((identifier) @var (#match? @var "[") (#set! priority 1))`, ""},
+		{`((identifier) @var (#set! priority "1"))`, "Abc self console window x x y"},
+	}
+
+	for i, item := range list {
+		q, err := sitter.NewQuery([]byte(item.Query), getLang())
+
+		if err != nil {
+			t.Fatalf("%d query err %s", i, err)
+		}
+
+		values := make([]string, 0)
+
+		for _, cap := range doc.QueryCaptures(q, doc.Tree.RootNode(), nil) {
+			values = append(values, doc.NodeText(cap.Node))
+		}
+
+		if strings.Join(values, " ") != item.Captures {
+			t.Errorf("%d captures %v expect %s", i, values, item.Captures)
+		}
+	}
+}
+
+func TestHighlights(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2\nvar zxc = 3")
+	doc.SetParser(createParser())
+
+	pattern := "(identifier) @ident\n(number) @num"
+	q, _ := sitter.NewQuery([]byte(pattern), getLang())
+	doc.SetHighlightQuery(q, &textdocument.Ignore{
+		Missing: true,
+		Extra:   true,
+	})
+
+	if len(doc.HighlightCaptures) != 6 {
+		t.Errorf("init HighlightCaptures wrong len %d expect %d", len(doc.HighlightCaptures), 6)
+	}
+
+	capTests := []struct {
+		Line  uint32
+		Char  uint32
+		Index uint32
+		Value string
+	}{
+		{0, 8, 1, "1"},
+		{1, 4, 0, "y"},
+		{2, 11, 1, "3"},
+	}
+
+	for i, item := range capTests {
+		cap, err := doc.GetHighlightCaptureByPosition(&textdocument.Position{
+			Line:      item.Line,
+			Character: item.Char,
+		})
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		if cap.Index != item.Index {
+			t.Errorf("%d cap wrong Index %d expect %d", i, cap.Index, item.Index)
+		}
+
+		str := cap.Node.Content([]byte(doc.Text))
+
+		if str != item.Value {
+			t.Errorf("%d cap.Node.Content '%s' expect '%s'", i, str, item.Value)
+		}
+	}
+
+	closestTests := []struct {
+		Line   uint32
+		Char   uint32
+		Prev   string
+		Target string
+		Next   string
+	}{
+		{0, 0, "", "", "x"},
+		{0, 4, "", "x", "1"},
+		{0, 5, "", "x", "1"},
+		{0, 6, "x", "", "1"},
+		{0, 8, "x", "1", "y"},
+		{0, 9, "x", "1", "y"},
+		{1, 0, "1", "", "y"},
+		{2, 11, "zxc", "3", ""},
+	}
+
+	for i, item := range closestTests {
+		prev, target, next, err := doc.GetClosestHighlightCaptureByPosition(&textdocument.Position{
+			Line:      item.Line,
+			Character: item.Char,
+		})
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+			continue
+		}
+
+		caps := []*sitter.QueryCapture{prev, target, next}
+		values := []string{item.Prev, item.Target, item.Next}
+
+		for n, cap := range caps {
+			if cap == nil {
+				if values[n] != "" {
+					t.Errorf("%d cap %d is nil expect '%s'", i, n, values[n])
+					break
+				}
+
+				continue
+			}
+
+			value := cap.Node.Content([]byte(doc.Text))
+
+			if value != values[n] {
+				t.Errorf("%d cap %d is '%s' expect '%s'", i, n, value, values[n])
+				break
+			}
+		}
+	}
+
+	list := []struct {
+		Pos  []uint32
+		Text string
+	}{
+		{[]uint32{0, 4, 0, 5}, "z"},
+		{[]uint32{1, 8, 1, 9}, "4"},
+		{[]uint32{2, 5, 2, 11}, "cx = 5"},
+		{[]uint32{0, 7, 0, 7}, "  "},
+		{[]uint32{2, 4, 2, 5}, ""},
+	}
+
+	for i, item := range list {
+		start := &proto.Position{
+			Line:      item.Pos[0],
+			Character: item.Pos[1],
+		}
+		end := &proto.Position{
+			Line:      item.Pos[2],
+			Character: item.Pos[3],
+		}
+
+		err := doc.Change(&textdocument.ChangeEvent{
+			Range: &proto.Range{
+				Start: *start,
+				End:   *end,
+			},
+			Text: item.Text,
+		})
+
+		if err != nil {
+			t.Errorf("%d err %s", i, err)
+		}
+	}
+
+	legend := textdocument.HighlightLegend{
+		{
+			Type:      0,
+			Modifiers: 0,
+		},
+		{
+			Type:      1,
+			Modifiers: 1,
+		},
+	}
+
+	tags, err := doc.ConvertHighlightCaptures(legend)
+
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	comp := []uint32{
+		0, 4, 1, 0, 0,
+		0, 6, 1, 1, 1,
+		1, 4, 1, 0, 0,
+		0, 4, 1, 1, 1,
+		1, 4, 2, 0, 0,
+		0, 5, 1, 1, 1,
+	}
+
+	count := len(comp)
+
+	if len(tags) != count {
+		t.Errorf("tags len %d expected %d", len(tags), count)
+		return
+	}
+
+	for i := 0; i < count; i += 5 {
+		for n := 0; n < 5; n++ {
+			if tags[i+n] != comp[i+n] {
+				t.Errorf("%d wrong tag %v expected %v\n", i/5, tags[i:i+5], comp[i:i+5])
+				return
+			}
+		}
+	}
+}
+
+func TestPositionEncoding(t *testing.T) {
+	doc := textdocument.NewTextDocument("a😀b\n⌘c") // 1 4 1 n 3 1
+
+	list := []struct {
+		Encoding textdocument.PositionEncoding
+		Line     uint32
+		Char     uint32
+		Index    uint32
+		Error    bool
+	}{
+		{textdocument.UTF16, 0, 1, 1, false},
+		{textdocument.UTF16, 0, 2, 0, true},
+		{textdocument.UTF16, 0, 3, 5, false},
+		{textdocument.UTF16, 0, 4, 6, false},
+		{textdocument.UTF16, 1, 1, 10, false},
+		{textdocument.UTF32, 0, 2, 5, false},
+		{textdocument.UTF32, 0, 3, 6, false},
+		{textdocument.UTF32, 0, 4, 0, true},
+		{textdocument.UTF8, 0, 5, 5, false},
+		{textdocument.UTF8, 1, 3, 10, false},
+	}
+
+	for i, item := range list {
+		doc.PositionEncoding = item.Encoding
+
+		pos := &textdocument.Position{
+			Line:      item.Line,
+			Character: item.Char,
+		}
+
+		index, err := doc.PositionToByteIndex(pos)
+
+		if item.Error {
+			if err == nil {
+				t.Errorf("%d should return error", i)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+			continue
+		}
+
+		if index != item.Index {
+			t.Errorf("%d index %d expect %d", i, index, item.Index)
+		}
+
+		back, err := doc.ByteIndexToPosition(index)
+
+		if err != nil {
+			t.Errorf("%d err: %s", i, err)
+			continue
+		}
+
+		if back.Line != item.Line || back.Character != item.Char {
+			t.Errorf("%d position %v expect {%d, %d}", i, back, item.Line, item.Char)
+		}
+	}
+}
+
+func TestModifierMask(t *testing.T) {
+	legend := []string{"declaration", "definition", "readonly", "static"}
+
+	list := []struct {
+		Names []string
+		Mask  uint32
+		Err   bool
+	}{
+		{nil, 0, false},
+		{[]string{"declaration"}, 1, false},
+		{[]string{"readonly", "declaration"}, 5, false},
+		{[]string{"static", "static"}, 8, false},
+		{[]string{"readonly", "async"}, 0, true},
+	}
+
+	for i, item := range list {
+		mask, err := textdocument.ModifierMask(item.Names, legend)
+
+		if (err != nil) != item.Err || mask != item.Mask {
+			t.Errorf("%d mask %d err %v expect %d", i, mask, err, item.Mask)
+		}
+	}
+}
+
+func TestConvertHighlightCapturesSorted(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num\n(variable_declarator) @decl"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	legend := textdocument.HighlightLegend{
+		{Type: 0, Modifiers: 0},
+		{Type: 1, Modifiers: 0},
+		{Type: 2, Modifiers: 0},
+	}
+
+	expected := []uint32{
+		0, 4, 5, 2, 0,
+		0, 0, 1, 0, 0,
+		0, 4, 1, 1, 0,
+		1, 4, 5, 2, 0,
+		0, 0, 1, 0, 0,
+		0, 4, 1, 1, 0,
+	}
+
+	slices.Reverse(doc.HighlightCaptures)
+
+	tokens, err := doc.ConvertHighlightCaptures(legend)
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	if !slices.Equal(tokens, expected) {
+		t.Errorf("tokens %v expect %v", tokens, expected)
+	}
+}
+
+func TestConvertHighlightCapturesMultiLine(t *testing.T) {
+	legend := textdocument.HighlightLegend{{Type: 1}, {Type: 2}, {Type: 3}}
+	expect := []uint32{
+		0, 4, 1, 2, 0,
+		0, 4, 2, 1, 0,
+		1, 0, 4, 1, 0,
+		0, 2, 1, 2, 0,
+		1, 0, 2, 1, 0,
+		1, 0, 4, 3, 0,
+		2, 0, 4, 3, 0,
+		0, 5, 1, 2, 0,
+	}
+
+	for _, eol := range []string{"\n", "\r\n"} {
+		text := strings.Join([]string{"var a = `x", "${b}", "y`;", "/* c", "", "d */ e"}, eol)
+		doc := textdocument.NewTextDocument(text)
+		doc.SetParser(createParser())
+
+		q, _ := sitter.NewQuery([]byte("(template_string) @string\n(identifier) @variable\n(comment) @comment"), getLang())
+		doc.SetHighlightQuery(q, nil)
+
+		tokens, err := doc.ConvertHighlightCaptures(legend)
+
+		if err != nil || !slices.Equal(tokens, expect) {
+			t.Errorf("%q tokens %v err %v expect %v", eol, tokens, err, expect)
+		}
+
+		token, err := doc.GetTokenAtPosition(&textdocument.Position{Line: 5, Character: 1}, legend)
+
+		if err != nil || token == nil || token.Line != 5 || token.Character != 0 || token.Length != 4 {
+			t.Errorf("%q token %v err %v", eol, token, err)
+		}
+	}
+}
+
+func TestConvertHighlightCapturesFunc(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2;\nx = y + 3")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num\n(variable_declarator) @decl"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	legend := textdocument.HighlightLegend{
+		{Type: 0, Modifiers: 0},
+		{Type: 1, Modifiers: 1},
+		{Type: 2, Modifiers: 0},
+	}
+
+	expected, err := doc.ConvertHighlightCaptures(legend)
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	var tokens []uint32
+
+	err = doc.ConvertHighlightCapturesFunc(legend, func(line, char, length, typ, mods textdocument.UInt) error {
+		tokens = append(tokens, line, char, length, typ, mods)
+		return nil
+	})
+
+	if err != nil || !slices.Equal(tokens, expected) {
+		t.Errorf("tokens %v err %v expect %v", tokens, err, expected)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+
+	err = doc.ConvertHighlightCapturesFunc(legend, func(line, char, length, typ, mods textdocument.UInt) error {
+		count++
+
+		if count == 2 {
+			return stop
+		}
+
+		return nil
+	})
+
+	if err != stop || count != 2 {
+		t.Errorf("err %v count %d expect stop after 2 tokens", err, count)
+	}
+}
+
+func TestSetCaptureMapper(t *testing.T) {
+	doc := textdocument.NewTextDocument("f(x);")
+	doc.SetParser(createParser())
+	doc.TokenConflictResolution = textdocument.KeepInnermostToken
+
+	q, _ := sitter.NewQuery([]byte("(call_expression) @call\n(identifier) @variable\n\"(\" @punct\n(call_expression function: (identifier) @function.builtin (#eq? @function.builtin \"f\"))"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	doc.SetCaptureMapper(func(cap *sitter.QueryCapture, name string) (textdocument.TokenType, bool) {
+		switch name {
+		case "function.builtin":
+			return textdocument.TokenType{Type: 7, Modifiers: 2}, true
+		case "variable":
+			return textdocument.TokenType{Type: 1}, true
+		}
+
+		return textdocument.TokenType{}, false
+	})
+
+	// legend is not used by mapper
+	tokens, err := doc.ConvertHighlightCaptures(nil)
+
+	if err != nil {
+		t.Fatalf("err %s", err)
+	}
+
+	// f is captured as variable and as function.builtin, call and "(" are dropped
+	expect := []uint32{0, 0, 1, 7, 2, 0, 2, 1, 1, 0}
+
+	if !slices.Equal(tokens, expect) {
+		t.Errorf("tokens %v expect %v", tokens, expect)
+	}
+
+	token, err := doc.GetTokenAtPosition(&textdocument.Position{Line: 0, Character: 1}, nil)
+
+	if err != nil || token != nil {
+		t.Errorf("token %v err %v of dropped capture", token, err)
+	}
+
+	doc.SetCaptureMapper(func(cap *sitter.QueryCapture, name string) (textdocument.TokenType, bool) {
+		return textdocument.TokenType{Type: 7, Modifiers: 2}, name == "function.builtin"
+	})
+
+	tokens, _ = doc.ConvertHighlightCaptures(nil)
+
+	if !slices.Equal(tokens, []uint32{0, 0, 1, 7, 2}) {
+		t.Errorf("builtin tokens %v", tokens)
+	}
+
+	doc.SetCaptureMapper(nil)
+
+	if _, err := doc.ConvertHighlightCaptures(nil); err == nil {
+		t.Errorf("empty legend without mapper should return error")
+	}
+}
+
+func TestTokenConflictResolution(t *testing.T) {
+	legend := textdocument.HighlightLegend{
+		{Type: 0, Modifiers: 0},
+		{Type: 1, Modifiers: 0},
+		{Type: 2, Modifiers: 0},
+	}
+
+	list := []struct {
+		Text       string
+		Query      string
+		Resolution textdocument.TokenConflictResolution
+		Tokens     []uint32
+	}{
+		{"var x = f(1)", "(identifier) @ident\n(call_expression) @call\n(number) @num", textdocument.KeepAllTokens, []uint32{0, 4, 1, 0, 0, 0, 4, 4, 1, 0, 0, 0, 1, 0, 0, 0, 2, 1, 2, 0}},
+		{"var x = f(1)", "(identifier) @ident\n(call_expression) @call\n(number) @num", textdocument.KeepInnermostToken, []uint32{0, 4, 1, 0, 0, 0, 4, 1, 0, 0, 0, 2, 1, 2, 0}},
+		{"var x = f(1)", "(call_expression) @call\n(identifier) @ident\n(number) @num", textdocument.KeepInnermostToken, []uint32{0, 4, 1, 1, 0, 0, 4, 1, 1, 0, 0, 2, 1, 2, 0}},
+		{"var x = f(1)", "(call_expression) @call\n(identifier) @ident\n(number) @num", textdocument.KeepPriorityToken, []uint32{0, 4, 1, 1, 0, 0, 4, 4, 0, 0}},
+		{"var x = f(y)", "(number) @a\n(call_expression) @b\n(identifier) @a", textdocument.KeepPriorityToken, []uint32{0, 4, 1, 0, 0, 0, 4, 1, 0, 0, 0, 2, 1, 0, 0}},
+		{"var x = f(y)", "(number) @a\n(call_expression) @b\n(identifier) @a", textdocument.KeepPatternPriorityToken, []uint32{0, 4, 1, 0, 0, 0, 4, 4, 1, 0}},
+		{"  ", "(program) @program", textdocument.KeepAllTokens, []uint32{0, 2, 0, 0, 0}},
+		{"  ", "(program) @program", textdocument.KeepInnermostToken, []uint32{}},
+	}
+
+	for i, item := range list {
+		doc := textdocument.NewTextDocument(item.Text)
+		doc.SetParser(createParser())
+		doc.TokenConflictResolution = item.Resolution
+
+		q, _ := sitter.NewQuery([]byte(item.Query), getLang())
+		doc.SetHighlightQuery(q, nil)
+
+		tokens, err := doc.ConvertHighlightCaptures(legend)
+
+		if err != nil {
 			t.Errorf("%d err %s", i, err)
+			continue
 		}
 
-		if pos.Line != item[1] || pos.Character != item[2] {
-			t.Errorf("%d pos (%d, %d) expected (%d, %d)", i, pos.Line, pos.Character, item[1], item[2])
+		if !slices.Equal(tokens, item.Tokens) {
+			t.Errorf("%d tokens %v expect %v", i, tokens, item.Tokens)
 		}
 	}
 }
 
-func TestPointToPosition(t *testing.T) {
-	doc := getDoc()
+func TestGetMergedHighlightRanges(t *testing.T) {
+	legend := textdocument.HighlightLegend{
+		{Type: 0, Modifiers: 0},
+		{Type: 1, Modifiers: 0},
+	}
 
-	list := [][]uint32{
-		{0, 0, 0, 0},
-		{0, 3, 0, 1},
-		{1, 0, 1, 0},
-		{1, 2, 1, 2},
-		{2, 0, 2, 0},
-		{2, 4, 2, 2},
+	list := []struct {
+		Text   string
+		Tokens [][]uint32
+	}{
+		{"x+y", [][]uint32{{0, 0, 3, 0}}},
+		{"x + y", [][]uint32{{0, 0, 1, 0}, {0, 2, 1, 0}, {0, 4, 1, 0}}},
+		{"x+1+y", [][]uint32{{0, 0, 2, 0}, {0, 2, 1, 1}, {0, 3, 2, 0}}},
+		{"x+\ny", [][]uint32{{0, 0, 2, 0}, {1, 0, 1, 0}}},
 	}
 
+	q, _ := sitter.NewQuery([]byte("(identifier) @a\n\"+\" @a\n(number) @b"), getLang())
+
 	for i, item := range list {
-		pos, err := doc.PointToPosition(textdocument.Point{
-			Row:    item[0],
-			Column: item[1],
-		})
+		doc := textdocument.NewTextDocument(item.Text)
+		doc.SetParser(createParser())
+		doc.SetHighlightQuery(q, nil)
+
+		tokens, err := doc.GetMergedHighlightRanges(legend)
 
 		if err != nil {
-			t.Errorf("%d err: %s", i, err)
+			t.Errorf("%d err %s", i, err)
+			continue
 		}
 
-		if pos.Line != item[2] {
-			t.Errorf("%d pos.Line %d expect %d", i, pos.Line, item[2])
+		values := make([][]uint32, len(tokens))
+
+		for j, token := range tokens {
+			values[j] = []uint32{token.Line, token.Character, token.Length, token.Type}
 		}
 
-		if pos.Character != item[3] {
-			t.Errorf("%d pos.Character %d expect %d", i, pos.Character, item[3])
+		if fmt.Sprint(values) != fmt.Sprint(item.Tokens) {
+			t.Errorf("%d tokens %v expect %v", i, values, item.Tokens)
 		}
 	}
 }
 
-func TestLineByteIndexToPosition(t *testing.T) {
-	doc := getDoc()
+func TestGetHighlightCapturesWithPatterns(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = f(1)")
+	doc.SetParser(createParser())
 
-	list := [][]uint32{
-		{0, 0, 0, 0, 0},
-		{0, 3, 0, 1, 0},
-		{0, 4, 0, 2, 0},
-		{0, 5, 0, 3, 0},
-		{1, 0, 1, 0, 0},
-		{1, 2, 1, 2, 0},
-		{1, 5, 0, 0, 1},
-		{2, 3, 2, 1, 0},
-		{2, 4, 2, 2, 0},
-		{2, 5, 2, 3, 0},
-		{0, 6, 0, 0, 1},
-		{2, 6, 0, 0, 1},
+	q, _ := sitter.NewQuery([]byte("(number) @a\n(call_expression) @b\n(identifier) @a"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	list := doc.GetHighlightCapturesWithPatterns()
+	expect := []string{"x 2", "f(1) 1", "f 2", "1 0"}
+
+	if len(list) != len(expect) {
+		t.Fatalf("captures %d expect %d", len(list), len(expect))
+	}
+
+	for i, cap := range list {
+		text := fmt.Sprintf("%s %d", doc.NodeText(cap.Node), cap.PatternIndex)
+
+		if text != expect[i] {
+			t.Errorf("%d capture %q expect %q", i, text, expect[i])
+		}
+	}
+}
+
+func TestConvertHighlightCapturesDelta(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2\nvar zxc = 3")
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	legend := textdocument.HighlightLegend{
+		{Type: 0, Modifiers: 0},
+		{Type: 1, Modifiers: 1},
+	}
+
+	list := []struct {
+		Range  *textdocument.Range
+		Text   string
+		Edits  int
+		Start  uint32
+		Delete uint32
+		Insert int
+	}{
+		{textdocument.NewRange(0, 0, 0, 0), "", 0, 0, 0, 0},
+		{textdocument.NewRange(1, 4, 1, 5), "yy", 1, 10, 10, 2},
+		{textdocument.NewRange(1, 8, 1, 9), "a + b", 1, 15, 5, 2},
+		{textdocument.NewRange(0, 0, 1, 0), "", 1, 0, 15, 1},
 	}
 
 	for i, item := range list {
-		pos, err := doc.LineByteIndexToPosition(item[0], item[1])
+		prev, err := doc.ConvertHighlightCaptures(legend)
 
-		if item[4] == 1 {
-			if err == nil {
-				t.Errorf("%d should be error but it returns %v for {%d, %d}", i, pos, item[0], item[1])
+		if err != nil {
+			t.Fatalf("%d err %s", i, err)
+		}
+
+		err = doc.Change(&textdocument.ChangeEvent{
+			Range: item.Range,
+			Text:  item.Text,
+		})
+
+		if err != nil {
+			t.Fatalf("%d err %s", i, err)
+		}
+
+		edits, err := doc.ConvertHighlightCapturesDelta(prev, legend)
+
+		if err != nil {
+			t.Fatalf("%d err %s", i, err)
+		}
+
+		if len(edits) != item.Edits {
+			t.Errorf("%d edits len %d expect %d", i, len(edits), item.Edits)
+			continue
+		}
+
+		for _, edit := range edits {
+			if edit.Start != item.Start || edit.Delete != item.Delete || len(edit.Insert) != item.Insert || len(edit.Data) != item.Insert*5 {
+				t.Errorf("%d edit {%d %d %d} expect {%d %d %d}", i, edit.Start, edit.Delete, len(edit.Insert), item.Start, item.Delete, item.Insert)
 			}
+
+			res := append([]uint32{}, prev[:edit.Start]...)
+			res = append(res, edit.Data...)
+			res = append(res, prev[edit.Start+edit.Delete:]...)
+			prev = res
+		}
+
+		tokens, _ := doc.ConvertHighlightCaptures(legend)
+
+		if len(tokens) != len(prev) {
+			t.Errorf("%d applied edits %v expect %v", i, prev, tokens)
 			continue
 		}
 
-		if err != nil {
-			t.Errorf("%d err: %s", i, err)
+		for n := range tokens {
+			if tokens[n] != prev[n] {
+				t.Errorf("%d applied edits %v expect %v", i, prev, tokens)
+				break
+			}
+		}
+	}
+
+	_, err := doc.ConvertHighlightCapturesDelta([]uint32{1, 2}, legend)
+
+	if err == nil {
+		t.Errorf("should return error")
+	}
+}
+
+func TestSyncTextDocumentMethods(t *testing.T) {
+	docType := reflect.TypeOf(&textdocument.TextDocument{})
+	syncType := reflect.TypeOf(&textdocument.SyncTextDocument{})
+
+	for i := 0; i < docType.NumMethod(); i++ {
+		method := docType.Method(i)
+		wrapper, ok := syncType.MethodByName(method.Name)
+
+		if !ok {
+			t.Errorf("SyncTextDocument has no %s()", method.Name)
 			continue
 		}
 
-		if pos.Line != item[2] || pos.Character != item[3] {
-			t.Errorf("%d wrong pos %v expect {%d, %d}", i, pos, item[2], item[3])
+		// receivers are different, so compare only arguments and results
+		a, b := method.Type, wrapper.Type
+		same := a.NumIn() == b.NumIn() && a.NumOut() == b.NumOut() && a.IsVariadic() == b.IsVariadic()
+
+		for j := 1; same && j < a.NumIn(); j++ {
+			same = a.In(j) == b.In(j)
+		}
+
+		for j := 0; same && j < a.NumOut(); j++ {
+			same = a.Out(j) == b.Out(j)
+		}
+
+		if !same {
+			t.Errorf("%s() signature %s expect %s", method.Name, b, a)
 		}
 	}
 }
 
-func TestGetNonSpaceTextAroundPosition(t *testing.T) {
-	doc := textdocument.NewTextDocument("asd\nwer zxc")
+func TestSyncTextDocument(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1")
+	doc.SetParser(createParser())
 
-	type Test struct {
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	sd := textdocument.NewSyncTextDocument(doc)
+	legend := textdocument.HighlightLegend{
+		{Type: 0, Modifiers: 0},
+		{Type: 1, Modifiers: 0},
+	}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+
+			for n := 0; n < 50; n++ {
+				err := sd.Change(&textdocument.ChangeEvent{
+					Range: textdocument.NewRange(0, 0, 0, 0),
+					Text:  "x;",
+				})
+
+				if err != nil {
+					t.Errorf("Change err %s", err)
+					return
+				}
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			for n := 0; n < 50; n++ {
+				_, err := sd.GetNodeByPosition(&textdocument.Position{Line: 0, Character: 0})
+
+				if err != nil {
+					t.Errorf("GetNodeByPosition err %s", err)
+					return
+				}
+
+				tokens, err := sd.ConvertHighlightCaptures(legend)
+
+				if err != nil {
+					t.Errorf("ConvertHighlightCaptures err %s", err)
+					return
+				}
+
+				if len(tokens)%5 != 0 {
+					t.Errorf("wrong tokens len %d", len(tokens))
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	text := sd.Text()
+
+	if len(text) != len("var x = 1")+4*50*2 {
+		t.Errorf("wrong text len %d", len(text))
+	}
+
+	sd.Read(func(doc *textdocument.TextDocument) {
+		if len(doc.HighlightCaptures) != 4*50+2 {
+			t.Errorf("wrong captures len %d", len(doc.HighlightCaptures))
+		}
+	})
+}
+
+func getLargeText(lines int) string {
+	return strings.Repeat("var x = 1; // ⌘ comment\n", lines)
+}
+
+func BenchmarkChangeLines(b *testing.B) {
+	doc := textdocument.NewTextDocument(getLargeText(100000))
+	e := &textdocument.ChangeEvent{
+		Range: textdocument.NewRange(50000, 4, 50000, 5),
+		Text:  "y",
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		doc.Change(e)
+	}
+}
+
+func BenchmarkByteIndexLine(b *testing.B) {
+	doc := textdocument.NewTextDocument(getLargeText(500000))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		doc.ByteIndexLine(uint32(i*7919) % doc.TextLength)
+	}
+}
+
+func BenchmarkByteIndexToPoint(b *testing.B) {
+	doc := textdocument.NewTextDocument(getLargeText(500000))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		doc.ByteIndexToPoint(uint32(i*7919) % doc.TextLength)
+	}
+}
+
+func BenchmarkChangeHighlightCaptures(b *testing.B) {
+	doc := textdocument.NewTextDocument(getLargeText(10000))
+	doc.SetParser(createParser())
+
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num\n(comment) @comment"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	e := &textdocument.ChangeEvent{
+		Range: textdocument.NewRange(5000, 4, 5000, 5),
+		Text:  "y",
+	}
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		doc.Change(e)
+		doc.UpdateHighlightCaptures()
+	}
+}
+
+func BenchmarkChangeHighlightCapturesNested(b *testing.B) {
+	text := strings.Repeat("function f() {\n"+strings.Repeat("  var x = 1; // ⌘ comment\n", 100)+"}\n", 100)
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num\n(comment) @comment"), getLang())
+
+	list := []struct {
+		Name string
 		Line uint32
-		Char uint32
-		Text string
+	}{
+		{"start", 50},
+		{"middle", 5000},
+		{"end", 10000},
 	}
 
-	list := []Test{
-		{
-			Line: 0,
-			Char: 0,
-			Text: "asd",
-		},
-		{
-			Line: 0,
-			Char: 1,
-			Text: "asd",
-		},
-		{
-			Line: 1,
-			Char: 0,
-			Text: "wer",
-		},
-		{
-			Line: 1,
-			Char: 1,
-			Text: "wer",
-		},
-		{
-			Line: 1,
-			Char: 3,
-			Text: "wer",
-		},
-		{
-			Line: 1,
-			Char: 4,
-			Text: "zxc",
-		},
-		{
-			Line: 1,
-			Char: 5,
-			Text: "zxc",
-		},
-		{
-			Line: 1,
-			Char: 7,
-			Text: "zxc",
-		},
+	for _, item := range list {
+		b.Run(item.Name, func(b *testing.B) {
+			doc := textdocument.NewTextDocument(text)
+			doc.SetParser(createParser())
+			doc.SetHighlightQuery(q, nil)
+
+			texts := []string{"y", "x"}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				doc.Change(&textdocument.ChangeEvent{
+					Range: textdocument.NewRange(item.Line, 6, item.Line, 7),
+					Text:  texts[i%2],
+				})
+				doc.UpdateHighlightCaptures()
+			}
+		})
 	}
+}
 
-	for i, item := range list {
-		text, err := doc.GetNonSpaceTextAroundPosition(&textdocument.Position{
-			Line:      item.Line,
-			Character: item.Char,
+func BenchmarkUpdateLines(b *testing.B) {
+	doc := textdocument.NewTextDocument(getLargeText(100000))
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		doc.UpdateLines()
+	}
+}
+
+func BenchmarkLineByteIndexToPosition(b *testing.B) {
+	list := []struct {
+		Name string
+		Line string
+	}{
+		{"ascii", strings.Repeat("var x = 1; ", 20)},
+		{"multibyte", strings.Repeat("var ä = 1; ", 20)},
+	}
+
+	for _, item := range list {
+		doc := textdocument.NewTextDocument(item.Line + "\n" + item.Line)
+		length := textdocument.UInt(len(item.Line))
+
+		b.Run(item.Name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// other line every time, so cached offset of line is not used
+				doc.LineByteIndexToPosition(textdocument.UInt(i%2), length)
+			}
 		})
+	}
+}
 
-		if err != nil {
-			t.Errorf("%d err: %s", i, err)
-			continue
-		}
+func BenchmarkSingleLine(b *testing.B) {
+	text := strings.Repeat("var x = 1; ", 20)
 
-		if text != item.Text {
-			t.Errorf("%d wrong text '%s' expected '%s'", i, text, item.Text)
-		}
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		doc := textdocument.NewTextDocument(text)
+		doc.Change(&textdocument.ChangeEvent{
+			Range: textdocument.NewRange(0, 4, 0, 5),
+			Text:  "y",
+		})
 	}
 }
 
-func TestGetNodesByRange(t *testing.T) {
-	text := "var x = 1\nvar y = 2\nvar z = 3"
-	doc := textdocument.NewTextDocument(text)
+func TestConvertHighlightCapturesByRange(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2\nvar zxc = 3")
 	doc.SetParser(createParser())
 
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num"), getLang())
+	doc.SetHighlightQuery(q, nil)
+
+	legend := textdocument.HighlightLegend{
+		{Type: 0, Modifiers: 0},
+		{Type: 1, Modifiers: 1},
+	}
+
 	list := []struct {
-		StartLine uint32
-		StartChar uint32
-		EndLine   uint32
-		EndChar   uint32
-		Values    []string
+		Range  *textdocument.Range
+		Tokens []uint32
 	}{
-		{0, 4, 0, 9, []string{"x = 1"}},
-		{0, 1, 0, 5, []string{"var", "x"}},
-		{0, 8, 2, 1, []string{"1", "var y = 2", "var"}},
-		{1, 0, 1, 9, []string{"var y = 2"}},
-		{1, 0, 2, 0, []string{"var y = 2"}},
-		{2, 8, 2, 9, []string{"3"}},
+		{textdocument.NewRange(0, 0, 2, 11), []uint32{
+			0, 4, 1, 0, 0,
+			0, 4, 1, 1, 1,
+			1, 4, 1, 0, 0,
+			0, 4, 1, 1, 1,
+			1, 4, 3, 0, 0,
+			0, 6, 1, 1, 1,
+		}},
+		{textdocument.NewRange(1, 0, 1, 9), []uint32{
+			1, 4, 1, 0, 0,
+			0, 4, 1, 1, 1,
+		}},
+		{textdocument.NewRange(1, 6, 2, 5), []uint32{
+			1, 8, 1, 1, 1,
+			1, 4, 3, 0, 0,
+		}},
+		{textdocument.NewRange(1, 0, 1, 3), []uint32{}},
 	}
 
 	for i, item := range list {
-		start := proto.Position{
-			Line:      item.StartLine,
-			Character: item.StartChar,
-		}
-		end := proto.Position{
-			Line:      item.EndLine,
-			Character: item.EndChar,
-		}
-		nodes, err := doc.GetNodesByRange(&start, &end)
+		tokens, err := doc.ConvertHighlightCapturesByRange(&item.Range.Start, &item.Range.End, legend)
 
 		if err != nil {
-			t.Errorf("%d err: %s", i, err)
+			t.Errorf("%d err %s", i, err)
 			continue
 		}
 
-		values := make([]string, len(nodes))
-
-		for i, node := range nodes {
-			values[i] = node.Content([]byte(text))
-		}
-
-		if len(values) != len(item.Values) {
-			t.Errorf("%d values: %v expect %v", i, values, item.Values)
+		if len(tokens) != len(item.Tokens) {
+			t.Errorf("%d tokens %v expect %v", i, tokens, item.Tokens)
 			continue
 		}
 
-		for j, value := range item.Values {
-			if values[j] != value {
-				t.Errorf("%d:%d value: '%s' expect '%s'", i, j, values[j], value)
+		for n := range tokens {
+			if tokens[n] != item.Tokens[n] {
+				t.Errorf("%d tokens %v expect %v", i, tokens, item.Tokens)
+				break
 			}
 		}
 	}
 }
 
-func TestGetNodeByPosition(t *testing.T) {
-	text := "var x = 1\nvar y =  2\nvar z = 3"
-	doc := textdocument.NewTextDocument(text)
-	doc.SetParser(createParser())
+func TestParseRegion(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = `a {}`")
 
-	list := []struct {
-		StartLine uint32
-		StartChar uint32
-		Value     string
-	}{
-		{0, 4, "x"},
-		{0, 1, "var"},
-		{0, 8, "1"},
-		{1, 0, "var"},
-		{1, 5, "y"},
-		{1, 8, ""},
-		{2, 9, "3"},
-	}
+	tree, err := doc.ParseRegion(css.GetLanguage(), *textdocument.NewRange(0, 9, 0, 13))
 
-	for i, item := range list {
-		start := proto.Position{
-			Line:      item.StartLine,
-			Character: item.StartChar,
-		}
-		node, err := doc.GetNodeByPosition(&start)
+	if err != nil {
+		t.Fatalf("ParseRegion err %s", err)
+	}
 
-		if err != nil {
-			t.Errorf("%d err: %s", i, err)
-			continue
-		}
+	defer tree.Close()
 
-		if node == nil {
-			if item.Value == "" {
-				continue
-			}
+	root := tree.RootNode()
 
-			t.Errorf("%d node nil, pos: %v", i, item)
-			continue
-		}
+	if root.Type() != "stylesheet" || root.StartByte() != 9 || root.EndByte() != 13 || root.HasError() {
+		t.Errorf("wrong region tree %s %d-%d", root.String(), root.StartByte(), root.EndByte())
+	}
 
-		value := node.Content([]byte(text))
+	_, err = doc.ParseRegion(css.GetLanguage(), *textdocument.NewRange(1, 0, 1, 1))
 
-		if item.Value != value {
-			t.Errorf("%d value: '%s' expect '%s'", i, value, item.Value)
-		}
+	if err == nil {
+		t.Errorf("region out of text should return error")
 	}
 }
 
-func TestHighlights(t *testing.T) {
-	doc := textdocument.NewTextDocument("var x = 1\nvar y = 2\nvar zxc = 3")
+func TestInjectionRegionShift(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = `a {}`")
 	doc.SetParser(createParser())
 
-	pattern := "(identifier) @ident\n(number) @num"
-	q, _ := sitter.NewQuery([]byte(pattern), getLang())
-	doc.SetHighlightQuery(q, &textdocument.Ignore{
-		Missing: true,
-		Extra:   true,
-	})
+	inj, err := doc.AddInjection(css.GetLanguage(), nil, *textdocument.NewRange(0, 9, 0, 13))
 
-	if len(doc.HighlightCaptures) != 6 {
-		t.Errorf("init HighlightCaptures wrong len %d expect %d", len(doc.HighlightCaptures), 6)
+	if err != nil {
+		t.Fatalf("AddInjection err %s", err)
 	}
 
-	capTests := []struct {
-		Line  uint32
-		Char  uint32
-		Index uint32
-		Value string
+	list := []struct {
+		Range  *textdocument.Range
+		Text   string
+		Region *textdocument.Range
 	}{
-		{0, 8, 1, "1"},
-		{1, 4, 0, "y"},
-		{2, 11, 1, "3"},
+		{textdocument.NewRange(0, 0, 0, 0), "var y;\n", textdocument.NewRange(1, 9, 1, 13)},
+		{textdocument.NewRange(1, 13, 1, 13), " b {}", textdocument.NewRange(1, 9, 1, 18)},
+		{textdocument.NewRange(1, 10, 1, 10), "\n", textdocument.NewRange(1, 9, 2, 8)},
+		{textdocument.NewRange(0, 0, 1, 0), "", textdocument.NewRange(0, 9, 1, 8)},
+		{textdocument.NewRange(1, 8, 1, 9), "", textdocument.NewRange(0, 9, 1, 8)},
 	}
 
-	for i, item := range capTests {
-		cap, err := doc.GetHighlightCaptureByPosition(&textdocument.Position{
-			Line:      item.Line,
-			Character: item.Char,
+	for i, item := range list {
+		err := doc.Change(&textdocument.ChangeEvent{
+			Range: item.Range,
+			Text:  item.Text,
 		})
 
 		if err != nil {
-			t.Errorf("%d err %s", i, err)
-			continue
+			t.Fatalf("%d change err %s", i, err)
 		}
 
-		if cap.Index != item.Index {
-			t.Errorf("%d cap wrong Index %d expect %d", i, cap.Index, item.Index)
+		if inj.Region != *item.Region {
+			t.Errorf("%d region %v expect %v", i, inj.Region, *item.Region)
 		}
 
-		str := cap.Node.Content([]byte(doc.Text))
+		start, end := doc.NodeByteRange(inj.Tree.RootNode())
+		r, _ := doc.RangeToSitterRange(&inj.Region)
 
-		if str != item.Value {
-			t.Errorf("%d cap.Node.Content '%s' expect '%s'", i, str, item.Value)
+		if inj.Tree.RootNode().Type() != "stylesheet" || start != r.StartByte || end != r.EndByte {
+			t.Errorf("%d tree %d-%d expect %d-%d", i, start, end, r.StartByte, r.EndByte)
 		}
 	}
 
-	closestTests := []struct {
-		Line   uint32
-		Char   uint32
-		Prev   string
-		Target string
-		Next   string
+	// full replacements move region by changed part of text
+	batches := []struct {
+		Events []*textdocument.ChangeEvent
+		Region *textdocument.Range
 	}{
-		{0, 0, "", "", "x"},
-		{0, 4, "", "x", "1"},
-		{0, 5, "", "x", "1"},
-		{0, 6, "x", "", "1"},
-		{0, 8, "x", "1", "y"},
-		{0, 9, "x", "1", "y"},
-		{1, 0, "1", "", "y"},
-		{2, 11, "zxc", "3", ""},
+		{[]*textdocument.ChangeEvent{{Text: "var y;\nvar x = `a {}`"}}, textdocument.NewRange(1, 9, 1, 13)},
+		{[]*textdocument.ChangeEvent{{Text: "var x = `a {}`"}, {Range: textdocument.NewRange(0, 0, 0, 0), Text: "\n\n"}}, textdocument.NewRange(2, 9, 2, 13)},
+		{[]*textdocument.ChangeEvent{{Range: textdocument.NewRange(0, 0, 0, 4), Text: ""}, {Text: "let z = 1;\nvar x = `a {}`"}}, textdocument.NewRange(1, 9, 1, 13)},
 	}
 
-	for i, item := range closestTests {
-		prev, target, next, err := doc.GetClosestHighlightCaptureByPosition(&textdocument.Position{
-			Line:      item.Line,
-			Character: item.Char,
-		})
+	for i, item := range batches {
+		doc := textdocument.NewTextDocument("var x = `a {}`")
+		doc.SetParser(createParser())
+		inj, _ := doc.AddInjection(css.GetLanguage(), nil, *textdocument.NewRange(0, 9, 0, 13))
+
+		err := doc.ChangeMany(item.Events, nil)
 
 		if err != nil {
-			t.Errorf("%d err %s", i, err)
+			t.Errorf("%d batch err %s", i, err)
 			continue
 		}
 
-		caps := []*sitter.QueryCapture{prev, target, next}
-		values := []string{item.Prev, item.Target, item.Next}
-
-		for n, cap := range caps {
-			if cap == nil {
-				if values[n] != "" {
-					t.Errorf("%d cap %d is nil expect '%s'", i, n, values[n])
-					break
-				}
-
-				continue
-			}
-
-			value := cap.Node.Content([]byte(doc.Text))
-
-			if value != values[n] {
-				t.Errorf("%d cap %d is '%s' expect '%s'", i, n, value, values[n])
-				break
-			}
+		if inj.Region != *item.Region || doc.NodeText(inj.Tree.RootNode()) != "a {}" {
+			t.Errorf("%d batch region %v expect %v", i, inj.Region, *item.Region)
 		}
 	}
+}
 
-	list := []struct {
-		Pos  []uint32
-		Text string
-	}{
-		{[]uint32{0, 4, 0, 5}, "z"},
-		{[]uint32{1, 8, 1, 9}, "4"},
-		{[]uint32{2, 5, 2, 11}, "cx = 5"},
-		{[]uint32{0, 7, 0, 7}, "  "},
-		{[]uint32{2, 4, 2, 5}, ""},
-	}
+func TestAddInjection(t *testing.T) {
+	doc := textdocument.NewTextDocument("var x = `\na { color: red }\n`\nvar y = 1")
+	doc.SetParser(createParser())
 
-	for i, item := range list {
-		start := &proto.Position{
-			Line:      item.Pos[0],
-			Character: item.Pos[1],
-		}
-		end := &proto.Position{
-			Line:      item.Pos[2],
-			Character: item.Pos[3],
-		}
+	q, _ := sitter.NewQuery([]byte("(identifier) @ident\n(number) @num"), getLang())
+	doc.SetHighlightQuery(q, nil)
 
-		err := doc.Change(&textdocument.ChangeEvent{
-			Range: &proto.Range{
-				Start: *start,
-				End:   *end,
-			},
-			Text: item.Text,
-		})
+	cssQuery, _ := sitter.NewQuery([]byte("(tag_name) @ident\n(plain_value) @num"), css.GetLanguage())
+	inj, err := doc.AddInjection(css.GetLanguage(), cssQuery, *textdocument.NewRange(1, 0, 1, 16))
 
-		if err != nil {
-			t.Errorf("%d err %s", i, err)
-		}
+	if err != nil {
+		t.Fatalf("AddInjection err %s", err)
+	}
+
+	if inj.Tree == nil || inj.Tree.RootNode().Type() != "stylesheet" {
+		t.Fatalf("wrong injection tree")
 	}
 
 	legend := textdocument.HighlightLegend{
-		{
-			Type:      0,
-			Modifiers: 0,
-		},
-		{
-			Type:      1,
-			Modifiers: 1,
-		},
+		{Type: 0, Modifiers: 0},
+		{Type: 1, Modifiers: 0},
 	}
 
-	tags, err := doc.ConvertHighlightCaptures(legend)
+	tokens, err := doc.ConvertHighlightCaptures(legend)
 
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatalf("err %s", err)
 	}
 
-	comp := []uint32{
+	check := []uint32{
 		0, 4, 1, 0, 0,
-		0, 6, 1, 1, 1,
-		1, 4, 1, 0, 0,
-		0, 4, 1, 1, 1,
-		1, 4, 2, 0, 0,
-		0, 5, 1, 1, 1,
+		1, 0, 1, 0, 0,
+		0, 11, 3, 1, 0,
+		2, 4, 1, 0, 0,
+		0, 4, 1, 1, 0,
 	}
 
-	count := len(comp)
+	if fmt.Sprint(tokens) != fmt.Sprint(check) {
+		t.Errorf("tokens %v expect %v", tokens, check)
+	}
 
-	if len(tags) != count {
-		t.Errorf("tags len %d expected %d", len(tags), count)
-		return
+	err = doc.Change(&textdocument.ChangeEvent{
+		Range: textdocument.NewRange(1, 0, 1, 1),
+		Text:  "b",
+	})
+
+	if err != nil {
+		t.Fatalf("Change err %s", err)
 	}
 
-	for i := 0; i < count; i += 5 {
-		for n := 0; n < 5; n++ {
-			if tags[i+n] != comp[i+n] {
-				t.Errorf("%d wrong tag %v expected %v\n", i/5, tags[i:i+5], comp[i:i+5])
-				return
-			}
-		}
+	caps := doc.GetHighlightCapturesByRange(&sitter.Point{Row: 1, Column: 0}, &sitter.Point{Row: 1, Column: 1})
+
+	if len(caps) != 1 || caps[0].Node.Content([]byte(doc.Text)) != "b" {
+		t.Errorf("injection captures were not updated")
 	}
 }